@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	dcmgmt "github.com/vpngen/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+	"github.com/vpngen/keydesk/keydesk"
+)
+
+const maxBatchLine = 64 * 1024
+
+// batchSpec - brigade spec line, the fields are the same as the args.
+type batchSpec struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Person string `json:"person"`
+	Desc   string `json:"desc"`
+	URL    string `json:"url"`
+	IP     string `json:"ip,omitempty"`
+}
+
+// batchAnswer - answer line per brigade, the id is the same as in the spec.
+type batchAnswer struct {
+	ID string `json:"id"`
+	dcmgmt.Answer
+}
+
+// createBatch - reads brigade specs from stdin, creates the brigades,
+// writes the answers in the specs order.
+func createBatch(w io.Writer, conf *brigade.Config) error {
+	var (
+		answers []*batchAnswer
+		batch   []*brigade.Opts
+		idx     []int // answer index of the opts
+	)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, maxBatchLine), maxBatchLine)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		spec := &batchSpec{}
+		if err := json.Unmarshal([]byte(line), spec); err != nil {
+			answers = append(answers, failedAnswer(fmt.Sprintf("line %d", n), fmt.Errorf("spec: %w", err)))
+
+			continue
+		}
+
+		opts, err := newOpts(spec.ID, spec.Name, spec.Person, spec.Desc, spec.URL, spec.IP)
+		if err != nil {
+			answers = append(answers, failedAnswer(spec.ID, err))
+
+			continue
+		}
+
+		idx = append(idx, len(answers))
+		answers = append(answers, &batchAnswer{ID: spec.ID})
+		batch = append(batch, opts)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read specs: %w", err)
+	}
+
+	slog.Info("batch", "brigades", len(batch), "invalid", len(answers)-len(batch))
+
+	for k, res := range brigade.CreateBatch(context.Background(), conf, batch) {
+		id := answers[idx[k]].ID
+
+		if res.Err != nil {
+			slog.Error("can't create brigade", logging.KeyBrigade, id, logging.KeyError, res.Err)
+
+			answers[idx[k]] = failedAnswer(id, res.Err)
+
+			continue
+		}
+
+		answers[idx[k]] = &batchAnswer{
+			ID: id,
+			Answer: dcmgmt.Answer{
+				Answer: keydesk.Answer{
+					Code:    http.StatusCreated,
+					Desc:    http.StatusText(http.StatusCreated),
+					Status:  keydesk.AnswerStatusSuccess,
+					Configs: res.Result.Configs,
+				},
+				KeydeskIPv6: res.Result.KeydeskIPv6,
+				FreeSlots:   int(res.Result.FreeSlots),
+				Delegation:  res.Result.Delegation,
+			},
+		}
+	}
+
+	enc := json.NewEncoder(w)
+
+	for _, answ := range answers {
+		if err := enc.Encode(answ); err != nil {
+			return fmt.Errorf("write answer: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func failedAnswer(id string, err error) *batchAnswer {
+	return &batchAnswer{
+		ID: id,
+		Answer: dcmgmt.Answer{
+			Answer: keydesk.Answer{
+				Code:    http.StatusInternalServerError,
+				Desc:    http.StatusText(http.StatusInternalServerError),
+				Status:  "error",
+				Message: err.Error(),
+			},
+		},
+	}
+}
@@ -0,0 +1,34 @@
+#!/bin/sh
+
+set -e
+
+DBNAME=${DBNAME:-"vgrealm"}
+echo "dbname: $DBNAME"
+SCHEMA_PAIRS=${PSCHEMA:-"pairs"}
+echo "schema: $SCHEMA_PAIRS"
+
+control_ip="$1"
+shift
+
+if [ -z "${control_ip}" ]; then
+    echo "Usage: $0 <control_ip> [label]..."
+    exit 1
+fi
+
+labels=""
+for label in "$@" ; do
+    labels="${labels:+${labels},}\"${label}\""
+done
+
+ON_ERROR_STOP=yes psql -v -a -d "${DBNAME}" \
+    --set schema_name="${SCHEMA_PAIRS}" \
+    --set control_ip="${control_ip}" \
+    --set labels="{${labels}}" <<EOF
+BEGIN;
+
+UPDATE :"schema_name".pairs SET labels=:'labels'::text[] WHERE control_ip=:'control_ip';
+
+COMMIT;
+EOF
+
+echo "Set labels {${labels}} for pair ${control_ip}"
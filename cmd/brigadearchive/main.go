@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "brigadearchive"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked bool
+	jout    bool
+	query   brigade.ArchiveQuery
+}
+
+// The purged brigades are looked up by the brigade ID, the brigadier name, the endpoint or the domain.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	list, err := brigade.SearchArchive(context.Background(), conf, a.query)
+	if err != nil {
+		logging.Fatal(logger, "can't search archive", err)
+	}
+
+	if a.jout {
+		if list == nil {
+			list = []*brigade.Archived{}
+		}
+
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			logging.Fatal(logger, "can't print archive", err)
+		}
+
+		return
+	}
+
+	for _, b := range list {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			b.PurgedAt.Format(time.RFC3339), b.BrigadeID, b.Brigadier, b.EndpointIPv4, b.Domain, b.ControlIP, b.KeydeskIPv6, b.Reason,
+		); err != nil {
+			logging.Fatal(logger, "can't print archive", err)
+		}
+	}
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id (uuid)")
+	endpoint := flag.String("ip", "", "endpoint ipv4")
+	flag.StringVar(&a.query.Brigadier, "name", "", "brigadier name")
+	flag.StringVar(&a.query.Domain, "domain", "", "domain name")
+	flag.IntVar(&a.query.Limit, "n", 0, "max records, 100 by default")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+
+	flag.Parse()
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != uuid.Nil {
+		a.query.BrigadeID = id.String()
+	}
+
+	if *endpoint != "" {
+		addr, err := netip.ParseAddr(*endpoint)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("endpoint: %s: %w", *endpoint, errInlalidArgs)
+		}
+
+		a.query.EndpointIPv4 = addr
+	}
+
+	if a.query.BrigadeID == "" && a.query.Brigadier == "" && !a.query.EndpointIPv4.IsValid() && a.query.Domain == "" {
+		return nil, fmt.Errorf("no search conditions: %w", errInlalidArgs)
+	}
+
+	return a, nil
+}
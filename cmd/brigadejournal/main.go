@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	CommandList     = "list"
+	CommandResume   = "resume"
+	CommandRollback = "rollback"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "brigadejournal"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked bool
+	jout    bool
+	cmd     string
+	id      string
+	force   bool
+}
+
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	ctx := context.Background()
+
+	switch a.cmd {
+	case CommandList:
+		list, err := brigade.ListJournals(ctx, conf)
+		if err != nil {
+			logging.Fatal(logger, "can't list journals", err)
+		}
+
+		if a.jout {
+			if list == nil {
+				list = []*brigade.Journal{}
+			}
+
+			if err := json.NewEncoder(w).Encode(list); err != nil {
+				logging.Fatal(logger, "can't print journals", err)
+			}
+
+			return
+		}
+
+		for _, j := range list {
+			if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\t%s\n",
+				j.BrigadeID, j.Operation, j.State, j.Step, j.StepsDone, j.UpdateTime.Format("2006-01-02T15:04:05Z07:00"), j.LastError,
+			); err != nil {
+				logging.Fatal(logger, "can't print journals", err)
+			}
+		}
+	case CommandResume:
+		res, err := brigade.Resume(ctx, conf, a.id, a.force)
+		if err != nil {
+			logging.Fatal(logger, "can't resume brigade", err)
+		}
+
+		logger.Info("brigade is created", logging.KeyBrigade, a.id, "keydesk", res.KeydeskIPv6, "free_slots", res.FreeSlots)
+	case CommandRollback:
+		if err := brigade.Rollback(ctx, conf, a.id, a.force); err != nil {
+			logging.Fatal(logger, "can't rollback brigade", err)
+		}
+
+		logger.Info("brigade is rolled back", logging.KeyBrigade, a.id)
+	}
+}
+
+func parseArgs() (*args, error) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s|%s|%s [options]\n", os.Args[0], CommandList, CommandResume, CommandRollback)
+		flag.PrintDefaults()
+	}
+
+	a := &args{}
+
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+	flag.Parse()
+
+	if len(flag.Args()) < 1 {
+		return nil, fmt.Errorf("no command specified")
+	}
+
+	a.cmd = flag.Args()[0]
+
+	switch a.cmd {
+	case CommandList:
+		return a, nil
+	case CommandResume, CommandRollback:
+		cmdFlags := flag.NewFlagSet(a.cmd, flag.ExitOnError)
+		brigadeID := cmdFlags.String("id", "", "brigadier_id")
+		brigadeUUID := cmdFlags.String("uuid", "", "brigadier_id (uuid)")
+		cmdFlags.BoolVar(&a.force, "f", false, "don't wait for the journal to become stale, ignore rollback errors")
+		cmdFlags.Usage = func() {
+			fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s [options]\n", os.Args[0], a.cmd)
+			cmdFlags.PrintDefaults()
+		}
+
+		cmdFlags.Parse(flag.Args()[1:])
+
+		id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+		switch {
+		case err != nil:
+			return nil, err
+		case id == uuid.Nil:
+			return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+		}
+
+		a.id = id.String()
+
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unknown command: %w", errInlalidArgs)
+	}
+}
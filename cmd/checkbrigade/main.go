@@ -2,20 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/base32"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http/httputil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 )
 
 const (
@@ -43,35 +48,54 @@ func setLogTag() string {
 	return filepath.Base(executable)
 }
 
+type args struct {
+	chunked   bool
+	jout      bool
+	deep      bool
+	freshness time.Duration
+	bid32     string
+	id        string
+}
+
+// The deep check compares the brigade with the pair, the DNS and the stats
+// and prints the report, the plain check prints the brigade stats.
 func main() {
+	logger := logging.Setup(LogTag)
+
 	var w io.WriteCloser
 
-	chunked, bid32, id, err := parseArgs()
+	a, err := parseArgs()
 	if err != nil {
-		log.Fatalf("%s: Can't parse args: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	if a.deep {
+		deepCheck(logger, a)
+
+		return
 	}
 
 	dbname, schemaBrigades, schemaStats, err := readConfigs()
 	if err != nil {
-		log.Fatalf("%s: Can't read configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't read configs", err)
 	}
 
 	db, err := createDBPool(dbname)
 	if err != nil {
-		log.Fatalf("%s: Can't create db pool: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't create db pool", err)
 	}
 
 	// attention! id - uuid-style string.
-	brigadeGetID, totalUsersCount, activeUsersCount, createdAt, firstVisit, err := checkBrigade(db, schemaBrigades, schemaStats, id)
+	brigadeGetID, totalUsersCount, activeUsersCount, createdAt, firstVisit, err := checkBrigade(db, schemaBrigades, schemaStats, a.id)
 	if err != nil {
-		log.Fatalf("%s: Can't check brigade: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't check brigade", err)
 	}
 
-	if brigadeGetID != id {
-		log.Fatalf("%s: Brigade ID not matched: %s vs %s\n", LogTag, id, brigadeGetID)
+	if brigadeGetID != a.id {
+		logging.Fatal(logger, "brigade id not matched", fmt.Errorf("%s vs %s", a.id, brigadeGetID))
 	}
 
-	switch chunked {
+	switch a.chunked {
 	case true:
 		w = httputil.NewChunkedWriter(os.Stdout)
 		defer w.Close()
@@ -80,13 +104,54 @@ func main() {
 	}
 
 	fmt.Fprintln(w, brigadeGetID)
-	fmt.Fprintln(w, bid32)
+	fmt.Fprintln(w, a.bid32)
 	fmt.Fprintln(w, totalUsersCount)
 	fmt.Fprintln(w, activeUsersCount)
 	fmt.Fprintln(w, createdAt)
 	fmt.Fprintln(w, firstVisit)
 }
 
+func deepCheck(logger *slog.Logger, a *args) {
+	var w io.WriteCloser
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	report, err := brigade.CheckHealth(context.Background(), conf, a.id, a.freshness)
+	if err != nil {
+		logging.Fatal(logger, "can't check brigade", err, logging.KeyBrigade, a.id)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if a.jout {
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logging.Fatal(logger, "can't print report", err)
+		}
+
+		return
+	}
+
+	for _, check := range report.Checks {
+		result := "fail"
+		if check.Pass {
+			result = "pass"
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, result, check.Detail); err != nil {
+			logging.Fatal(logger, "can't print report", err)
+		}
+	}
+}
+
 func checkBrigade(db *pgxpool.Pool, schemaBrigades, schemaStats, brigadeID string) (string, int, int, string, string, error) {
 	ctx := context.Background()
 
@@ -156,39 +221,29 @@ func createDBPool(dburl string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-func parseArgs() (bool, string, string, error) {
+func parseArgs() (*args, error) {
+	a := &args{}
+
 	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
 	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
-	chunked := flag.Bool("ch", false, "chunked output")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.deep, "deep", false, "check the brigade on the pair, the delegations and the stats freshness")
+	flag.BoolVar(&a.jout, "j", false, "json output, deep check only")
+	flag.DurationVar(&a.freshness, "fresh", brigade.DefaultStatsFreshness, "max stats age, deep check only")
 
 	flag.Parse()
 
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
 	switch {
-	case *brigadeID != "" && *brigadeUUID == "":
-		// brigadeID must be base32 decodable.
-		buf, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(*brigadeID)
-		if err != nil {
-			return false, "", "", fmt.Errorf("id base32: %s: %w", *brigadeID, err)
-		}
-
-		id, err := uuid.FromBytes(buf)
-		if err != nil {
-			return false, "", "", fmt.Errorf("id uuid: %s: %w", *brigadeID, err)
-		}
-
-		return *chunked, *brigadeID, id.String(), nil
-	case *brigadeUUID != "" && *brigadeID == "":
-		id, err := uuid.Parse(*brigadeUUID)
-		if err != nil {
-			return false, "", "", fmt.Errorf("id uuid: %s: %w", *brigadeID, err)
-		}
+	case err != nil:
+		return nil, err
+	case id == uuid.Nil:
+		return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+	}
 
-		bid := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id[:])
+	a.bid32, a.id = kdlib.BrigadeID32(id), id.String()
 
-		return *chunked, bid, id.String(), nil
-	default:
-		return false, "", "", fmt.Errorf("both ids: %w", errInlalidArgs)
-	}
+	return a, nil
 }
 
 func readConfigs() (string, string, string, error) {
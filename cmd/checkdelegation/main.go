@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const defaultWatchPause = 10 * time.Second
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "checkdelegation"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked bool
+	jout    bool
+	list    bool
+	all     bool
+	watch   time.Duration
+	id      string
+}
+
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	ctx := context.Background()
+
+	var list []*brigade.Delegation
+
+	switch a.list {
+	case true:
+		list, err = brigade.ListDelegations(ctx, conf, a.id, a.all)
+		if err != nil {
+			logging.Fatal(logger, "can't list delegations", err)
+		}
+	default:
+		finish := time.Now().Add(a.watch)
+
+		for {
+			list, err = brigade.CheckDelegations(ctx, conf, a.id)
+			if err != nil {
+				logging.Fatal(logger, "can't check delegations", err)
+			}
+
+			if !pending(list) || time.Now().Add(defaultWatchPause).After(finish) {
+				break
+			}
+
+			time.Sleep(defaultWatchPause)
+		}
+	}
+
+	if a.jout {
+		if list == nil {
+			list = []*brigade.Delegation{}
+		}
+
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			logging.Fatal(logger, "can't print delegations", err)
+		}
+
+		return
+	}
+
+	for _, d := range list {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%v\t%d\t%s\n",
+			d.BrigadeID, d.State, d.KeydeskFQDN, d.KeydeskOk, d.Domain, d.DomainOk, d.Attempts, d.CheckTime.Format("2006-01-02T15:04:05Z07:00"),
+		); err != nil {
+			logging.Fatal(logger, "can't print delegations", err)
+		}
+	}
+}
+
+func pending(list []*brigade.Delegation) bool {
+	for _, d := range list {
+		if d.State == brigade.DelegationPending {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id (uuid)")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+	flag.BoolVar(&a.list, "l", false, "list only, don't check")
+	flag.BoolVar(&a.all, "a", false, "list the done delegations too")
+	flag.DurationVar(&a.watch, "w", 0, "repeat the checks until nothing is pending or the time is over")
+
+	flag.Parse()
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != uuid.Nil {
+		a.id = id.String()
+	}
+
+	return a, nil
+}
@@ -4,13 +4,14 @@ import (
 	"encoding/base32"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/netip"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 	"github.com/vpngen/dc-mgmt/internal/snap"
 	"golang.org/x/crypto/ssh"
 )
@@ -73,7 +74,7 @@ func collectSnaps(wg *sync.WaitGroup, stream chan<- *snap.IncomingSnaps, sem <-c
 	}()
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: [%s]: fetch snaps: %s\n", LogTag, opts.addr, err)
+		slog.Error("can't fetch snaps", logging.KeyControlIP, opts.addr, logging.KeyError, err)
 
 		parsedStats.TotalCount = len(opts.brigades)
 		parsedStats.ErrorsCount = parsedStats.TotalCount
@@ -81,10 +82,8 @@ func collectSnaps(wg *sync.WaitGroup, stream chan<- *snap.IncomingSnaps, sem <-c
 		return
 	}
 
-	// fmt.Fprintf(os.Stderr, "fetch stats: %s\n", groupStats)
-
 	if err := json.Unmarshal(groupStats, &parsedStats); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: [%s]: unmarshal snaps: %s\n", LogTag, opts.addr, err)
+		slog.Error("can't unmarshal snaps", logging.KeyControlIP, opts.addr, logging.KeyError, err)
 
 		parsedStats.TotalCount = len(opts.brigades)
 		parsedStats.ErrorsCount = parsedStats.TotalCount
@@ -93,17 +92,15 @@ func collectSnaps(wg *sync.WaitGroup, stream chan<- *snap.IncomingSnaps, sem <-c
 	}
 
 	if len(opts.brigades) != parsedStats.TotalCount {
-		fmt.Fprintf(os.Stderr,
-			"%s: [%s]: brigades count mismatch: %d != %d\n", LogTag, opts.addr,
-			len(opts.brigades), parsedStats.TotalCount)
+		slog.Warn("brigades count mismatch", logging.KeyControlIP, opts.addr,
+			"requested", len(opts.brigades), "total", parsedStats.TotalCount)
 
 		parsedStats.TotalCount = len(opts.brigades)
 	}
 
 	if parsedStats.TotalCount-parsedStats.ErrorsCount != len(parsedStats.Snaps) {
-		fmt.Fprintf(os.Stderr,
-			"%s: [%s]: brigades count mismatch: %d != %d\n", LogTag, opts.addr,
-			parsedStats.TotalCount-parsedStats.ErrorsCount, len(parsedStats.Snaps))
+		slog.Warn("snaps count mismatch", logging.KeyControlIP, opts.addr,
+			"succeeded", parsedStats.TotalCount-parsedStats.ErrorsCount, "snaps", len(parsedStats.Snaps))
 
 		parsedStats.ErrorsCount = parsedStats.TotalCount - len(parsedStats.Snaps)
 	}
@@ -120,7 +117,7 @@ func fetchSnapsBySSH(opts *collectConfig, ids []string) (func(string), []byte, e
 		opts.maintenanceMode,
 	)
 
-	fmt.Fprintf(os.Stderr, "%s#%s:22 -> %s\n", sshkeyRemoteUsername, opts.addr, cmd)
+	slog.Info("node command", logging.KeyControlIP, opts.addr, "user", sshkeyRemoteUsername, logging.KeyCmd, cmd)
 
 	client, b, e, cleanup, err := kdlib.NewSSHCient(opts.sshconf, opts.addr.String()+":22")
 	if err != nil {
@@ -2,13 +2,13 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 	"github.com/vpngen/dc-mgmt/internal/snap"
 )
 
@@ -35,34 +35,36 @@ func setLogTag() string {
 }
 
 func main() {
+	logger := logging.Setup(LogTag)
+
 	opts, err := readConfigs()
 	if err != nil {
-		log.Fatalf("%s: Can't read configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't read configs", err)
 	}
 
 	if err := parseArgs(opts); err != nil {
-		log.Fatalf("%s: Can't parse args: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't parse args", err)
 	}
 
 	sshconf, err := kdlib.CreateSSHConfig(opts.sshKeyFilename, opts.sshKeyRemoteUsername, kdlib.SSHDefaultTimeOut)
 	if err != nil {
-		log.Fatalf("%s: Can't create ssh configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't create ssh configs", err)
 	}
 
 	db, err := kdlib.CreateDBPool(opts.dbURL)
 	if err != nil {
-		log.Fatalf("%s: Can't create db pool: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't create db pool", err)
 	}
 
 	baseTag, stime := adjustTag(opts)
 	snapFile, err := composeFilename(opts.storageDir, baseTag, opts.tag)
 	if err != nil {
-		log.Fatalf("%s: Can't compose filename: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't compose filename", err)
 	}
 
 	psk, epsk, err := snap.GenPSK(opts.realmRSA)
 	if err != nil {
-		log.Fatalf("%s: Can't generate psk: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't generate psk", err)
 	}
 
 	if err := pairsWalk(&walkConfig{
@@ -76,11 +78,11 @@ func main() {
 
 		config: opts,
 	}); err != nil {
-		log.Fatalf("%s: Can't collect stats: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't collect stats", err)
 	}
 
 	if err := rotateSnapshots(opts.storageDir, baseTag, opts.tag); err != nil {
-		log.Fatalf("%s: Can't rotate snapshots: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't rotate snapshots", err)
 	}
 }
 
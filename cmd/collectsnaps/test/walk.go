@@ -35,7 +35,7 @@ func pairsWalk(opts *walkConfig) error {
 	var wgh sync.WaitGroup
 
 	wgh.Add(1)
-	go snap.HandleSnapsStream(LogTag, data, opts.snapFile, stream, &wgh)
+	go snap.HandleSnapsStream(data, opts.snapFile, stream, &wgh)
 
 	collectSnaps(stream, &collectConfig{
 		tag:     opts.tag,
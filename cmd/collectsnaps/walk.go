@@ -55,7 +55,7 @@ func pairsWalk(opts *walkConfig) error {
 	var wgh sync.WaitGroup
 
 	wgh.Add(1)
-	go snap.HandleSnapsStream(LogTag, data, opts.snapFile, stream, &wgh)
+	go snap.HandleSnapsStream(data, opts.snapFile, stream, &wgh)
 
 	for _, group := range groups {
 		sem <- struct{}{} // Acquire the semaphore
@@ -8,7 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http/httputil"
 	"net/netip"
 	"os"
@@ -23,6 +23,7 @@ import (
 	"github.com/jackc/pgx/v5/pgtype/zeronull"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 	"github.com/vpngen/keydesk/keydesk/storage"
 	"golang.org/x/crypto/ssh"
 )
@@ -119,37 +120,39 @@ func setLogTag() string {
 }
 
 func main() {
+	logger := logging.Setup(LogTag)
+
 	sshKeyFilename, dbname, pairsSchema, brigadesSchema, statsSchema, dcName, dcID, err := readConfigs()
 	if err != nil {
-		log.Fatalf("%s: Can't read configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't read configs", err)
 	}
 
 	storePath, err := parseArgs()
 	if err != nil {
-		log.Fatalf("%s: Can't parse args: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't parse args", err)
 	}
 
 	if _, err := os.Stat(storePath); os.IsNotExist(err) {
 		if err := os.MkdirAll(storePath, 0o755); err != nil {
-			log.Fatalf("%s: Can't create store path: %s\n", LogTag, err)
+			logging.Fatal(logger, "can't create store path", err, "path", storePath)
 		}
 	}
 
 	sshconf, err := kdlib.CreateSSHConfig(sshKeyFilename, sshkeyRemoteUsername, kdlib.SSHDefaultTimeOut)
 	if err != nil {
-		log.Fatalf("%s: Can't create ssh configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't create ssh configs", err)
 	}
 
 	db, err := createDBPool(dbname)
 	if err != nil {
-		log.Fatalf("%s: Can't create db pool: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't create db pool", err)
 	}
 
 	dateSuffix := time.Now().UTC().Format("20060102-150405")
 	statsFileName := fmt.Sprintf("stats-%s-%s.json", dcName, dateSuffix)
 
 	if err := pairsWalk(db, sshconf, pairsSchema, brigadesSchema, statsSchema, dcID, filepath.Join(storePath, statsFileName)); err != nil {
-		log.Fatalf("%s: Can't collect stats: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't collect stats", err)
 	}
 }
 
@@ -168,16 +171,14 @@ func collectStats(sshconf *ssh.ClientConfig, addr netip.Addr, brigades [][]byte,
 
 	groupStats, err := fetchStatsBySSH(sshconf, addr, ids)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: fetch stats: %s\n", LogTag, err)
+		slog.Error("can't fetch stats", logging.KeyControlIP, addr, logging.KeyError, err)
 
 		return
 	}
 
-	// fmt.Fprintf(os.Stderr, "fetch stats: %s\n", groupStats)
-
 	var parsedStats AggrStats
 	if err := json.Unmarshal(groupStats, &parsedStats); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: unmarshal stats: %s\n", LogTag, err)
+		slog.Error("can't unmarshal stats", logging.KeyControlIP, addr, logging.KeyError, err)
 
 		return
 	}
@@ -280,14 +281,14 @@ func handleStatsStream(db *pgxpool.Pool, statsSchema string, filename string, st
 			aggrStats.Stats = append(aggrStats.Stats, s)
 
 			if err := updateStats(db, statsSchema, s); err != nil {
-				fmt.Fprintf(os.Stderr, "%s: update stats: %s\n", LogTag, err)
+				slog.Error("can't update stats", logging.KeyBrigade, s.BrigadeID, logging.KeyError, err)
 			}
 		}
 	}
 
 	f, err := os.Create(filename + fileTempSuffix)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: create stats file: %s\n", LogTag, err)
+		slog.Error("can't create stats file", "file", filename, logging.KeyError, err)
 
 		return
 	}
@@ -295,28 +296,28 @@ func handleStatsStream(db *pgxpool.Pool, statsSchema string, filename string, st
 	defer f.Close()
 
 	if err := json.NewEncoder(f).Encode(aggrStats); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: encode stats: %s\n", LogTag, err)
+		slog.Error("can't encode stats", "file", filename, logging.KeyError, err)
 
 		return
 	}
 
 	if _, err := os.Stat(filename); !os.IsNotExist(err) {
 		if err := os.Remove(filename); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: remove stats file: %s\n", LogTag, err)
+			slog.Error("can't remove stats file", "file", filename, logging.KeyError, err)
 
 			return
 		}
 	}
 
 	if err := os.Link(filename+fileTempSuffix, filename); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: link stats file: %s\n", LogTag, err)
+		slog.Error("can't link stats file", "file", filename, logging.KeyError, err)
 
 		return
 	}
 
 	if _, err := os.Stat(filename + fileTempSuffix); !os.IsNotExist(err) {
 		if err := os.Remove(filename + fileTempSuffix); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: remove temp stats file: %s\n", LogTag, err)
+			slog.Error("can't remove temp stats file", "file", filename+fileTempSuffix, logging.KeyError, err)
 
 			return
 		}
@@ -328,7 +329,7 @@ func getDataCenterStats(db *pgxpool.Pool, pairsSchema, brigadesSchema string, dc
 
 	if dcID != "" {
 		if _, err := uuid.Parse(dcID); err != nil {
-			fmt.Fprintf(os.Stderr, "bad dc id: %s: %s\n", dcID, err)
+			slog.Warn("bad dc id", "dc_id", dcID, logging.KeyError, err)
 
 			dcID = ""
 		}
@@ -336,7 +337,7 @@ func getDataCenterStats(db *pgxpool.Pool, pairsSchema, brigadesSchema string, dc
 
 	tx, err := db.Begin(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "begin transaction: %s\n", err)
+		slog.Error("can't begin transaction", logging.KeyError, err)
 
 		return DataCenterStats{}
 	}
@@ -350,7 +351,7 @@ func getDataCenterStats(db *pgxpool.Pool, pairsSchema, brigadesSchema string, dc
 		ctx,
 		fmt.Sprintf(sqlGetTotalPairsCont, pgx.Identifier{pairsSchema, "pairs"}.Sanitize()),
 	).Scan(&TotalPairsCount); err != nil && err != pgx.ErrNoRows {
-		fmt.Fprintf(os.Stderr, "get total pairs count: %s\n", err)
+		slog.Error("can't get total pairs count", logging.KeyError, err)
 
 		return DataCenterStats{}
 	}
@@ -361,7 +362,7 @@ func getDataCenterStats(db *pgxpool.Pool, pairsSchema, brigadesSchema string, dc
 		ctx,
 		fmt.Sprintf(sqlGetActivePairsCount, pgx.Identifier{pairsSchema, "pairs"}.Sanitize()),
 	).Scan(&ActivePairsCount); err != nil && err != pgx.ErrNoRows {
-		fmt.Fprintf(os.Stderr, "get active pairs count: %s\n", err)
+		slog.Error("can't get active pairs count", logging.KeyError, err)
 
 		return DataCenterStats{}
 	}
@@ -371,7 +372,7 @@ func getDataCenterStats(db *pgxpool.Pool, pairsSchema, brigadesSchema string, dc
 		ctx,
 		kdlib.GetFreeSlotsNumberStatement(brigadesSchema, false),
 	).Scan(&TotalFreeSlotsCount); err != nil && err != pgx.ErrNoRows {
-		fmt.Fprintf(os.Stderr, "get total free slots count: %s\n", err)
+		slog.Error("can't get total free slots count", logging.KeyError, err)
 
 		return DataCenterStats{}
 	}
@@ -381,13 +382,14 @@ func getDataCenterStats(db *pgxpool.Pool, pairsSchema, brigadesSchema string, dc
 		ctx,
 		kdlib.GetFreeSlotsNumberStatement(brigadesSchema, true),
 	).Scan(&ActiveFreeSlotsCount); err != nil && err != pgx.ErrNoRows {
-		fmt.Fprintf(os.Stderr, "get active free slots count: %s\n", err)
+		slog.Error("can't get active free slots count", logging.KeyError, err)
 
 		return DataCenterStats{}
 	}
 
-	fmt.Fprintf(os.Stdout, "DataCenterStats: pairs: %d(%d), slots: %d (%d)\n",
-		TotalPairsCount, ActivePairsCount, TotalFreeSlotsCount, ActiveFreeSlotsCount)
+	slog.Info("datacenter stats",
+		"pairs", TotalPairsCount, "active_pairs", ActivePairsCount,
+		"free_slots", TotalFreeSlotsCount, "active_free_slots", ActiveFreeSlotsCount)
 
 	return DataCenterStats{
 		Version:              DataCenterStatsVersion,
@@ -437,7 +439,7 @@ func pairsWalk(db *pgxpool.Pool, sshconf *ssh.ClientConfig, pairsSchema, brigade
 func fetchStatsBySSH(sshconf *ssh.ClientConfig, addr netip.Addr, ids []string) ([]byte, error) {
 	cmd := fmt.Sprintf("fetchstats -b %s -ch", strings.Join(ids, ","))
 
-	fmt.Fprintf(os.Stderr, "%s#%s:22 -> %s\n", sshkeyRemoteUsername, addr, cmd)
+	slog.Info("node command", logging.KeyControlIP, addr, "user", sshkeyRemoteUsername, "cmd", cmd)
 
 	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", addr), sshconf)
 	if err != nil {
@@ -459,12 +461,9 @@ func fetchStatsBySSH(sshconf *ssh.ClientConfig, addr netip.Addr, ids []string) (
 	defer func() {
 		switch errstr := e.String(); errstr {
 		case "":
-			fmt.Fprintf(os.Stderr, "%s: SSH Session StdErr: empty\n", LogTag)
+			slog.Debug("ssh session stderr is empty", logging.KeyControlIP, addr)
 		default:
-			fmt.Fprintf(os.Stderr, "%s: SSH Session StdErr:\n", LogTag)
-			for _, line := range strings.Split(errstr, "\n") {
-				fmt.Fprintf(os.Stderr, "%s: | %s\n", LogTag, line)
-			}
+			slog.Info("ssh session stderr", logging.KeyControlIP, addr, "stderr", logging.Lines(errstr))
 		}
 	}()
 
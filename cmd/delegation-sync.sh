@@ -41,7 +41,9 @@ psql -qtAF ';' -d "${DBNAME}" \
         --set brigades_schema_name="${SCHEMA}" <<EOF | sed 's/;$//g' > "${TEMP_DELEGATION_FILE}"
 BEGIN;
 
-SELECT domain_name,endpoint_ipv4 FROM :"brigades_schema_name".domains_endpoints_ipv4;
+SELECT domain_name,endpoint_ipv4 FROM :"brigades_schema_name".domains_endpoints_ipv4
+UNION ALL
+SELECT domain_name,endpoint_ipv4 FROM :"brigades_schema_name".domains_retiring;
 
 ROLLBACK;
 EOF
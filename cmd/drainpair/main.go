@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/reset"
+)
+
+const defaultParallel = 2
+
+const (
+	CommandStart  = "start"
+	CommandStatus = "status"
+	CommandCancel = "cancel"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "drainpair"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked      bool
+	cmd          string
+	pairID       string
+	controlIP    netip.Addr
+	parallel     int
+	routerFile   string
+	shufflerFile string
+}
+
+// The draining pair doesn't take the new brigades, its brigades are moved
+// to the other pairs as movebrigade does. The interrupted drain is continued
+// by the next start, the cancel returns the pair to the active pairs.
+// The output is the JSON report.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var out any
+
+	switch a.cmd {
+	case CommandStart:
+		routerKey, shufflerKeys, err := reset.ReadKeys(a.routerFile, a.shufflerFile)
+		if err != nil {
+			logging.Fatal(logger, "can't read keys", err)
+		}
+
+		report, err := brigade.Drain(ctx, conf, a.pairID, a.controlIP, brigade.DrainOpts{
+			Parallel:     a.parallel,
+			RouterKey:    routerKey,
+			ShufflerKeys: shufflerKeys,
+		})
+		if err != nil && report == nil {
+			logging.Fatal(logger, "can't drain pair", err)
+		}
+
+		if err != nil {
+			logger.Warn("drain is not finished", logging.KeyError, err)
+		}
+
+		out = report
+	case CommandStatus:
+		out, err = brigade.FetchDrain(ctx, conf, a.pairID, a.controlIP)
+		if err != nil {
+			logging.Fatal(logger, "can't fetch pair", err)
+		}
+	case CommandCancel:
+		out, err = brigade.SetDraining(ctx, conf, a.pairID, a.controlIP, false)
+		if err != nil {
+			logging.Fatal(logger, "can't cancel drain", err)
+		}
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		logging.Fatal(logger, "can't print report", err)
+	}
+}
+
+func parseArgs() (*args, error) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s|%s|%s [options]\n",
+			os.Args[0], CommandStart, CommandStatus, CommandCancel)
+		flag.PrintDefaults()
+	}
+
+	a := &args{}
+
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.Parse()
+
+	if len(flag.Args()) < 1 {
+		return nil, fmt.Errorf("no command specified")
+	}
+
+	a.cmd = flag.Args()[0]
+	cmdFlags := flag.NewFlagSet(a.cmd, flag.ExitOnError)
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s [options]\n", os.Args[0], a.cmd)
+		cmdFlags.PrintDefaults()
+	}
+
+	pair := cmdFlags.String("pair", "", "pair id or control ip")
+
+	switch a.cmd {
+	case CommandStart:
+		cmdFlags.IntVar(&a.parallel, "p", defaultParallel, "brigades to move at once")
+		cmdFlags.StringVar(&a.routerFile, "rk", os.Getenv("ROUTER_KEY_FILE"), "router public key file")
+		cmdFlags.StringVar(&a.shufflerFile, "sk", os.Getenv("SHUFFLER_KEY_FILE"), "shuffler keypair file")
+
+		cmdFlags.Parse(flag.Args()[1:])
+
+		if a.parallel < 1 {
+			return nil, fmt.Errorf("parallel: %w", errInlalidArgs)
+		}
+
+		if a.routerFile == "" || a.shufflerFile == "" {
+			return nil, fmt.Errorf("no keys: %w", errInlalidArgs)
+		}
+	case CommandStatus, CommandCancel:
+		cmdFlags.Parse(flag.Args()[1:])
+	default:
+		return nil, fmt.Errorf("unknown command: %w", errInlalidArgs)
+	}
+
+	if *pair == "" {
+		return nil, fmt.Errorf("no pair: %w", errInlalidArgs)
+	}
+
+	if ip, err := netip.ParseAddr(*pair); err == nil {
+		a.controlIP = ip
+	} else {
+		id, err := uuid.Parse(*pair)
+		if err != nil {
+			return nil, fmt.Errorf("pair: %s: %w", *pair, errInlalidArgs)
+		}
+
+		a.pairID = id.String()
+	}
+
+	return a, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+// Output formats.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "findbrigades"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+var header = []string{
+	"brigade_id", "brigadier", "pair_id", "control_ip", "endpoint_ipv4", "domain",
+	"keydesk_ipv6", "ipv4_cgnat", "ipv6_ula", "total_users", "active_users", "created_at", "update_time",
+}
+
+type args struct {
+	chunked bool
+	format  string
+	query   brigade.SearchQuery
+}
+
+// The brigades are looked up by the brigadier name, the domain, the addresses or the pair,
+// all the brigades are listed without conditions. The result is paginated.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	res, err := brigade.Search(context.Background(), conf, a.query)
+	if err != nil {
+		logging.Fatal(logger, "can't search brigades", err)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	switch a.format {
+	case FormatJSON:
+		err = json.NewEncoder(w).Encode(res)
+	case FormatCSV:
+		err = printCSV(w, res)
+	default:
+		err = printTable(w, res)
+	}
+
+	if err != nil {
+		logging.Fatal(logger, "can't print brigades", err)
+	}
+}
+
+func record(f *brigade.Found) []string {
+	ts := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+
+		return t.Format(time.RFC3339)
+	}
+
+	return []string{
+		f.BrigadeID,
+		f.Brigadier,
+		f.PairID,
+		f.ControlIP.String(),
+		f.EndpointIPv4.String(),
+		f.Domain,
+		f.KeydeskIPv6.String(),
+		f.IPv4CGNAT.String(),
+		f.IPv6ULA.String(),
+		strconv.Itoa(f.TotalUsersCount),
+		strconv.Itoa(f.ActiveUsersCount),
+		ts(f.CreatedAt),
+		ts(f.UpdateTime),
+	}
+}
+
+func printCSV(w io.Writer, res *brigade.SearchResult) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(header); err != nil {
+		return fmt.Errorf("csv: %w", err)
+	}
+
+	for _, f := range res.Brigades {
+		if err := cw.Write(record(f)); err != nil {
+			return fmt.Errorf("csv: %w", err)
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func printTable(w io.Writer, res *brigade.SearchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+
+	for _, f := range res.Brigades {
+		fmt.Fprintln(tw, strings.Join(record(f), "\t"))
+	}
+
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("table: %w", err)
+	}
+
+	_, err := fmt.Fprintf(w, "%d-%d of %d\n", min(res.Offset+1, res.Offset+len(res.Brigades)), res.Offset+len(res.Brigades), res.Total)
+
+	return err
+}
+
+// parsePrefix - the address is the single address prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
+	endpoint := flag.String("ip", "", "endpoint ipv4 address or network")
+	keydesk := flag.String("kd", "", "keydesk ipv6 address or network")
+	addr := flag.String("addr", "", "address within the brigade cgnat or ula network")
+	pair := flag.String("pair", "", "pair id or control ip")
+	flag.StringVar(&a.query.Brigadier, "name", "", "brigadier name, partial")
+	flag.StringVar(&a.query.Domain, "domain", "", "domain name, partial")
+	flag.IntVar(&a.query.Limit, "n", 0, "page size, 50 by default")
+	flag.IntVar(&a.query.Offset, "offset", 0, "page offset")
+	flag.StringVar(&a.format, "o", FormatTable, "output format: table|json|csv")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+
+	flag.Parse()
+
+	switch a.format {
+	case FormatTable, FormatJSON, FormatCSV:
+	default:
+		return nil, fmt.Errorf("format: %s: %w", a.format, errInlalidArgs)
+	}
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != uuid.Nil {
+		a.query.BrigadeID = id.String()
+	}
+
+	if *endpoint != "" {
+		p, err := parsePrefix(*endpoint)
+		if err != nil || !p.Addr().Is4() {
+			return nil, fmt.Errorf("endpoint: %s: %w", *endpoint, errInlalidArgs)
+		}
+
+		a.query.EndpointIPv4 = p.Masked()
+	}
+
+	if *keydesk != "" {
+		p, err := parsePrefix(*keydesk)
+		if err != nil || !p.Addr().Is6() {
+			return nil, fmt.Errorf("keydesk: %s: %w", *keydesk, errInlalidArgs)
+		}
+
+		a.query.KeydeskIPv6 = p.Masked()
+	}
+
+	if *addr != "" {
+		ip, err := netip.ParseAddr(*addr)
+		if err != nil {
+			return nil, fmt.Errorf("addr: %s: %w", *addr, errInlalidArgs)
+		}
+
+		a.query.Addr = ip
+	}
+
+	if *pair != "" {
+		if ip, err := netip.ParseAddr(*pair); err == nil {
+			a.query.ControlIP = ip
+		} else {
+			id, err := uuid.Parse(*pair)
+			if err != nil {
+				return nil, fmt.Errorf("pair: %s: %w", *pair, errInlalidArgs)
+			}
+
+			a.query.PairID = id.String()
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	defaultDatabaseURL         = "postgresql:///vgrealm"
+	defaultBrigadesSchema      = "brigades"
+	defaultPairsSchema         = "pairs"
+	defaultBrigadesStatsSchema = "stats"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "forecast"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+// The projected exhaustion date per resource by the brigades
+// creation and purge rate. The output is JSON.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	chunked, params, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	dbURL, pairsSchema, brigadesSchema, statsSchema := readConfigs()
+
+	db, err := createDBPool(dbURL)
+	if err != nil {
+		logging.Fatal(logger, "can't create db pool", err)
+	}
+
+	f, err := kdlib.CollectForecast(context.Background(), db, pairsSchema, brigadesSchema, statsSchema, params)
+	if err != nil {
+		logging.Fatal(logger, "can't get forecast", err)
+	}
+
+	switch chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		logging.Fatal(logger, "can't print result", err)
+	}
+}
+
+func createDBPool(dbURL string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("conn string: %w", err)
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("create pool: %w", err)
+	}
+
+	return pool, nil
+}
+
+func parseArgs() (bool, kdlib.ForecastParams, error) {
+	chunked := flag.Bool("ch", false, "chunked output")
+	days := flag.Int("d", kdlib.DefaultForecastDays, "days to average the rates over")
+	alert := flag.Int("a", kdlib.DefaultForecastAlert, "alert if the resource runs out within days")
+
+	flag.Parse()
+
+	if *days < 1 || *alert < 1 {
+		return false, kdlib.ForecastParams{}, fmt.Errorf("days/alert: %w", errInlalidArgs)
+	}
+
+	return *chunked, kdlib.ForecastParams{Days: *days, AlertDays: *alert}, nil
+}
+
+func readConfigs() (string, string, string, string) {
+	dbURL := os.Getenv("DB_URL")
+	if dbURL == "" {
+		dbURL = defaultDatabaseURL
+	}
+
+	pairsSchema := os.Getenv("PAIRS_SCHEMA")
+	if pairsSchema == "" {
+		pairsSchema = defaultPairsSchema
+	}
+
+	brigadesSchema := os.Getenv("BRIGADES_SCHEMA")
+	if brigadesSchema == "" {
+		brigadesSchema = defaultBrigadesSchema
+	}
+
+	statsSchema := os.Getenv("BRIGADES_STATS_SCHEMA")
+	if statsSchema == "" {
+		statsSchema = defaultBrigadesStatsSchema
+	}
+
+	return dbURL, pairsSchema, brigadesSchema, statsSchema
+}
@@ -2,33 +2,42 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 
 	"github.com/coreos/go-systemd/activation"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const (
-	defaultBrigadesSchema = "brigades"
-	defaultPairsSchema    = "pairs"
-	defaultDCName         = "unknown"
-	defaultDCID           = "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+	defaultBrigadesSchema      = "brigades"
+	defaultPairsSchema         = "pairs"
+	defaultBrigadesStatsSchema = "stats"
+	defaultDCName              = "unknown"
+	defaultDCID                = "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
 )
 
 const (
@@ -41,9 +50,15 @@ const (
 	KeySlotsAllActive
 	KeySlotsFreeTotal
 	KeySlotsFreeActive
+	KeyCapacity
 )
 
-var ErrNoListener = errors.New("no listener")
+var (
+	ErrNoListener = errors.New("no listener")
+	ErrNoCert     = errors.New("no tls cert")
+	ErrScheme     = errors.New("unknown listen scheme")
+	ErrTokenNoTLS = errors.New("bearer token needs https on the non-loopback address")
+)
 
 var LogTag = setLogTag()
 
@@ -59,24 +74,26 @@ func setLogTag() string {
 }
 
 func main() {
+	logger := logging.Setup(LogTag)
+
 	var w io.WriteCloser
 
-	chunked, jsonFormat, active, listener, err := parseArgs()
+	chunked, jsonFormat, active, listeners, token, err := parseArgs()
 	if err != nil {
-		log.Fatalf("%s: Can't parse args: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't parse args", err)
 	}
 
-	dbURL, pairsSchema, brigadesSchema, dcName, dcID, err := readConfigs()
+	dbURL, pairsSchema, brigadesSchema, statsSchema, dcName, dcID, err := readConfigs()
 	if err != nil {
-		log.Fatalf("%s: Can't read configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't read configs", err)
 	}
 
 	db, err := createDBPool(dbURL)
 	if err != nil {
-		log.Fatalf("%s: Can't create db pool: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't create db pool", err)
 	}
 
-	if listener == nil {
+	if len(listeners) == 0 {
 
 		var (
 			num    int32
@@ -87,42 +104,47 @@ func main() {
 		case KeySlotsFreeTotal:
 			num, err = getFreeSlotsNumber(db, brigadesSchema, false)
 			if err != nil {
-				log.Fatalf("%s: Can't get free slots number: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't get free slots number", err)
 			}
 
 			output, err = getFormattedFreeSlotsNumber(num, false, jsonFormat)
 			if err != nil {
-				log.Fatalf("%s: Can't format nums: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't format nums", err)
 			}
 		case KeySlotsFreeActive:
 			num, err = getFreeSlotsNumber(db, brigadesSchema, true)
 			if err != nil {
-				log.Fatalf("%s: Can't get free slots number: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't get free slots number", err)
 			}
 
 			output, err = getFormattedFreeSlotsNumber(num, true, jsonFormat)
 			if err != nil {
-				log.Fatalf("%s: Can't format nums: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't format nums", err)
 			}
 		case KeySlotsAllTotal:
 			num, err = getAllSlotsNumber(db, pairsSchema, false)
 			if err != nil {
-				log.Fatalf("%s: Can't get all slots number: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't get all slots number", err)
 			}
 
 			output, err = getFormattedAllSlotsNumber(num, false, jsonFormat)
 			if err != nil {
-				log.Fatalf("%s: Can't format nums: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't format nums", err)
+			}
+		case KeyCapacity:
+			output, err = getCapacityJSON(db, pairsSchema, brigadesSchema, dcName, dcID)
+			if err != nil {
+				logging.Fatal(logger, "can't get capacity", err)
 			}
 		case KeySlotsAllActive:
 			num, err = getAllSlotsNumber(db, pairsSchema, true)
 			if err != nil {
-				log.Fatalf("%s: Can't get all slots number: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't get all slots number", err)
 			}
 
 			output, err = getFormattedAllSlotsNumber(num, true, jsonFormat)
 			if err != nil {
-				log.Fatalf("%s: Can't format nums: %s\n", LogTag, err)
+				logging.Fatal(logger, "can't format nums", err)
 			}
 		}
 
@@ -140,7 +162,7 @@ func main() {
 
 		_, err = w.Write(output)
 		if err != nil {
-			log.Fatalf("%s: Can't print output: %s\n", LogTag, err)
+			logging.Fatal(logger, "can't print output", err)
 		}
 
 		return
@@ -153,17 +175,38 @@ func main() {
 	router.HandleFunc("/metrics/datacenter/all_slots", func(w http.ResponseWriter, r *http.Request) {
 		zabbixRequestAllSlotsHandler(w, r, db, pairsSchema, dcName, dcID)
 	})
+	router.HandleFunc("/metrics/datacenter/pairs", func(w http.ResponseWriter, r *http.Request) {
+		zabbixRequestPairsHandler(w, r, db, pairsSchema, brigadesSchema, statsSchema, dcName, dcID)
+	})
+	router.HandleFunc("/metrics/datacenter/capacity", func(w http.ResponseWriter, r *http.Request) {
+		capacityHandler(w, r, db, pairsSchema, brigadesSchema, dcName, dcID)
+	})
+	router.HandleFunc("/metrics/datacenter/forecast", func(w http.ResponseWriter, r *http.Request) {
+		forecastHandler(w, r, db, pairsSchema, brigadesSchema, statsSchema, dcName, dcID)
+	})
+	// The forecast query is heavy and its rates change slowly.
+	forecasts := &kdlib.ForecastCache{TTL: kdlib.DefaultForecastTTL}
+
+	router.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		prometheusHandler(w, r, db, forecasts, pairsSchema, brigadesSchema, statsSchema, dcName, dcID)
+	})
+
+	if token != "" {
+		router.Use(bearerAuth(token))
+	}
 
 	server := &http.Server{
 		Handler:     router,
 		IdleTimeout: 60 * time.Minute,
 	}
 
-	go func() {
-		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("Can't serve: %s\n", err)
-		}
-	}()
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logging.Fatal(logger, "can't serve", err)
+			}
+		}(listener)
+	}
 
 	// On signal, gracefully shut down the server and wait 5
 	// seconds for current connections to stop.
@@ -177,7 +220,7 @@ func main() {
 	go func() {
 		<-quit
 
-		fmt.Fprintln(os.Stderr, "Quit signal received...")
+		slog.Info("quit signal received")
 
 		closeFunc := func(srv *http.Server) {
 			defer wg.Done()
@@ -187,11 +230,11 @@ func main() {
 
 			srv.SetKeepAlivesEnabled(false)
 			if err := srv.Shutdown(ctx); err != nil {
-				fmt.Fprintf(os.Stderr, "Can't gracefully shut down the server: %s\n", err)
+				slog.Error("can't gracefully shut down the server", logging.KeyError, err)
 			}
 		}
 
-		fmt.Fprintln(os.Stderr, "Server is shutting down")
+		slog.Info("server is shutting down")
 		wg.Add(1)
 
 		go closeFunc(server)
@@ -411,6 +454,216 @@ func zabbixRequestFreeSlotsHandler(w http.ResponseWriter, r *http.Request, db *p
 	}
 }
 
+// capacityOutput - the capacity breakdown labelled with the datacenter.
+type capacityOutput struct {
+	DCName string `json:"dc_name"`
+	DCID   string `json:"dc_id"`
+	*kdlib.Capacity
+}
+
+func getCapacityJSON(db *pgxpool.Pool, pairsSchema, brigadesSchema, dcName, dcID string) ([]byte, error) {
+	c, err := kdlib.CollectCapacity(context.Background(), db, pairsSchema, brigadesSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(capacityOutput{DCName: dcName, DCID: dcID, Capacity: c})
+}
+
+func capacityHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, pairsSchema, brigadesSchema, dcName, dcID string) {
+	output, err := getCapacityJSON(db, pairsSchema, brigadesSchema, dcName, dcID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("can't get capacity", logging.KeyError, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
+
+// forecastOutput - the forecast labelled with the datacenter.
+type forecastOutput struct {
+	DCName string `json:"dc_name"`
+	DCID   string `json:"dc_id"`
+	*kdlib.Forecast
+}
+
+// forecastHandler - the exhaustion forecast, the window and the alert threshold
+// in days are taken from the days and alert_days query params.
+func forecastHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, pairsSchema, brigadesSchema, statsSchema, dcName, dcID string) {
+	params := kdlib.ForecastParams{Days: kdlib.DefaultForecastDays, AlertDays: kdlib.DefaultForecastAlert}
+
+	for _, q := range []struct {
+		name string
+		num  *int
+	}{
+		{"days", &params.Days},
+		{"alert_days", &params.AlertDays},
+	} {
+		if v := r.URL.Query().Get(q.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid request"))
+
+				return
+			}
+
+			*q.num = n
+		}
+	}
+
+	f, err := kdlib.CollectForecast(r.Context(), db, pairsSchema, brigadesSchema, statsSchema, params)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("can't get forecast", logging.KeyError, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+
+		return
+	}
+
+	output, err := json.Marshal(forecastOutput{DCName: dcName, DCID: dcID, Forecast: f})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
+
+// prometheusHandler - the capacity metrics and the cached forecast with the default params.
+func prometheusHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, forecasts *kdlib.ForecastCache, pairsSchema, brigadesSchema, statsSchema, dcName, dcID string) {
+	m, err := kdlib.CollectDCMetrics(r.Context(), db, pairsSchema, brigadesSchema)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("can't collect metrics", logging.KeyError, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+
+		return
+	}
+
+	f, err := forecasts.Get(time.Now(), func() (*kdlib.Forecast, error) {
+		return kdlib.CollectForecast(r.Context(), db, pairsSchema, brigadesSchema, statsSchema,
+			kdlib.ForecastParams{Days: kdlib.DefaultForecastDays, AlertDays: kdlib.DefaultForecastAlert})
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("can't get forecast", logging.KeyError, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	m.WritePrometheus(w, dcName, dcID)
+	f.WritePrometheus(w, dcName, dcID)
+}
+
+// zabbixRequestPairsHandler - the pairs discovery and the per-pair items,
+// the last stats collection is the unix time, 0 if never.
+func zabbixRequestPairsHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, pairsSchema, brigadesSchema, statsSchema, dcName, dcID string) {
+	if r.URL.Query().Get("format") != "zabbix" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request"))
+		return
+	}
+
+	action := r.URL.Query().Get("action")
+
+	if action == "list" {
+		list, err := kdlib.CollectPairsStats(r.Context(), db, pairsSchema, brigadesSchema, statsSchema, "")
+		if err != nil {
+			logging.FromContext(r.Context()).Error("can't get pairs stats", logging.KeyError, err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+
+			return
+		}
+
+		zabbixResponse, err := kdlib.ZabbixPairsLLD(list, dcName, dcID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("can't format pairs discovery", logging.KeyError, err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write(zabbixResponse)
+
+		return
+	}
+
+	id, err := uuid.Parse(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request"))
+
+		return
+	}
+
+	list, err := kdlib.CollectPairsStats(r.Context(), db, pairsSchema, brigadesSchema, statsSchema, id.String())
+	if err != nil {
+		logging.FromContext(r.Context()).Error("can't get pair stats", logging.KeyPair, id, logging.KeyError, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+
+		return
+	}
+
+	if len(list) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request"))
+
+		return
+	}
+
+	pair := list[0]
+
+	var num int64
+
+	switch action {
+	case "get_free_slots":
+		num = pair.FreeSlots
+	case "get_brigades_number":
+		num = pair.Brigades
+	case "get_active_users":
+		num = pair.ActiveUsers
+	case "get_last_stats":
+		if pair.LastStats != nil {
+			num = pair.LastStats.Unix()
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request"))
+
+		return
+	}
+
+	zabbixResponse := fmt.Sprintf("%d\n", num)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(zabbixResponse))
+}
+
 func createDBPool(dbURL string) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig(dbURL)
 	if err != nil {
@@ -425,54 +678,268 @@ func createDBPool(dbURL string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-func parseArgs() (bool, bool, int, net.Listener, error) {
+func parseArgs() (bool, bool, int, []net.Listener, string, error) {
 	chunked := flag.Bool("ch", false, "chunked output")
 	slotsAllTotal := flag.Bool("at", false, "all slots")
 	slotsAllActive := flag.Bool("aa", false, "all active slots")
 	slotsFreeTotal := flag.Bool("ft", false, "free slots")
 	slotsFreeActive := flag.Bool("fa", false, "free active slots")
+	capacity := flag.Bool("cap", false, "per-pair and per-pool capacity, json only")
 	jsonFormat := flag.Bool("j", false, "json output")
-	listenAddr := flag.String("l", "", "Listen addr:port (http and https separate with commas)")
+	listenAddr := flag.String("l", "", "Listen [http://|https://]addr:port separated with commas, http if no scheme")
+	certFile := flag.String("cert", os.Getenv("TLS_CERT_FILE"), "https cert file")
+	keyFile := flag.String("key", os.Getenv("TLS_KEY_FILE"), "https key file")
+	clientCAFile := flag.String("ca", os.Getenv("TLS_CLIENT_CA_FILE"), "https client certs CA file, client certs are required if set")
+	tokenFile := flag.String("token", os.Getenv("BEARER_TOKEN_FILE"), "bearer token file, the token is required if set")
 
 	flag.Parse()
 
 	if *listenAddr != "" {
-		if l, err := net.Listen("tcp", *listenAddr); err == nil {
-			return *chunked, *jsonFormat, 0, l, nil
+		specs, err := parseListen(*listenAddr)
+		if err != nil {
+			return false, false, 0, nil, "", err
+		}
+
+		var token string
+
+		if *tokenFile != "" {
+			buf, err := os.ReadFile(*tokenFile)
+			if err != nil {
+				return false, false, 0, nil, "", fmt.Errorf("token: %w", err)
+			}
+
+			token = strings.TrimSpace(string(buf))
+			if token == "" {
+				return false, false, 0, nil, "", fmt.Errorf("token: %s: empty", *tokenFile)
+			}
+		}
+
+		var conf *tls.Config
+
+		for _, spec := range specs {
+			if !spec.https {
+				continue
+			}
+
+			conf, err = tlsConfig(*certFile, *keyFile, *clientCAFile)
+			if err != nil {
+				return false, false, 0, nil, "", fmt.Errorf("tls: %w", err)
+			}
+
+			break
 		}
 
-		listeners, err := activation.Listeners()
+		listeners, err := openListeners(specs)
 		if err != nil {
-			return false, false, 0, nil, ErrNoListener
+			return false, false, 0, nil, "", err
 		}
 
-		if len(listeners) == 0 {
-			return false, false, 0, nil, ErrNoListener
+		listeners, err = secureListeners(specs, listeners, conf, token != "")
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return false, false, 0, nil, "", err
 		}
 
-		return *chunked, *jsonFormat, 0, listeners[0], nil
+		return *chunked, *jsonFormat, 0, listeners, token, nil
+	}
+
+	if *capacity {
+		return *chunked, true, KeyCapacity, nil, "", nil
 	}
 
 	if *slotsAllTotal {
-		return *chunked, *jsonFormat, KeySlotsAllTotal, nil, nil
+		return *chunked, *jsonFormat, KeySlotsAllTotal, nil, "", nil
 	}
 
 	if *slotsAllActive {
-		return *chunked, *jsonFormat, KeySlotsAllActive, nil, nil
+		return *chunked, *jsonFormat, KeySlotsAllActive, nil, "", nil
 	}
 
 	if *slotsFreeTotal {
-		return *chunked, *jsonFormat, KeySlotsFreeTotal, nil, nil
+		return *chunked, *jsonFormat, KeySlotsFreeTotal, nil, "", nil
 	}
 
 	if *slotsFreeActive {
-		return *chunked, *jsonFormat, KeySlotsFreeActive, nil, nil
+		return *chunked, *jsonFormat, KeySlotsFreeActive, nil, "", nil
+	}
+
+	return *chunked, *jsonFormat, KeySlotsAllTotal, nil, "", nil
+}
+
+// listenSpec - the listen address and its scheme.
+type listenSpec struct {
+	addr  string
+	https bool
+}
+
+// parseListen - the comma separated addresses with the optional http:// or https:// scheme.
+func parseListen(addrs string) ([]listenSpec, error) {
+	var specs []listenSpec
+
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		spec := listenSpec{addr: addr}
+
+		if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+			switch scheme {
+			case "http":
+			case "https":
+				spec.https = true
+			default:
+				return nil, fmt.Errorf("%w: %s", ErrScheme, addr)
+			}
+
+			spec.addr = rest
+		}
+
+		specs = append(specs, spec)
+	}
+
+	if len(specs) == 0 {
+		return nil, ErrNoListener
+	}
+
+	return specs, nil
+}
+
+// openListeners - the listeners in the order of the addresses. The systemd sockets
+// are taken in the same order if the addresses are already bound by systemd.
+func openListeners(specs []listenSpec) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(specs))
+
+	for _, spec := range specs {
+		l, err := net.Listen("tcp", spec.addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			activated, aerr := systemdListeners(len(specs))
+			if aerr != nil {
+				return nil, fmt.Errorf("listen: %w", errors.Join(err, aerr))
+			}
+
+			return activated, nil
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+func systemdListeners(num int) ([]net.Listener, error) {
+	activated, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("systemd: %w", err)
+	}
+
+	for i := 0; i < num; i++ {
+		if i < len(activated) && activated[i] != nil {
+			continue
+		}
+
+		for _, l := range activated {
+			if l != nil {
+				l.Close()
+			}
+		}
+
+		return nil, fmt.Errorf("systemd: %w: %d sockets of %d", ErrNoListener, len(activated), num)
+	}
+
+	return activated[:num], nil
+}
+
+// secureListeners - wraps the https listeners with TLS. The bearer token
+// travels in clear text over http, it's allowed on the loopback only.
+func secureListeners(specs []listenSpec, listeners []net.Listener, conf *tls.Config, token bool) ([]net.Listener, error) {
+	secured := make([]net.Listener, len(listeners))
+
+	for i, l := range listeners {
+		secured[i] = l
+
+		if specs[i].https {
+			secured[i] = tls.NewListener(l, conf)
+
+			continue
+		}
+
+		if token && !isLoopback(l.Addr()) {
+			return listeners, fmt.Errorf("%w: %s", ErrTokenNoTLS, l.Addr())
+		}
 	}
 
-	return *chunked, *jsonFormat, KeySlotsAllTotal, nil, nil
+	return secured, nil
 }
 
-func readConfigs() (string, string, string, string, string, error) {
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+
+	return ok && tcp.IP.IsLoopback()
+}
+
+// tlsConfig - the server cert, the client certs are verified with the CA if given.
+func tlsConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, ErrNoCert
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cert: %w", err)
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client ca: %s: no certs", clientCAFile)
+		}
+
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// bearerAuth - the requests without the token are rejected.
+func bearerAuth(token string) mux.MiddlewareFunc {
+	want := []byte("Bearer " + token)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Unauthorized"))
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func readConfigs() (string, string, string, string, string, string, error) {
 	dbURL := os.Getenv("DB_URL")
 	if dbURL == "" {
 		dbURL = defaultDatabaseURL
@@ -488,6 +955,11 @@ func readConfigs() (string, string, string, string, string, error) {
 		pairsSchema = defaultPairsSchema
 	}
 
+	statsSchema := os.Getenv("BRIGADES_STATS_SCHEMA")
+	if statsSchema == "" {
+		statsSchema = defaultBrigadesStatsSchema
+	}
+
 	dcName := os.Getenv("DC_NAME")
 	if dcName == "" {
 		dcName = defaultDCName
@@ -498,5 +970,5 @@ func readConfigs() (string, string, string, string, string, error) {
 		dcID = defaultDCID
 	}
 
-	return dbURL, pairsSchema, brigadesSchema, dcName, dcID, nil
+	return dbURL, pairsSchema, brigadesSchema, statsSchema, dcName, dcID, nil
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []listenSpec
+		wantErr error
+	}{
+		{name: "bare", in: "127.0.0.1:8881", want: []listenSpec{{addr: "127.0.0.1:8881"}}},
+		{
+			name: "schemes",
+			in:   "https://0.0.0.0:8443, http://127.0.0.1:8881,127.0.0.1:8882",
+			want: []listenSpec{{addr: "0.0.0.0:8443", https: true}, {addr: "127.0.0.1:8881"}, {addr: "127.0.0.1:8882"}},
+		},
+		{name: "unknown scheme", in: "ftp://127.0.0.1:21", wantErr: ErrScheme},
+		{name: "empty", in: " , ", wantErr: ErrNoListener},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := parseListen(tt.in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err: %v, want %v", err, tt.wantErr)
+			}
+
+			if len(specs) != len(tt.want) {
+				t.Fatalf("specs: %+v, want %+v", specs, tt.want)
+			}
+
+			for i := range specs {
+				if specs[i] != tt.want[i] {
+					t.Errorf("spec %d: %+v, want %+v", i, specs[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOpenListenersError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	defer busy.Close()
+
+	// No systemd sockets, the listen error is returned.
+	_, err = openListeners([]listenSpec{{addr: busy.Addr().String()}})
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("no listen error in: %v", err)
+	}
+}
+
+func TestSecureListenersToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		https   bool
+		token   bool
+		wantErr error
+	}{
+		{name: "loopback http with token", addr: "127.0.0.1:0", token: true},
+		{name: "any http without token", addr: "0.0.0.0:0"},
+		{name: "any http with token", addr: "0.0.0.0:0", token: true, wantErr: ErrTokenNoTLS},
+		{name: "any https with token", addr: "0.0.0.0:0", https: true, token: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", tt.addr)
+			if err != nil {
+				t.Fatalf("listen: %s", err)
+			}
+
+			defer l.Close()
+
+			_, err = secureListeners([]listenSpec{{addr: tt.addr, https: tt.https}}, []net.Listener{l}, &tls.Config{}, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err: %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	h := bearerAuth("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%q: status %d, want %d", tt.header, w.Code, tt.want)
+		}
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	testCert(t, dir, "client", ca, caKey)
+	testCert(t, dir, "stranger", nil, nil)
+
+	conf, err := tlsConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("tls config: %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	listeners, err := secureListeners([]listenSpec{{addr: "127.0.0.1:0", https: true}}, []net.Listener{l}, conf, true)
+	if err != nil {
+		t.Fatalf("secure: %s", err)
+	}
+
+	srv := httptest.NewUnstartedServer(bearerAuth("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	srv.Listener = listeners[0]
+	srv.Start()
+
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		name    string
+		cert    string
+		token   string
+		want    int
+		wantErr bool
+	}{
+		{name: "no client cert", token: "secret", wantErr: true},
+		{name: "unknown client cert", cert: "stranger", token: "secret", wantErr: true},
+		{name: "no token", cert: "client", want: http.StatusUnauthorized},
+		{name: "cert and token", cert: "client", token: "secret", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConf := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+			if tt.cert != "" {
+				cert, err := tls.LoadX509KeyPair(filepath.Join(dir, tt.cert+".crt"), filepath.Join(dir, tt.cert+".key"))
+				if err != nil {
+					t.Fatalf("client cert: %s", err)
+				}
+
+				clientConf.Certificates = []tls.Certificate{cert}
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConf}}
+
+			req, _ := http.NewRequest(http.MethodGet, "https://"+l.Addr().String()+"/metrics", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := client.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v, want error: %t", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+// testCert - writes the cert and the key to dir, self-signed CA if parent is nil.
+func testCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("cert: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %s", err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		name + ".crt": {Type: "CERTIFICATE", Bytes: der},
+		name + ".key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("write %s: %s", file, err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	return cert, key
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/reset"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "movebrigade"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked      bool
+	jout         bool
+	id           string
+	pairID       string
+	controlIP    netip.Addr
+	routerFile   string
+	shufflerFile string
+}
+
+// Moves the brigade to the free endpoint of the target pair,
+// the old copy is destroyed after the delegation follows the new one,
+// checkdelegation destroys the kept ones.
+func main() {
+	var w io.WriteCloser
+
+	logger := logging.Setup(LogTag)
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	routerKey, shufflerKeys, err := reset.ReadKeys(a.routerFile, a.shufflerFile)
+	if err != nil {
+		logging.Fatal(logger, "can't read keys", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	res, err := brigade.Move(context.Background(), conf, a.id, brigade.MoveOpts{
+		PairID:       a.pairID,
+		ControlIP:    a.controlIP,
+		RouterKey:    routerKey,
+		ShufflerKeys: shufflerKeys,
+	})
+	if err != nil {
+		logging.Fatal(logger, "can't move brigade", err, logging.KeyBrigade, a.id)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if a.jout {
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logging.Fatal(logger, "can't print result", err)
+		}
+
+		return
+	}
+
+	fmt.Fprintln(w, res.BrigadeID)
+	fmt.Fprintln(w, res.ToControlIP)
+	fmt.Fprintln(w, res.ToEndpoint)
+	fmt.Fprintln(w, res.OldDestroyed)
+
+	if res.Warning != "" {
+		fmt.Fprintln(w, res.Warning)
+	}
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
+	pair := flag.String("pair", "", "target pair id or control ip, picked up by the placement policy if empty")
+	flag.StringVar(&a.routerFile, "rk", os.Getenv("ROUTER_KEY_FILE"), "router public key file")
+	flag.StringVar(&a.shufflerFile, "sk", os.Getenv("SHUFFLER_KEY_FILE"), "shuffler keypair file")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+
+	flag.Parse()
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	switch {
+	case err != nil:
+		return nil, err
+	case id == uuid.Nil:
+		return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+	}
+
+	a.id = id.String()
+
+	switch ip, err := netip.ParseAddr(*pair); {
+	case *pair == "":
+	case err == nil:
+		a.controlIP = ip
+	default:
+		id, err := uuid.Parse(*pair)
+		if err != nil {
+			return nil, fmt.Errorf("pair: %s: %w", *pair, errInlalidArgs)
+		}
+
+		a.pairID = id.String()
+	}
+
+	if a.routerFile == "" || a.shufflerFile == "" {
+		return nil, fmt.Errorf("no keys: %w", errInlalidArgs)
+	}
+
+	return a, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "purgebrigades"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked bool
+	jout    bool
+	list    bool
+	force   bool
+	id      string
+}
+
+// The deleted brigades are removed after the grace period.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	ctx := context.Background()
+
+	var (
+		list     []*brigade.Deleted
+		purgeErr error
+	)
+
+	switch a.list {
+	case true:
+		list, err = brigade.ListDeleted(ctx, conf, true)
+		if err != nil {
+			logging.Fatal(logger, "can't list deleted brigades", err)
+		}
+	default:
+		// The purged ones are printed even if some of them are failed.
+		list, purgeErr = brigade.Purge(ctx, conf, a.id, "purged", a.force)
+	}
+
+	if err := printList(w, a.jout, list); err != nil {
+		logging.Fatal(logger, "can't print brigades", err)
+	}
+
+	if purgeErr != nil {
+		if a.chunked {
+			w.Close()
+		}
+
+		logging.Fatal(logger, "can't purge brigades", purgeErr)
+	}
+}
+
+func printList(w io.Writer, jout bool, list []*brigade.Deleted) error {
+	if jout {
+		if list == nil {
+			list = []*brigade.Deleted{}
+		}
+
+		return json.NewEncoder(w).Encode(list)
+	}
+
+	for _, d := range list {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n",
+			d.BrigadeID, d.DeletedAt.Format(time.RFC3339), d.PurgeAfter.Format(time.RFC3339),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id (uuid)")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+	flag.BoolVar(&a.list, "l", false, "list the deleted brigades, don't purge")
+	flag.BoolVar(&a.force, "f", false, "ignore the grace period")
+
+	flag.Parse()
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != uuid.Nil {
+		a.id = id.String()
+	}
+
+	return a, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	defaultFirstVisitDaysLimit        = 1
+	defaultActiveCreatedAtMonthsLimit = 1
+	defaultMinActiveUsers             = 5
+	defaultMaxBrigades                = 10
+)
+
+const (
+	CommandResume = "resume"
+	CommandShow   = "show"
+	CommandList   = "list"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "reclaim"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked bool
+	cmd     string
+	params  brigade.ReclaimParams
+	runID   int64
+	retry   bool
+	limit   int
+}
+
+// The wasted brigades are selected as getwasted does and deleted as delbrigade does,
+// the run is recorded and the interrupted run is resumed by the run ID.
+// The output is the JSON report.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var out any
+
+	switch a.cmd {
+	case kdlib.WastedNotVisited, kdlib.WastedInactive:
+		out, err = brigade.StartReclaim(ctx, conf, a.params)
+		if err != nil {
+			logging.Fatal(logger, "can't reclaim brigades", err)
+		}
+	case CommandResume:
+		out, err = brigade.ResumeReclaim(ctx, conf, a.runID, a.retry)
+		if err != nil {
+			logging.Fatal(logger, "can't resume reclaim", err, "run_id", a.runID)
+		}
+	case CommandShow:
+		out, err = brigade.FetchReclaim(ctx, conf, a.runID)
+		if err != nil {
+			logging.Fatal(logger, "can't fetch reclaim", err, "run_id", a.runID)
+		}
+	case CommandList:
+		list, err := brigade.ListReclaims(ctx, conf, a.limit)
+		if err != nil {
+			logging.Fatal(logger, "can't list reclaims", err)
+		}
+
+		if list == nil {
+			list = []*brigade.ReclaimRun{}
+		}
+
+		out = list
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		logging.Fatal(logger, "can't print report", err)
+	}
+}
+
+func parseArgs() (*args, error) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s|%s|%s|%s|%s [options]\n",
+			os.Args[0], kdlib.WastedNotVisited, kdlib.WastedInactive, CommandResume, CommandShow, CommandList)
+		flag.PrintDefaults()
+	}
+
+	a := &args{}
+
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.Parse()
+
+	if len(flag.Args()) < 1 {
+		return nil, fmt.Errorf("no command specified")
+	}
+
+	a.cmd = flag.Args()[0]
+	cmdFlags := flag.NewFlagSet(a.cmd, flag.ExitOnError)
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s [options]\n", os.Args[0], a.cmd)
+		cmdFlags.PrintDefaults()
+	}
+
+	switch a.cmd {
+	case kdlib.WastedNotVisited, kdlib.WastedInactive:
+		a.params.Selector = a.cmd
+
+		cmdFlags.IntVar(&a.params.Num, "cap", defaultMaxBrigades, "max brigades to delete in the run")
+		cmdFlags.IntVar(&a.params.Rate, "rate", 0, "max deletions per minute, unlimited if 0")
+
+		if a.cmd == kdlib.WastedNotVisited {
+			cmdFlags.IntVar(&a.params.Days, "d", defaultFirstVisitDaysLimit, "days limit to first visit")
+		} else {
+			cmdFlags.IntVar(&a.params.Months, "m", defaultActiveCreatedAtMonthsLimit, "months limit from registration")
+			cmdFlags.IntVar(&a.params.MinActive, "x", defaultMinActiveUsers, "minmium active users count for live")
+		}
+
+		cmdFlags.Parse(flag.Args()[1:])
+
+		if a.params.Num < 1 || a.params.Rate < 0 {
+			return nil, fmt.Errorf("cap/rate: %w", errInlalidArgs)
+		}
+
+		if (a.cmd == kdlib.WastedNotVisited && a.params.Days < 1) || (a.cmd == kdlib.WastedInactive && a.params.MinActive < 1) {
+			return nil, fmt.Errorf("days/x: %w", errInlalidArgs)
+		}
+	case CommandResume, CommandShow:
+		cmdFlags.Int64Var(&a.runID, "run", 0, "reclaim run ID")
+		if a.cmd == CommandResume {
+			cmdFlags.BoolVar(&a.retry, "retry", false, "retry the failed brigades")
+		}
+
+		cmdFlags.Parse(flag.Args()[1:])
+
+		if a.runID < 1 {
+			return nil, fmt.Errorf("run: %w", errInlalidArgs)
+		}
+	case CommandList:
+		cmdFlags.IntVar(&a.limit, "n", 0, "max runs, 20 by default")
+
+		cmdFlags.Parse(flag.Args()[1:])
+	default:
+		return nil, fmt.Errorf("unknown command: %w", errInlalidArgs)
+	}
+
+	return a, nil
+}
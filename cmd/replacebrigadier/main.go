@@ -3,13 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/netip"
@@ -22,6 +21,7 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	dcmgmt "github.com/vpngen/dc-mgmt"
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 	"github.com/vpngen/keydesk/gen/models"
 	"github.com/vpngen/keydesk/keydesk"
 
@@ -55,13 +55,15 @@ const (
 	FROM %s
 	WHERE
 		brigade_id=$1
-	FOR UPDATE
 	`
 )
 
 const defaultWireguardConfigs = "native"
 
-var errInlalidArgs = errors.New("invalid args")
+var (
+	errInlalidArgs = errors.New("invalid args")
+	errNotRun      = errors.New("command is not run")
+)
 
 var LogTag = setLogTag()
 
@@ -76,15 +78,29 @@ func setLogTag() string {
 	return filepath.Base(executable)
 }
 
+type args struct {
+	chunked   bool
+	jout      bool
+	brigadeID string // base32
+	id        string // uuid
+	force     bool
+	repl      kdlib.Replacement
+}
+
+// Every replacement is recorded, the replacements number per brigade is limited by REPLACE_LIMIT
+// in REPLACE_LIMIT_PERIOD, the forced replacement ignores the limit.
+// The forced replacement is refused by ssh_command.sh, it's for the local admin only.
 func main() {
+	logger := logging.Setup(LogTag)
+
 	var w io.WriteCloser
 
-	chunked, jout, brigadeID, id, err := parseArgs()
+	a, err := parseArgs()
 	if err != nil {
-		log.Fatalf("%s: Can't parse args: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't parse args", err)
 	}
 
-	switch chunked {
+	switch a.chunked {
 	case true:
 		w = httputil.NewChunkedWriter(os.Stdout)
 		defer w.Close()
@@ -92,34 +108,58 @@ func main() {
 		w = os.Stdout
 	}
 
-	sshKeyFilename, dbname, schema, opts, err := readConfigs()
+	sshKeyFilename, dbname, schema, opts, policy, err := readConfigs()
 	if err != nil {
-		fatal(w, jout, "%s: Can't read configs: %s\n", LogTag, err)
+		fatal(w, a.jout, "%s: Can't read configs: %s\n", LogTag, err)
 	}
 
 	sshconf, err := kdlib.CreateSSHConfig(sshKeyFilename, sshkeyRemoteUsername, kdlib.SSHDefaultTimeOut)
 	if err != nil {
-		fatal(w, jout, "%s: Can't create ssh configs: %s\n", LogTag, err)
+		fatal(w, a.jout, "%s: Can't create ssh configs: %s\n", LogTag, err)
 	}
 
 	db, err := createDBPool(dbname)
 	if err != nil {
-		fatal(w, jout, "%s: Can't create db pool: %s\n", LogTag, err)
+		fatal(w, a.jout, "%s: Can't create db pool: %s\n", LogTag, err)
 	}
 
+	ctx := context.Background()
+
 	// attention! id - uuid-style string.
-	controlIP, keydeskIPv6, err := checkBrigade(db, schema, id)
+	controlIP, keydeskIPv6, err := fetchBrigade(ctx, db, schema, a.id)
 	if err != nil {
-		fatal(w, jout, "%s: Can't check brigade: %s\n", LogTag, err)
+		fatal(w, a.jout, "%s: Can't check brigade: %s\n", LogTag, err)
+	}
+
+	a.repl.Forced = a.force
+	a.repl.Origin = sshOrigin()
+	a.repl.OpID = logging.OpID()
+
+	// The replacement is recorded first, so the node is never ahead of the history.
+	if err := kdlib.ReserveReplacement(ctx, db, schema, a.id, policy, &a.repl); err != nil {
+		if errors.Is(err, kdlib.ErrReplaceLimit) {
+			fatalCode(w, a.jout, http.StatusTooManyRequests, "%s: Can't replace brigadier: %s\n", LogTag, err)
+		}
+
+		fatal(w, a.jout, "%s: Can't record replacement: %s\n", LogTag, err)
 	}
 
 	// attention! brigadeID - base32-style.
-	wgconf, err := replaceBrigadier(db, schema, sshconf, brigadeID, controlIP, opts)
+	wgconf, err := replaceBrigadier(sshconf, a.brigadeID, controlIP, opts)
 	if err != nil {
-		fatal(w, jout, "%s: Can't replace brigadier: %s\n", LogTag, err)
+		// The node might have replaced the brigadier if the command was run, the record is kept then.
+		if errors.Is(err, errNotRun) {
+			if cerr := kdlib.CancelReplacement(ctx, db, schema, &a.repl); cerr != nil {
+				logger.Error("can't cancel replacement", logging.KeyBrigade, a.id, logging.KeyError, cerr)
+			}
+		}
+
+		fatal(w, a.jout, "%s: Can't replace brigadier: %s\n", LogTag, err)
 	}
 
-	switch jout {
+	logger.Info("brigadier is replaced", logging.KeyBrigade, a.id, "caller", a.repl.Caller, "origin", a.repl.Origin, "reason", a.repl.Reason, "forced", a.force)
+
+	switch a.jout {
 	case true:
 		answ := dcmgmt.Answer{
 			Answer: keydesk.Answer{
@@ -133,62 +173,61 @@ func main() {
 
 		payload, err := json.Marshal(answ)
 		if err != nil {
-			fatal(w, jout, "%s: Can't marshal answer: %s\n", LogTag, err)
+			fatal(w, a.jout, "%s: Can't marshal answer: %s\n", LogTag, err)
 		}
 
 		if _, err := w.Write(payload); err != nil {
-			fatal(w, jout, "%s: Can't write answer: %s\n", LogTag, err)
+			fatal(w, a.jout, "%s: Can't write answer: %s\n", LogTag, err)
 		}
 	default:
 		if _, err = fmt.Fprintln(w, keydeskIPv6.String()); err != nil {
-			log.Fatalf("%s: Can't print keydesk ipv6: %s\n", LogTag, err)
+			logging.Fatal(logger, "can't print keydesk ipv6", err)
 		}
 
 		if _, err := fmt.Fprintln(w, *wgconf.WireguardConfig.FileName); err != nil {
-			log.Fatalf("%s: Can't print wgconf filename: %s\n", LogTag, err)
+			logging.Fatal(logger, "can't print wgconf filename", err)
 		}
 
 		if _, err := fmt.Fprintln(w, *wgconf.WireguardConfig.FileContent); err != nil {
-			log.Fatalf("%s: Can't print wgconf content: %s\n", LogTag, err)
+			logging.Fatal(logger, "can't print wgconf content", err)
 		}
 	}
 }
 
 const fatalString = `{
-	"code" : 500,
-	"desc" : "Internal Server Error",
+	"code" : %d,
+	"desc" : "%s",
 	"status" : "error",
 	"message" : "%s"
 }`
 
 func fatal(w io.Writer, jout bool, format string, args ...any) {
+	fatalCode(w, jout, http.StatusInternalServerError, format, args...)
+}
+
+func fatalCode(w io.Writer, jout bool, code int, format string, args ...any) {
 	msg := fmt.Sprintf(format, args...)
 
 	switch jout {
 	case true:
-		fmt.Fprintf(w, fatalString, msg)
+		fmt.Fprintf(w, fatalString, code, http.StatusText(code), msg)
 	default:
 		fmt.Fprint(w, msg)
 	}
 
-	log.Fatal(msg)
-}
-
-func checkBrigade(db *pgxpool.Pool, schema string, brigadeID string) (netip.Addr, netip.Addr, error) {
-	ctx := context.Background()
-	emptyIP := netip.Addr{}
+	slog.Error(strings.TrimSpace(msg))
 
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return emptyIP, emptyIP, fmt.Errorf("begin: %w", err)
-	}
+	os.Exit(1)
+}
 
+// fetchBrigade - the brigade pair and keydesk address.
+func fetchBrigade(ctx context.Context, db *pgxpool.Pool, schema string, brigadeID string) (netip.Addr, netip.Addr, error) {
 	var (
 		controlIP   netip.Addr
 		keydeskIPv6 netip.Addr
 	)
 
-	err = tx.QueryRow(ctx,
+	if err := db.QueryRow(ctx,
 		fmt.Sprintf(sqlGetControlIP,
 			(pgx.Identifier{schema, "meta_brigades"}.Sanitize()),
 		),
@@ -196,22 +235,21 @@ func checkBrigade(db *pgxpool.Pool, schema string, brigadeID string) (netip.Addr
 	).Scan(
 		&controlIP,
 		&keydeskIPv6,
-	)
-	if err != nil {
-		tx.Rollback(ctx)
-
-		return emptyIP, emptyIP, fmt.Errorf("brigade query: %w", err)
-	}
-
-	err = tx.Commit(ctx)
-	if err != nil {
-		return emptyIP, emptyIP, fmt.Errorf("commit: %w", err)
+	); err != nil {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("brigade query: %w", err)
 	}
 
 	return controlIP, keydeskIPv6, nil
 }
 
-func replaceBrigadier(db *pgxpool.Pool, schema string, sshconf *ssh.ClientConfig, brigadeID string, control_ip netip.Addr, opts vpnCfgs) (*models.Newuser, error) {
+// sshOrigin - the ssh client address of the caller, empty if it's run locally.
+func sshOrigin() string {
+	origin, _, _ := strings.Cut(os.Getenv("SSH_CLIENT"), " ")
+
+	return origin
+}
+
+func replaceBrigadier(sshconf *ssh.ClientConfig, brigadeID string, control_ip netip.Addr, opts vpnCfgs) (*models.Newuser, error) {
 	cmd := fmt.Sprintf("replace -id %s -ch -j", brigadeID)
 
 	if opts.wg != "" {
@@ -230,17 +268,17 @@ func replaceBrigadier(db *pgxpool.Pool, schema string, sshconf *ssh.ClientConfig
 		cmd += fmt.Sprintf(" -outline %s", opts.outline)
 	}
 
-	fmt.Fprintf(os.Stderr, "%s: %s#%s:22 -> %s\n", LogTag, sshkeyRemoteUsername, control_ip, cmd)
+	slog.Info("node command", logging.KeyBrigade, brigadeID, logging.KeyControlIP, control_ip, "user", sshkeyRemoteUsername, "cmd", cmd)
 
 	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", control_ip), sshconf)
 	if err != nil {
-		return nil, fmt.Errorf("ssh dial: %w", err)
+		return nil, fmt.Errorf("%w: ssh dial: %w", errNotRun, err)
 	}
 	defer client.Close()
 
 	session, err := client.NewSession()
 	if err != nil {
-		return nil, fmt.Errorf("ssh session: %w", err)
+		return nil, fmt.Errorf("%w: ssh session: %w", errNotRun, err)
 	}
 	defer session.Close()
 
@@ -249,15 +287,11 @@ func replaceBrigadier(db *pgxpool.Pool, schema string, sshconf *ssh.ClientConfig
 	session.Stdout = &b
 	session.Stderr = &e
 
+	kdlib.SSHSetOpID(session)
+
 	defer func() {
-		switch errstr := e.String(); errstr {
-		case "":
-			fmt.Fprintf(os.Stderr, "%s: SSH Session StdErr: empty\n", LogTag)
-		default:
-			fmt.Fprintf(os.Stderr, "%s: SSH Session StdErr:\n", LogTag)
-			for _, line := range strings.Split(errstr, "\n") {
-				fmt.Fprintf(os.Stderr, "%s: | %s\n", LogTag, line)
-			}
+		if errstr := e.String(); errstr != "" {
+			slog.Info("ssh session stderr", logging.KeyControlIP, control_ip, "stderr", logging.Lines(errstr))
 		}
 	}()
 
@@ -292,40 +326,30 @@ func createDBPool(dburl string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-func parseArgs() (bool, bool, string, string, error) {
+func parseArgs() (*args, error) {
+	a := &args{}
+
 	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
 	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
-	chunked := flag.Bool("ch", false, "chunked output")
-	jsonOut := flag.Bool("j", false, "json output")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+	flag.BoolVar(&a.force, "f", false, "ignore the replacements limit, local admin only")
+	flag.StringVar(&a.repl.Caller, "by", "", "who asks for the replacement, self-reported, it's recorded with the ssh origin")
+	flag.StringVar(&a.repl.Reason, "reason", "", "replacement reason, it's recorded")
 
 	flag.Parse()
 
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
 	switch {
-	case *brigadeID != "" && *brigadeUUID == "":
-		// brigadeID must be base32 decodable.
-		buf, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(*brigadeID)
-		if err != nil {
-			return false, false, "", "", fmt.Errorf("id base32: %s: %w", *brigadeID, err)
-		}
-
-		id, err := uuid.FromBytes(buf)
-		if err != nil {
-			return false, false, "", "", fmt.Errorf("id uuid: %s: %w", *brigadeID, err)
-		}
-
-		return *chunked, *jsonOut, *brigadeID, id.String(), nil
-	case *brigadeUUID != "" && *brigadeID == "":
-		id, err := uuid.Parse(*brigadeUUID)
-		if err != nil {
-			return false, false, "", "", fmt.Errorf("id uuid: %s: %w", *brigadeID, err)
-		}
+	case err != nil:
+		return nil, err
+	case id == uuid.Nil:
+		return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+	}
 
-		bid := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id[:])
+	a.brigadeID, a.id = kdlib.BrigadeID32(id), id.String()
 
-		return *chunked, *jsonOut, bid, id.String(), nil
-	default:
-		return false, false, "", "", fmt.Errorf("both ids: %w", errInlalidArgs)
-	}
+	return a, nil
 }
 
 type vpnCfgs struct {
@@ -335,7 +359,7 @@ type vpnCfgs struct {
 	outline string
 }
 
-func readConfigs() (string, string, string, vpnCfgs, error) {
+func readConfigs() (string, string, string, vpnCfgs, kdlib.ReplacePolicy, error) {
 	opts := vpnCfgs{}
 
 	dbURL := os.Getenv("DB_URL")
@@ -350,7 +374,7 @@ func readConfigs() (string, string, string, vpnCfgs, error) {
 
 	sshKeyFilename, err := kdlib.LookupForSSHKeyfile(os.Getenv("SSH_KEY"), sshkeyDefaultPath)
 	if err != nil {
-		return "", "", "", opts, fmt.Errorf("lookup for ssh key: %w", err)
+		return "", "", "", opts, kdlib.ReplacePolicy{}, fmt.Errorf("lookup for ssh key: %w", err)
 	}
 
 	opts.wg = os.Getenv("REPLACE_WIREGUARD_CONFIGS")
@@ -362,5 +386,10 @@ func readConfigs() (string, string, string, vpnCfgs, error) {
 	opts.ipsec = os.Getenv("REPLACE_IPSEC_CONFIGS")
 	opts.outline = os.Getenv("REPLACE_OUTLINE_CONFIGS")
 
-	return sshKeyFilename, dbURL, brigadeSchema, opts, nil
+	policy, err := kdlib.ReplacePolicyFromEnv()
+	if err != nil {
+		return "", "", "", opts, policy, err
+	}
+
+	return sshKeyFilename, dbURL, brigadeSchema, opts, policy, nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	defaultDatabaseURL    = "postgresql:///vgrealm"
+	defaultBrigadesSchema = "brigades"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "replacehistory"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked bool
+	jout    bool
+	id      string
+	limit   int
+}
+
+// History - the brigadier replacements of the brigade with the policy state.
+type History struct {
+	BrigadeID    string               `json:"brigade_id"`
+	Limit        int                  `json:"limit"`
+	Period       string               `json:"period"`
+	InPeriod     int                  `json:"in_period"`
+	Replacements []*kdlib.Replacement `json:"replacements"`
+}
+
+// The brigadier replacements of the brigade, the last first.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	dbURL, schema, policy, err := readConfigs()
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	db, err := kdlib.CreateDBPool(dbURL)
+	if err != nil {
+		logging.Fatal(logger, "can't create db pool", err)
+	}
+
+	ctx := context.Background()
+
+	h := &History{
+		BrigadeID: a.id,
+		Limit:     policy.Max,
+		Period:    policy.Period.String(),
+	}
+
+	h.InPeriod, err = kdlib.CountReplacements(ctx, db, schema, a.id, policy)
+	if err != nil {
+		logging.Fatal(logger, "can't count replacements", err, logging.KeyBrigade, a.id)
+	}
+
+	h.Replacements, err = kdlib.ListReplacements(ctx, db, schema, a.id, a.limit)
+	if err != nil {
+		logging.Fatal(logger, "can't list replacements", err, logging.KeyBrigade, a.id)
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if a.jout {
+		if h.Replacements == nil {
+			h.Replacements = []*kdlib.Replacement{}
+		}
+
+		if err := json.NewEncoder(w).Encode(h); err != nil {
+			logging.Fatal(logger, "can't print history", err)
+		}
+
+		return
+	}
+
+	if _, err := fmt.Fprintf(w, "%d\t%d\t%s\n", h.InPeriod, h.Limit, h.Period); err != nil {
+		logging.Fatal(logger, "can't print history", err)
+	}
+
+	for _, r := range h.Replacements {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\n",
+			r.ReplacedAt.Format(time.RFC3339), r.Caller, r.Origin, r.Forced, r.OpID, r.Reason,
+		); err != nil {
+			logging.Fatal(logger, "can't print history", err)
+		}
+	}
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
+	flag.IntVar(&a.limit, "n", 0, "max records, 100 by default")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.BoolVar(&a.jout, "j", false, "json output")
+
+	flag.Parse()
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	switch {
+	case err != nil:
+		return nil, err
+	case id == uuid.Nil:
+		return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+	}
+
+	a.id = id.String()
+
+	return a, nil
+}
+
+func readConfigs() (string, string, kdlib.ReplacePolicy, error) {
+	dbURL := os.Getenv("DB_URL")
+	if dbURL == "" {
+		dbURL = defaultDatabaseURL
+	}
+
+	brigadesSchema := os.Getenv("BRIGADES_SCHEMA")
+	if brigadesSchema == "" {
+		brigadesSchema = defaultBrigadesSchema
+	}
+
+	policy, err := kdlib.ReplacePolicyFromEnv()
+	if err != nil {
+		return "", "", policy, err
+	}
+
+	return dbURL, brigadesSchema, policy, nil
+}
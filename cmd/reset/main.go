@@ -5,10 +5,12 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/netip"
 	"os"
+	"path/filepath"
 
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 	"github.com/vpngen/keydesk/keydesk"
 	"github.com/vpngen/keydesk/keydesk/storage"
 	"github.com/vpngen/vpngine/naclkey"
@@ -23,21 +25,37 @@ var (
 	ErrCantDecrypt = errors.New("can't decrypt")
 )
 
+var LogTag = setLogTag()
+
+const defaultLogTag = "reset"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
 func main() {
+	logger := logging.Setup(LogTag)
+
 	shufflerFile, routerFile, brigadeID, dbFile, epAddr, err := parseArgs()
 	if err != nil {
-		log.Fatalf("Can't init: %s\n", err)
+		logging.Fatal(logger, "can't parse args", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Brigade: %s\n", brigadeID)
-	fmt.Fprintf(os.Stderr, "DBFile: %s\n", dbFile)
+	logger = logger.With(logging.KeyBrigade, brigadeID)
+
+	logger.Info("reset brigade", "file", dbFile)
 	if epAddr.IsValid() {
-		fmt.Fprintf(os.Stderr, "New Endpoint IPv4: %s\n", epAddr)
+		logger.Info("new endpoint", "endpoint_ipv4", epAddr)
 	}
 
 	routerKey, shufflerKeys, err := readKeys(routerFile, shufflerFile)
 	if err != nil {
-		log.Fatalf("Can't read keys: %s\n", err)
+		logging.Fatal(logger, "can't read keys", err)
 	}
 
 	db := &storage.BrigadeStorage{
@@ -53,11 +71,11 @@ func main() {
 	}
 
 	if err := db.SelfCheckAndInit(); err != nil {
-		log.Fatalf("Storage initialization: %s\n", err)
+		logging.Fatal(logger, "can't init storage", err, "file", dbFile)
 	}
 
 	if err := Do(db, routerKey, shufflerKeys, epAddr); err != nil {
-		log.Fatalf("Do: %s\n", err)
+		logging.Fatal(logger, "can't reset", err)
 	}
 }
 
@@ -123,13 +141,7 @@ func Do(db *storage.BrigadeStorage, routerKey *[naclkey.NaclBoxKeyLength]byte, s
 }
 
 func reEncrypt(routerKey *[naclkey.NaclBoxKeyLength]byte, shufflerKeys *naclkey.NaclBoxKeypair, payload []byte) ([]byte, error) {
-	fmt.Printf("Re-encrypting %d bytes\n", len(payload))
-
-	fmt.Printf("Router key: %x\n", *routerKey)
-	fmt.Printf("Shuffler public key: %x\n", shufflerKeys.Public)
-	fmt.Printf("Shuffler private key: %x\n", shufflerKeys.Private)
-
-	fmt.Printf("Payload: %x\n", payload)
+	slog.Debug("re-encrypting", "bytes", len(payload))
 
 	decrypted, ok := box.OpenAnonymous(nil, payload, &shufflerKeys.Public, &shufflerKeys.Private)
 
@@ -156,9 +168,9 @@ func readKeys(routerFile, shufflerFile string) (*[naclkey.NaclBoxKeyLength]byte,
 		return nil, nil, fmt.Errorf("shuffler key: %w", err)
 	}
 
-	fmt.Printf("Router key: %x\n", routerKey)
-	fmt.Printf("Shuffler public key: %x\n", shufflerKeys.Public)
-	fmt.Printf("Shuffler private key: %x\n", shufflerKeys.Private)
+	slog.Debug("keys read",
+		"router_key", fmt.Sprintf("%x", routerKey),
+		"shuffler_key", fmt.Sprintf("%x", shufflerKeys.Public))
 
 	return &routerKey, &shufflerKeys, nil
 }
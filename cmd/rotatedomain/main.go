@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const defaultParallel = 8
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "rotatedomain"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked  bool
+	all      bool
+	release  bool
+	parallel int
+	id       string
+}
+
+// The brigade gets the new subdomain on the same endpoint, the old one
+// is released after the new one is resolved. All the brigades domains
+// are rotated at once with -all. The unfinished rotations of the brigade,
+// or of all the brigades without the ID, are resumed with -release.
+// The output is JSON.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	ctx := context.Background()
+
+	var out any
+
+	switch {
+	case a.release:
+		out, err = brigade.ReleaseDomains(ctx, conf, a.id, a.parallel)
+		if err != nil {
+			logging.Fatal(logger, "can't release domains", err)
+		}
+	case a.all:
+		out, err = brigade.RotateAllDomains(ctx, conf, a.parallel)
+		if err != nil {
+			logging.Fatal(logger, "can't rotate domains", err)
+		}
+	default:
+		out, err = brigade.RotateDomain(ctx, conf, a.id)
+		if err != nil {
+			logging.Fatal(logger, "can't rotate domain", err, logging.KeyBrigade, a.id)
+		}
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		logging.Fatal(logger, "can't print result", err)
+	}
+}
+
+func parseArgs() (*args, error) {
+	a := &args{}
+
+	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
+	flag.BoolVar(&a.all, "all", false, "rotate the domains of all the brigades")
+	flag.BoolVar(&a.release, "release", false, "resume the unfinished rotations, of all the brigades without id")
+	flag.IntVar(&a.parallel, "p", defaultParallel, "brigades to wait for at once, -all and -release only")
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+
+	flag.Parse()
+
+	if a.release {
+		if a.all {
+			return nil, fmt.Errorf("all and release: %w", errInlalidArgs)
+		}
+
+		if a.parallel < 1 {
+			return nil, fmt.Errorf("parallel: %w", errInlalidArgs)
+		}
+
+		id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+		if err != nil {
+			return nil, err
+		}
+
+		if id != uuid.Nil {
+			a.id = id.String()
+		}
+
+		return a, nil
+	}
+
+	if a.all {
+		if *brigadeID != "" || *brigadeUUID != "" {
+			return nil, fmt.Errorf("all and id: %w", errInlalidArgs)
+		}
+
+		if a.parallel < 1 {
+			return nil, fmt.Errorf("parallel: %w", errInlalidArgs)
+		}
+
+		return a, nil
+	}
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	switch {
+	case err != nil:
+		return nil, err
+	case id == uuid.Nil:
+		return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+	}
+
+	a.id = id.String()
+
+	return a, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/reset"
+)
+
+const (
+	CommandRotate      = "rotate"
+	CommandQuarantined = "quarantined"
+	CommandRelease     = "release"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "rotateendpoint"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+type args struct {
+	chunked      bool
+	cmd          string
+	id           string
+	quarantine   bool
+	reason       string
+	endpoint     netip.Addr
+	routerFile   string
+	shufflerFile string
+}
+
+// The brigade gets the free endpoint of the same pair, the old endpoint
+// is freed or quarantined. The quarantined endpoints are listed and released
+// by hand. The output is JSON.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	a, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	ctx := context.Background()
+
+	var out any
+
+	switch a.cmd {
+	case CommandRotate:
+		routerKey, shufflerKeys, err := reset.ReadKeys(a.routerFile, a.shufflerFile)
+		if err != nil {
+			logging.Fatal(logger, "can't read keys", err)
+		}
+
+		out, err = brigade.Rotate(ctx, conf, a.id, brigade.RotateOpts{
+			Quarantine:   a.quarantine,
+			Reason:       a.reason,
+			RouterKey:    routerKey,
+			ShufflerKeys: shufflerKeys,
+		})
+		if err != nil {
+			logging.Fatal(logger, "can't rotate endpoint", err, logging.KeyBrigade, a.id)
+		}
+	case CommandQuarantined:
+		out, err = brigade.ListQuarantined(ctx, conf)
+		if err != nil {
+			logging.Fatal(logger, "can't list quarantined", err)
+		}
+	case CommandRelease:
+		if err := brigade.ReleaseQuarantined(ctx, conf, a.endpoint); err != nil {
+			logging.Fatal(logger, "can't release endpoint", err, "endpoint_ipv4", a.endpoint)
+		}
+
+		out = struct {
+			EndpointIPv4 netip.Addr `json:"endpoint_ipv4"`
+		}{a.endpoint}
+	}
+
+	switch a.chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		logging.Fatal(logger, "can't print result", err)
+	}
+}
+
+func parseArgs() (*args, error) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s|%s|%s [options]\n",
+			os.Args[0], CommandRotate, CommandQuarantined, CommandRelease)
+		flag.PrintDefaults()
+	}
+
+	a := &args{}
+
+	flag.BoolVar(&a.chunked, "ch", false, "chunked output")
+	flag.Parse()
+
+	if len(flag.Args()) < 1 {
+		return nil, fmt.Errorf("no command specified")
+	}
+
+	a.cmd = flag.Args()[0]
+	cmdFlags := flag.NewFlagSet(a.cmd, flag.ExitOnError)
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s [options]\n", os.Args[0], a.cmd)
+		cmdFlags.PrintDefaults()
+	}
+
+	switch a.cmd {
+	case CommandRotate:
+		brigadeID := cmdFlags.String("id", "", "brigadier_id in base32 form")
+		brigadeUUID := cmdFlags.String("uuid", "", "brigadier_id in uuid form")
+		cmdFlags.BoolVar(&a.quarantine, "q", false, "quarantine the old endpoint instead of freeing it")
+		cmdFlags.StringVar(&a.reason, "reason", "", "quarantine reason")
+		cmdFlags.StringVar(&a.routerFile, "rk", os.Getenv("ROUTER_KEY_FILE"), "router public key file")
+		cmdFlags.StringVar(&a.shufflerFile, "sk", os.Getenv("SHUFFLER_KEY_FILE"), "shuffler keypair file")
+
+		cmdFlags.Parse(flag.Args()[1:])
+
+		id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+		switch {
+		case err != nil:
+			return nil, err
+		case id == uuid.Nil:
+			return nil, fmt.Errorf("id or uuid: %w", errInlalidArgs)
+		}
+
+		a.id = id.String()
+
+		if a.routerFile == "" || a.shufflerFile == "" {
+			return nil, fmt.Errorf("no keys: %w", errInlalidArgs)
+		}
+	case CommandQuarantined:
+		cmdFlags.Parse(flag.Args()[1:])
+	case CommandRelease:
+		ip := cmdFlags.String("ip", "", "quarantined endpoint ipv4")
+
+		cmdFlags.Parse(flag.Args()[1:])
+
+		endpoint, err := netip.ParseAddr(*ip)
+		if err != nil || !endpoint.Is4() {
+			return nil, fmt.Errorf("ip: %s: %w", *ip, errInlalidArgs)
+		}
+
+		a.endpoint = endpoint
+	default:
+		return nil, fmt.Errorf("unknown command: %w", errInlalidArgs)
+	}
+
+	return a, nil
+}
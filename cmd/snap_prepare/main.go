@@ -6,11 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
 	dcmgmt "github.com/vpngen/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 	"golang.org/x/crypto/ssh"
 
 	snapCore "github.com/vpngen/keydesk-snap/core"
@@ -31,13 +32,15 @@ func setLogTag() string {
 }
 
 func main() {
+	logger := logging.Setup(LogTag)
+
 	opts, err := conf()
 	if err != nil {
-		log.Fatalf("%s: Can't read configs: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't read configs", err)
 	}
 
 	if err := recode(opts); err != nil {
-		log.Fatalf("%s: Can't recode: %s\n", LogTag, err)
+		logging.Fatal(logger, "can't recode", err)
 	}
 }
 
@@ -171,7 +174,7 @@ func checkIn(data *dcmgmt.AggrSnaps, o *opts) error {
 	}
 
 	if data.ErrorsCount > 0 {
-		fmt.Fprintf(os.Stderr, "%s: errors count: %d\n", LogTag, data.ErrorsCount)
+		slog.Warn("snapshot has errors", "errors", data.ErrorsCount)
 
 		if o.force {
 			return fmt.Errorf("%w: %d", ErrSnapshotErrors, data.ErrorsCount)
@@ -30,6 +30,17 @@ if [ -s "/etc/vg-dc-vpnapi/creation.env" ]; then
         . "/etc/vg-dc-vpnapi/creation.env"
 fi
 
+# The log settings and the operation ID of the caller are passed to every command.
+# The OP_ID reaches this host and the nodes only with "AcceptEnv OP_ID" in sshd,
+# see /etc/vg-dc-vpnapi/sshd-op-id.conf-sample.
+# The node API extensions are the same for all the commands changing the brigades.
+export OP_ID="${OP_ID}" LOG_FORMAT="${LOG_FORMAT}" LOG_LEVEL="${LOG_LEVEL}" NODE_API_EXTENSIONS="${NODE_API_EXTENSIONS}"
+
+# Locking: every command changing the brigades takes /tmp/modbrigade.lock shared,
+# the concurrent changes are resolved by the database (unique keys, row locks and
+# optimistic checks), so the commands run in parallel here and on the other hosts. The lists syncs below take the lock
+# exclusively, they never run in the middle of a change on this host.
+
 vpn_works_keysesks_sync() {
         /usr/bin/flock -x -E 0 -n /tmp/modbrigade.lock "${basedir}"/vpn-works-keydesks-sync.sh 2>&1 | /usr/bin/logger -p local0.notice -t KDSYNC
 }
@@ -46,13 +57,20 @@ if [ "addbrigade" = "${cmd}" ]; then
         DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
         KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
         KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
         KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
         DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
         WIREGUARD_CONFIGS="${WIREGUARD_CONFIGS}" \
         OVC_CONFIGS="${OVC_CONFIGS}" \
         OUTLINE_CONFIGS="${OUTLINE_CONFIGS}" \
         IPSEC_CONFIGS="${IPSEC_CONFIGS}" \
-        flock -x -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/addbrigade "$@"
+        ADDRESS_ALLOCATION="${ADDRESS_ALLOCATION}" \
+        PLACEMENT_POLICY="${PLACEMENT_POLICY}" \
+        PLACEMENT_LABELS="${PLACEMENT_LABELS}" \
+        DELEGATION_WAIT="${DELEGATION_WAIT}" \
+        REPLACE_LIMIT="${REPLACE_LIMIT}" \
+        REPLACE_LIMIT_PERIOD="${REPLACE_LIMIT_PERIOD}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/addbrigade "$@"
         #vpn_works_keysesks_sync
         #delegation_sync
 elif [ "delbrigade" = "${cmd}" ]; then
@@ -63,27 +81,217 @@ elif [ "delbrigade" = "${cmd}" ]; then
         DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
         KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
         KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
         KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
         DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
         WIREGUARD_CONFIGS="${WIREGUARD_CONFIGS}" \
         OVC_CONFIGS="${OVC_CONFIGS}" \
         OUTLINE_CONFIGS="${OUTLINE_CONFIGS}" \
         IPSEC_CONFIGS="${IPSEC_CONFIGS}" \
-        flock -x -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/delbrigade "$@"
+        DELETION_GRACE="${DELETION_GRACE}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/delbrigade "$@"
         #vpn_works_keysesks_sync
         #delegation_sync
+elif [ "undelbrigade" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/undelbrigade "$@"
+elif [ "purgebrigades" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/purgebrigades "$@"
+elif [ "brigadearchive" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        "${basedir}"/brigadearchive "$@"
+elif [ "findbrigades" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        "${basedir}"/findbrigades "$@"
+elif [ "brigadejournal" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        WIREGUARD_CONFIGS="${WIREGUARD_CONFIGS}" \
+        OVC_CONFIGS="${OVC_CONFIGS}" \
+        OUTLINE_CONFIGS="${OUTLINE_CONFIGS}" \
+        IPSEC_CONFIGS="${IPSEC_CONFIGS}" \
+        ADDRESS_ALLOCATION="${ADDRESS_ALLOCATION}" \
+        PLACEMENT_POLICY="${PLACEMENT_POLICY}" \
+        PLACEMENT_LABELS="${PLACEMENT_LABELS}" \
+        DELEGATION_WAIT="${DELEGATION_WAIT}" \
+        REPLACE_LIMIT="${REPLACE_LIMIT}" \
+        REPLACE_LIMIT_PERIOD="${REPLACE_LIMIT_PERIOD}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/brigadejournal "$@"
+elif [ "checkdelegation" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/checkdelegation "$@"
 elif [ "replacebrigadier" = "${cmd}" ]; then
+        # The forced replacement ignores the limit, it's for the local admin only.
+        for arg in "$@"; do
+                case "${arg}" in
+                        -f|-f=*|--f|--f=*)
+                                echo "Forced replacement is not allowed"
+                                exit 1
+                                ;;
+                esac
+        done
+
         DC_ID="${DC_ID}" \
         DC_NAME="${DC_NAME}" \
         REPLACE_WIREGUARD_CONFIGS="${REPLACE_WIREGUARD_CONFIGS}" \
         REPLACE_OVC_CONFIGS="${REPLACE_OVC_CONFIGS}" \
         REPLACE_OUTLINE_CONFIGS="${REPLACE_OUTLINE_CONFIGS}" \
         REPLACE_IPSEC_CONFIGS="${REPLACE_IPSEC_CONFIGS}" \
-        "${basedir}"/replacebrigadier "$@"
+        REPLACE_LIMIT="${REPLACE_LIMIT}" \
+        REPLACE_LIMIT_PERIOD="${REPLACE_LIMIT_PERIOD}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/replacebrigadier "$@"
+elif [ "replacehistory" = "${cmd}" ]; then
+        REPLACE_LIMIT="${REPLACE_LIMIT}" \
+        REPLACE_LIMIT_PERIOD="${REPLACE_LIMIT_PERIOD}" \
+        "${basedir}"/replacehistory "$@"
 elif [ "getwasted" = "${cmd}" ]; then
         "${basedir}"/getwasted "$@"
+elif [ "reclaim" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        WIREGUARD_CONFIGS="${WIREGUARD_CONFIGS}" \
+        OVC_CONFIGS="${OVC_CONFIGS}" \
+        OUTLINE_CONFIGS="${OUTLINE_CONFIGS}" \
+        IPSEC_CONFIGS="${IPSEC_CONFIGS}" \
+        DELETION_GRACE="${DELETION_GRACE}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/reclaim "$@"
+elif [ "movebrigade" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        PLACEMENT_POLICY="${PLACEMENT_POLICY}" \
+        PLACEMENT_LABELS="${PLACEMENT_LABELS}" \
+        DELEGATION_WAIT="${DELEGATION_WAIT}" \
+        ROUTER_KEY_FILE="${ROUTER_KEY_FILE}" \
+        SHUFFLER_KEY_FILE="${SHUFFLER_KEY_FILE}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/movebrigade "$@"
+elif [ "drainpair" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        PLACEMENT_POLICY="${PLACEMENT_POLICY}" \
+        PLACEMENT_LABELS="${PLACEMENT_LABELS}" \
+        DELEGATION_WAIT="${DELEGATION_WAIT}" \
+        ROUTER_KEY_FILE="${ROUTER_KEY_FILE}" \
+        SHUFFLER_KEY_FILE="${SHUFFLER_KEY_FILE}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/drainpair "$@"
+elif [ "rotateendpoint" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        DELEGATION_WAIT="${DELEGATION_WAIT}" \
+        ROUTER_KEY_FILE="${ROUTER_KEY_FILE}" \
+        SHUFFLER_KEY_FILE="${SHUFFLER_KEY_FILE}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/rotateendpoint "$@"
+elif [ "rotatedomain" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
+        flock -s -E 1 -w 60 /tmp/modbrigade.lock "${basedir}"/rotatedomain "$@"
 elif [ "checkbrigade" = "${cmd}" ]; then
+        DC_ID="${DC_ID}" \
+        DC_NAME="${DC_NAME}" \
+        SUBDOMAIN_API_SERVER="${SUBDOMAIN_API_SERVER}" \
+        SUBDOMAIN_API_TOKEN="${SUBDOMAIN_API_TOKEN}" \
+        DELEGATION_SYNC_CONNECT="${DELEGATION_SYNC_CONNECT}" \
+        KEYDESK_ADDRESS_SYNC_CONNECT="${KEYDESK_ADDRESS_SYNC_CONNECT}" \
+        KEYDESK_DOMAIN="${KEYDESK_DOMAIN}" \
+        KEYDESK_NAME_SCHEME="${KEYDESK_NAME_SCHEME}" \
+        KEYDESK_NAMESERVERS="${KEYDESK_NAMESERVERS}" \
+        DOMAIN_NAMESERVERS="${DOMAIN_NAMESERVERS}" \
         "${basedir}"/checkbrigade "$@"
+elif [ "forecast" = "${cmd}" ]; then
+    "${basedir}"/forecast "$@"
 elif [ "get_free_slots" = "${cmd}" ]; then
     "${basedir}"/get_free_slots "$@"
 else
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/vpngen/dc-mgmt/internal/brigade"
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+var errInlalidArgs = errors.New("invalid args")
+
+var LogTag = setLogTag()
+
+const defaultLogTag = "undelbrigade"
+
+func setLogTag() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return defaultLogTag
+	}
+
+	return filepath.Base(executable)
+}
+
+// The deleted brigade is resumed on the node within the grace period.
+func main() {
+	logger := logging.Setup(LogTag)
+
+	var w io.WriteCloser
+
+	chunked, force, id, err := parseArgs()
+	if err != nil {
+		logging.Fatal(logger, "can't parse args", err)
+	}
+
+	conf, err := brigade.NewConfigFromEnv(LogTag)
+	if err != nil {
+		logging.Fatal(logger, "can't read configs", err)
+	}
+
+	ctx := context.Background()
+
+	if err := brigade.Undelete(ctx, conf, id, force); err != nil {
+		logging.Fatal(logger, "can't undelete brigade", err, logging.KeyBrigade, id)
+	}
+
+	num, err := brigade.FreeSlots(ctx, conf)
+	if err != nil {
+		logging.Fatal(logger, "can't get free slots", err)
+	}
+
+	switch chunked {
+	case true:
+		w = httputil.NewChunkedWriter(os.Stdout)
+		defer w.Close()
+	default:
+		w = os.Stdout
+	}
+
+	if _, err := fmt.Fprintf(w, "%d\n", num); err != nil {
+		logging.Fatal(logger, "can't print output", err)
+	}
+}
+
+func parseArgs() (bool, bool, string, error) {
+	brigadeID := flag.String("id", "", "brigadier_id in base32 form")
+	brigadeUUID := flag.String("uuid", "", "brigadier_id in uuid form")
+	chunked := flag.Bool("ch", false, "chunked output")
+	force := flag.Bool("f", false, "restore the brigade after the grace period if it's not purged yet")
+
+	flag.Parse()
+
+	id, err := kdlib.ParseBrigadeID(*brigadeID, *brigadeUUID)
+	switch {
+	case err != nil:
+		return false, false, "", err
+	case id == uuid.Nil:
+		return false, false, "", fmt.Errorf("id or uuid: %w", errInlalidArgs)
+	}
+
+	return *chunked, *force, id.String(), nil
+}
@@ -7,10 +7,23 @@ export CGO_ENABLED=0
 go build -C dc-mgmt/cmd/addbrigade -o ../../../bin/addbrigade
 go build -C dc-mgmt/cmd/addbrigade/gen -o ../../../../bin/gen
 go build -C dc-mgmt/cmd/delbrigade -o ../../../bin/delbrigade
+go build -C dc-mgmt/cmd/undelbrigade -o ../../../bin/undelbrigade
+go build -C dc-mgmt/cmd/purgebrigades -o ../../../bin/purgebrigades
+go build -C dc-mgmt/cmd/brigadearchive -o ../../../bin/brigadearchive
+go build -C dc-mgmt/cmd/findbrigades -o ../../../bin/findbrigades
+go build -C dc-mgmt/cmd/brigadejournal -o ../../../bin/brigadejournal
+go build -C dc-mgmt/cmd/checkdelegation -o ../../../bin/checkdelegation
 go build -C dc-mgmt/cmd/checkbrigade -o ../../../bin/checkbrigade
 go build -C dc-mgmt/cmd/replacebrigadier -o ../../../bin/replacebrigadier
+go build -C dc-mgmt/cmd/replacehistory -o ../../../bin/replacehistory
 go build -C dc-mgmt/cmd/reset -o ../../../bin/reset
 go build -C dc-mgmt/cmd/getwasted -o ../../../bin/getwasted
+go build -C dc-mgmt/cmd/reclaim -o ../../../bin/reclaim
+go build -C dc-mgmt/cmd/movebrigade -o ../../../bin/movebrigade
+go build -C dc-mgmt/cmd/drainpair -o ../../../bin/drainpair
+go build -C dc-mgmt/cmd/rotateendpoint -o ../../../bin/rotateendpoint
+go build -C dc-mgmt/cmd/rotatedomain -o ../../../bin/rotatedomain
+go build -C dc-mgmt/cmd/forecast -o ../../../bin/forecast
 go build -C dc-mgmt/cmd/collectstats -o ../../../bin/collectstats
 go build -C dc-mgmt/cmd/get_free_slots -o ../../../bin/get_free_slots
 go build -C dc-mgmt/tools/cmd/dns-srv -o ../../../../bin/dns-srv
@@ -79,6 +79,9 @@ cleanInstall() {
         
         systemctl enable vg-dc-snaps.timer ||:
 	systemctl start vg-dc-snaps.timer ||:
+
+        systemctl enable vg-dc-purge.timer ||:
+        systemctl start vg-dc-purge.timer ||:
 }
 
 upgrade() {
@@ -99,6 +102,10 @@ upgrade() {
         systemctl enable vg-dc-snaps.timer ||:
         systemctl enable vg-dc-snaps.service ||:
 	systemctl restart vg-dc-snaps.timer ||:
+
+        systemctl enable vg-dc-purge.timer ||:
+        systemctl enable vg-dc-purge.service ||:
+        systemctl restart vg-dc-purge.timer ||:
 }
 
 # Step 2, check if this is a clean install or an upgrade
@@ -0,0 +1,214 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/wordsgens/namesgenerator"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+)
+
+const (
+	stressWorkers   = 8
+	stressBrigades  = 8 // per worker
+	stressNamespace = "allocate-stress-"
+)
+
+// TestAllocateConcurrent - creates many brigades in parallel and checks there are no duplicated addresses.
+// It needs the database with the free slots, e.g.
+// TEST_DB_URL=postgresql:///vgrealm go test -run TestAllocateConcurrent ./internal/brigade/
+func TestAllocateConcurrent(t *testing.T) {
+	dbURL := os.Getenv("TEST_DB_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DB_URL is not set")
+	}
+
+	db, err := kdlib.CreateDBPool(dbURL)
+	if err != nil {
+		t.Fatalf("db pool: %s", err)
+	}
+
+	defer db.Close()
+
+	c := &Config{
+		DB:                  db,
+		BrigadesSchema:      defaultBrigadesSchema,
+		BrigadesStatsSchema: defaultBrigadesStatsSchema,
+		PairsSchema:         defaultPairsSchema,
+		RandomAllocation:    false, // the worst case, everyone wants the same addresses
+		LogTag:              t.Name(),
+	}
+
+	ctx := context.Background()
+
+	var (
+		mu      sync.Mutex
+		created []*Journal
+		failed  []error
+	)
+
+	defer func() {
+		for _, j := range created {
+			if err := c.release(ctx, j); err != nil {
+				t.Errorf("cleanup: %s: %s", j.BrigadeID, err)
+			}
+
+			if err := c.journalDelete(ctx, j); err != nil {
+				t.Errorf("cleanup: %s: %s", j.BrigadeID, err)
+			}
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < stressBrigades; i++ {
+				id := uuid.New().String()
+				opts := &Opts{
+					ID:   id,
+					Name: stressNamespace + id,
+					Person: namesgenerator.Person{
+						Name: "Stress Test",
+						Desc: "allocation stress test",
+						URL:  "https://example.com",
+					},
+				}
+
+				j, err := c.journalBegin(ctx, OperationCreate, opts)
+				if err == nil {
+					err = c.allocate(ctx, j)
+				}
+
+				mu.Lock()
+
+				if err == nil {
+					created = append(created, j)
+				} else {
+					failed = append(failed, fmt.Errorf("%s: %w", id, err))
+
+					if j != nil {
+						if derr := c.journalDelete(ctx, j); derr != nil {
+							failed = append(failed, fmt.Errorf("%s: journal delete: %w", id, derr))
+						}
+					}
+				}
+
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for _, err := range failed {
+		t.Errorf("allocate: %s", err)
+	}
+
+	seen := make(map[string]string)
+
+	for _, j := range created {
+		b, err := c.fetchBrigade(ctx, j.BrigadeID)
+		if err != nil {
+			t.Fatalf("fetch: %s: %s", j.BrigadeID, err)
+		}
+
+		for _, key := range []string{
+			"ep:" + b.endpointIPv4.String(),
+			"cgnat:" + b.ipv4CGNAT.Masked().String(),
+			"ula:" + b.ipv6ULA.Masked().String(),
+			"kd:" + b.keydeskIPv6.String(),
+		} {
+			if other, ok := seen[key]; ok {
+				t.Errorf("duplicate %s: %s and %s", key, other, j.BrigadeID)
+			}
+
+			seen[key] = j.BrigadeID
+		}
+	}
+
+	// The whole table, not only our brigades.
+	for _, expr := range []string{"endpoint_ipv4", "network(ipv4_cgnat)", "network(ipv6_ula)", "keydesk_ipv6"} {
+		var dup netip.Prefix
+
+		err := db.QueryRow(ctx, fmt.Sprintf(
+			"SELECT %s::cidr FROM %s GROUP BY 1 HAVING count(*) > 1 LIMIT 1",
+			expr, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(),
+		)).Scan(&dup)
+		switch {
+		case err == nil:
+			t.Errorf("duplicate %s: %s", expr, dup)
+		case errors.Is(err, pgx.ErrNoRows):
+		default:
+			t.Errorf("duplicates query: %s: %s", expr, err)
+		}
+	}
+}
+
+// TestMakePlan - the plan picks up the allocation and leaves nothing behind.
+func TestMakePlan(t *testing.T) {
+	dbURL := os.Getenv("TEST_DB_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DB_URL is not set")
+	}
+
+	db, err := kdlib.CreateDBPool(dbURL)
+	if err != nil {
+		t.Fatalf("db pool: %s", err)
+	}
+
+	defer db.Close()
+
+	c := &Config{
+		DB:                  db,
+		BrigadesSchema:      defaultBrigadesSchema,
+		BrigadesStatsSchema: defaultBrigadesStatsSchema,
+		PairsSchema:         defaultPairsSchema,
+		LogTag:              t.Name(),
+	}
+
+	ctx := context.Background()
+
+	id := uuid.New().String()
+	opts := &Opts{
+		ID:   id,
+		Name: stressNamespace + id,
+		Person: namesgenerator.Person{
+			Name: "Plan Test",
+			Desc: "allocation plan test",
+			URL:  "https://example.com",
+		},
+	}
+
+	for _, name := range []string{PlacementMostFree, PlacementLeastActiveUsers, PlacementRoundRobin} {
+		c.Placement, err = NewPlacement(name, nil)
+		if err != nil {
+			t.Fatalf("placement: %s: %s", name, err)
+		}
+
+		p, err := MakePlan(ctx, c, opts)
+		if err != nil {
+			t.Fatalf("plan: %s: %s", name, err)
+		}
+
+		if p.Placement != name || p.PairID == "" || !p.KeydeskIPv6.IsValid() || !p.CGNATWindow.Contains(p.CGNAT.Addr()) {
+			t.Errorf("plan: %s: unexpected: %+v", name, p)
+		}
+
+		if _, err := c.fetchBrigade(ctx, id); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("plan: %s: brigade is stored: %v", name, err)
+		}
+	}
+}
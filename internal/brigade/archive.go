@@ -0,0 +1,216 @@
+package brigade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/wordsgens/namesgenerator"
+)
+
+const defaultArchiveLimit = 100
+
+const (
+	sqlArchiveBrigade = `
+INSERT INTO %s
+	(
+		brigade_id,
+		pair_id,
+		control_ip,
+		brigadier,
+		endpoint_ipv4,
+		domain_name,
+		dns_ipv4,
+		dns_ipv6,
+		keydesk_ipv6,
+		ipv4_cgnat,
+		ipv6_ula,
+		person,
+		stats,
+		deleted_at,
+		reason
+	)
+SELECT
+	m.brigade_id,
+	m.pair_id,
+	m.control_ip,
+	m.brigadier,
+	m.endpoint_ipv4,
+	m.domain_name,
+	m.dns_ipv4,
+	m.dns_ipv6,
+	m.keydesk_ipv6,
+	m.ipv4_cgnat,
+	m.ipv6_ula,
+	m.person,
+	(SELECT to_jsonb(s) FROM %s AS s WHERE s.brigade_id = m.brigade_id ORDER BY s.update_time DESC LIMIT 1),
+	COALESCE(d.deleted_at, now()),
+	$2
+FROM %s AS m
+	LEFT JOIN %s AS d ON d.brigade_id = m.brigade_id
+WHERE
+	m.brigade_id = $1
+`
+
+	sqlArchiveSearch = `
+SELECT
+	brigade_id,
+	pair_id,
+	control_ip,
+	brigadier,
+	endpoint_ipv4,
+	COALESCE(domain_name, ''),
+	keydesk_ipv6,
+	ipv4_cgnat,
+	ipv6_ula,
+	person,
+	COALESCE(stats, 'null'::jsonb),
+	deleted_at,
+	purged_at,
+	reason
+FROM %s
+WHERE
+	($1::uuid IS NULL OR brigade_id = $1)
+	AND ($2::text IS NULL OR brigadier = $2)
+	AND ($3::inet IS NULL OR endpoint_ipv4 = $3)
+	AND ($4::text IS NULL OR domain_name = $4)
+ORDER BY purged_at DESC
+LIMIT $5
+`
+)
+
+var ErrNotArchived = errors.New("brigade is not archived")
+
+// Archived - the purged brigade as it was at the deletion.
+type Archived struct {
+	BrigadeID    string                `json:"brigade_id"`
+	PairID       string                `json:"pair_id"`
+	ControlIP    netip.Addr            `json:"control_ip"`
+	Brigadier    string                `json:"brigadier"`
+	EndpointIPv4 netip.Addr            `json:"endpoint_ipv4"`
+	Domain       string                `json:"domain,omitempty"`
+	KeydeskIPv6  netip.Addr            `json:"keydesk_ipv6"`
+	IPv4CGNAT    netip.Prefix          `json:"ipv4_cgnat"`
+	IPv6ULA      netip.Prefix          `json:"ipv6_ula"`
+	Person       namesgenerator.Person `json:"person"`
+	Stats        json.RawMessage       `json:"stats"`
+	DeletedAt    time.Time             `json:"deleted_at"`
+	PurgedAt     time.Time             `json:"purged_at"`
+	Reason       string                `json:"reason,omitempty"`
+}
+
+// ArchiveQuery - the archive search conditions, the empty ones are ignored.
+type ArchiveQuery struct {
+	BrigadeID    string
+	Brigadier    string
+	EndpointIPv4 netip.Addr
+	Domain       string
+	Limit        int
+}
+
+func (c *Config) archiveTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "brigades_archive"}.Sanitize()
+}
+
+// archive - copies the brigade record and its last stats to the archive,
+// it's done in the transaction which removes the brigade.
+func (c *Config) archive(ctx context.Context, tx pgx.Tx, d *Deleted) error {
+	tag, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlArchiveBrigade,
+			c.archiveTable(),
+			pgx.Identifier{c.BrigadesStatsSchema, "brigades_stats"}.Sanitize(),
+			pgx.Identifier{c.BrigadesSchema, "meta_brigades"}.Sanitize(),
+			c.deletedTable(),
+		),
+		d.BrigadeID, d.Reason,
+	)
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrNotArchived, d.BrigadeID)
+	}
+
+	return nil
+}
+
+// SearchArchive - the archived brigades matching all the query conditions, the last purged first.
+func SearchArchive(ctx context.Context, c *Config, q ArchiveQuery) ([]*Archived, error) {
+	var (
+		id, brigadier, domain *string
+		endpoint              *netip.Addr
+	)
+
+	if q.BrigadeID != "" {
+		id = &q.BrigadeID
+	}
+
+	if q.Brigadier != "" {
+		brigadier = &q.Brigadier
+	}
+
+	if q.EndpointIPv4.IsValid() {
+		endpoint = &q.EndpointIPv4
+	}
+
+	if q.Domain != "" {
+		domain = &q.Domain
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultArchiveLimit
+	}
+
+	rows, err := c.DB.Query(ctx, fmt.Sprintf(sqlArchiveSearch, c.archiveTable()), id, brigadier, endpoint, domain, limit)
+	if err != nil {
+		return nil, fmt.Errorf("archive query: %w", err)
+	}
+
+	defer rows.Close()
+
+	var list []*Archived
+
+	for rows.Next() {
+		var (
+			a     Archived
+			pjson []byte
+		)
+
+		if err := rows.Scan(
+			&a.BrigadeID,
+			&a.PairID,
+			&a.ControlIP,
+			&a.Brigadier,
+			&a.EndpointIPv4,
+			&a.Domain,
+			&a.KeydeskIPv6,
+			&a.IPv4CGNAT,
+			&a.IPv6ULA,
+			&pjson,
+			&a.Stats,
+			&a.DeletedAt,
+			&a.PurgedAt,
+			&a.Reason,
+		); err != nil {
+			return nil, fmt.Errorf("archive row: %w", err)
+		}
+
+		if err := json.Unmarshal(pjson, &a.Person); err != nil {
+			return nil, fmt.Errorf("person: %w", err)
+		}
+
+		list = append(list, &a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("archive rows: %w", err)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,213 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+// BatchResult - the outcome of the brigade creation in the batch.
+type BatchResult struct {
+	ID     string
+	Result *Result
+	Err    error
+}
+
+// CreateBatch - creates many brigades with the single lists sync.
+// The brigades are allocated one by one, the delegation and keydesk address lists
+// are pushed once, then the nodes are provisioned in parallel, one goroutine per pair.
+// Every brigade has its own journal, a failed brigade is rolled back alone.
+// Already journaled or existing brigades go the usual Create way.
+// The batch may take longer than JournalStaleTime, so its journals are kept fresh
+// by the heartbeat, nobody takes them over while the batch is alive.
+func CreateBatch(ctx context.Context, c *Config, batch []*Opts) []BatchResult {
+	results := make([]BatchResult, len(batch))
+	journals := make(map[int]*Journal)
+
+	hb := c.journalHeartbeat(ctx)
+	defer hb.Stop()
+
+	for i, opts := range batch {
+		results[i].ID = opts.ID
+
+		j, err := c.batchBegin(ctx, opts)
+		switch {
+		case err != nil:
+			results[i].Err = err
+		case j == nil:
+			results[i].Result, results[i].Err = Create(ctx, c, opts)
+		default:
+			hb.Add(j)
+
+			if err := c.runSteps(brigadeContext(ctx, j.BrigadeID), j, []string{StepAllocate, StepSubdomain}); err != nil {
+				results[i].Err = err
+
+				continue
+			}
+
+			journals[i] = j
+		}
+	}
+
+	if len(journals) == 0 {
+		return results
+	}
+
+	// Sync the lists once for all the allocated brigades.
+
+	for i, j := range journals {
+		if err := c.journalStep(ctx, j, StepSync, JournalStateRunning); err != nil {
+			results[i].Err = err
+
+			delete(journals, i)
+		}
+	}
+
+	logging.FromContext(ctx).Info("sync lists", "brigades", len(journals))
+
+	if err := c.syncLists(ctx); err != nil {
+		c.abortBatch(ctx, journals, fmt.Errorf("%s: %w", StepSync, err), results)
+
+		return results
+	}
+
+	for i, j := range journals {
+		if err := c.journalStepDone(ctx, c.DB, j, StepSync); err != nil {
+			results[i].Err = c.abort(brigadeContext(ctx, j.BrigadeID), j, err)
+
+			delete(journals, i)
+		}
+	}
+
+	// Provision the nodes, the pairs are in parallel, the brigades of the pair are one by one.
+
+	pairs := make(map[string][]int)
+
+	for i, j := range journals {
+		b, err := c.fetchBrigade(ctx, j.BrigadeID)
+		if err != nil {
+			results[i].Err = c.abort(brigadeContext(ctx, j.BrigadeID), j, fmt.Errorf("fetch brigade: %w", err))
+
+			continue
+		}
+
+		pairs[b.controlIP.String()] = append(pairs[b.controlIP.String()], i)
+	}
+
+	wg := &sync.WaitGroup{}
+
+	for controlIP, idx := range pairs {
+		wg.Add(1)
+
+		go func(controlIP string, idx []int) {
+			defer wg.Done()
+
+			logging.FromContext(ctx).Info("provision", logging.KeyControlIP, controlIP, "brigades", len(idx))
+
+			for _, i := range idx {
+				j := journals[i]
+				ctx := brigadeContext(ctx, j.BrigadeID)
+
+				if err := c.runSteps(ctx, j, []string{StepNode, StepDelegation}); err != nil {
+					results[i].Err = err
+
+					continue
+				}
+
+				results[i].Result, results[i].Err = c.finish(ctx, j)
+			}
+		}(controlIP, idx)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// abortBatch - rolls the brigades back with the single lists resync at the end.
+// The journals are kept for the resume if the resync fails.
+func (c *Config) abortBatch(ctx context.Context, journals map[int]*Journal, cause error, results []BatchResult) {
+	undone := make(map[int]*Journal)
+
+	for i, j := range journals {
+		ctx := brigadeContext(ctx, j.BrigadeID)
+
+		if err := c.journalFail(ctx, j, cause); err != nil {
+			results[i].Err = errors.Join(cause, err)
+
+			continue
+		}
+
+		if err := c.compensate(ctx, j, false, StepSync); err != nil {
+			results[i].Err = c.rollbackIncomplete(ctx, j, cause, err)
+
+			continue
+		}
+
+		undone[i] = j
+	}
+
+	if len(undone) == 0 {
+		return
+	}
+
+	logging.FromContext(ctx).Info("rollback sync lists", "brigades", len(undone))
+
+	if err := c.syncLists(ctx); err != nil {
+		err = fmt.Errorf("undo %s: %w", StepSync, err)
+
+		for i, j := range undone {
+			results[i].Err = c.rollbackIncomplete(brigadeContext(ctx, j.BrigadeID), j, cause, err)
+		}
+
+		return
+	}
+
+	for i, j := range undone {
+		results[i].Err = cause
+
+		if j.Done(StepSync) {
+			if err := c.journalStepUndone(ctx, j, StepSync); err != nil {
+				results[i].Err = errors.Join(cause, err)
+
+				continue
+			}
+		}
+
+		if err := c.journalDelete(ctx, j); err != nil {
+			results[i].Err = errors.Join(cause, err)
+		}
+	}
+}
+
+// batchBegin - starts the journal of the new brigade,
+// returns nil journal if the brigade is already known.
+func (c *Config) batchBegin(ctx context.Context, opts *Opts) (*Journal, error) {
+	if _, err := FetchJournal(ctx, c, opts.ID); err == nil {
+		return nil, nil
+	} else if !errors.Is(err, ErrJournalNotFound) {
+		return nil, err
+	}
+
+	if _, err := c.fetchBrigade(ctx, opts.ID); err == nil {
+		return nil, nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	j, err := c.journalBegin(ctx, OperationCreate, opts)
+	if err != nil {
+		if errors.Is(err, ErrJournalExists) {
+			return nil, fmt.Errorf("%w: %s", ErrJournalBusy, opts.ID)
+		}
+
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+
+	return j, nil
+}
@@ -0,0 +1,182 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	sqlDelBrigade          = `DELETE FROM %s WHERE brigade_id=$1`
+	sqlResetBrigadeDomain  = `UPDATE %s SET domain_name=NULL WHERE brigade_id=$1 AND domain_name=$2`
+	sqlDelPairDomain       = `DELETE FROM %s WHERE domain_name=$1`
+	sqlCountDomainBrigades = `SELECT count(*) FROM %s WHERE domain_name=$1`
+)
+
+var ErrDomainInUse = errors.New("domain is in use")
+
+// undoOrder - the steps with the compensation in the order of undoing,
+// the lists are resynced at the end without the brigade.
+var undoOrder = []string{StepNode, StepSubdomain, StepAllocate, StepSync}
+
+// undoPlan - the touched steps to compensate in the order of undoing, except the skipped ones.
+func (j *Journal) undoPlan(skip ...string) []string {
+	var plan []string
+
+	for _, step := range undoOrder {
+		if j.Touched(step) && !slices.Contains(skip, step) {
+			plan = append(plan, step)
+		}
+	}
+
+	return plan
+}
+
+// compensate - undoes the touched steps in the reverse order.
+// A step which was started but not finished is undone on the best-effort basis,
+// a failure of a finished step compensation stops the rollback unless forced.
+// The lists are resynced even if the sync step wasn't finished,
+// unless the sync is skipped to be done once for many brigades.
+func (c *Config) compensate(ctx context.Context, j *Journal, force bool, skip ...string) error {
+	for _, step := range j.undoPlan(skip...) {
+		log := logging.FromContext(ctx).With(logging.KeyStep, step)
+
+		log.Info("rollback")
+
+		if err := c.undoStep(ctx, j, step); err != nil {
+			if (j.Done(step) || step == StepSync) && !force {
+				return fmt.Errorf("undo %s: %w", step, err)
+			}
+
+			log.Warn("can't undo", logging.KeyError, err)
+		}
+
+		if j.Done(step) {
+			if err := c.journalStepUndone(ctx, j, step); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) undoStep(ctx context.Context, j *Journal, step string) error {
+	switch step {
+	case StepNode:
+		return c.destroyOnNode(ctx, j)
+	case StepSubdomain:
+		return c.releaseSubdomain(ctx, j)
+	case StepAllocate:
+		return c.release(ctx, j)
+	case StepSync:
+		return c.syncLists(ctx)
+	}
+
+	return nil
+}
+
+// destroyOnNode - removes the brigade from the pair.
+func (c *Config) destroyOnNode(ctx context.Context, j *Journal) error {
+	b, err := c.fetchBrigade(ctx, j.BrigadeID)
+	if err != nil {
+		return fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeDestroyCmd, b.id32())); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// releaseSubdomain - detaches the picked subdomain and returns it to the subdomain API.
+func (c *Config) releaseSubdomain(ctx context.Context, j *Journal) error {
+	domain := j.payload.Domain
+	if domain == "" {
+		return nil
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlResetBrigadeDomain, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		j.BrigadeID, domain,
+	); err != nil {
+		return fmt.Errorf("brigade domain reset: %w", err)
+	}
+
+	var num int64
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlCountDomainBrigades, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		domain,
+	).Scan(&num); err != nil {
+		return fmt.Errorf("domain brigades query: %w", err)
+	}
+
+	if num > 0 {
+		return fmt.Errorf("%w: %s", ErrDomainInUse, domain)
+	}
+
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlDelPairDomain, pgx.Identifier{c.BrigadesSchema, "domains_endpoints_ipv4"}.Sanitize()),
+		domain,
+	); err != nil {
+		return fmt.Errorf("pair domain delete: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return c.deleteSubdomain(ctx, domain)
+}
+
+// deleteSubdomain - returns the subdomain to the subdomain API.
+func (c *Config) deleteSubdomain(ctx context.Context, domain string) error {
+	if c.SubdomainAPIToken == dcmgmtlib.NoUseSubdomainAPIToken {
+		return nil
+	}
+
+	for i := 0; i < subdomainAPIAttempts; i++ {
+		if err := kdlib.SubdomainDelete(c.SubdomainAPIHost, c.SubdomainAPIToken, domain); err != nil {
+			logging.FromContext(ctx).Warn("can't delete subdomain", "domain", domain, logging.KeyError, err)
+			if i == subdomainAPIAttempts-1 {
+				return fmt.Errorf("delete subdomain: %w", err)
+			}
+
+			time.Sleep(subdomainAPISleep)
+
+			continue
+		}
+
+		break
+	}
+
+	return nil
+}
+
+// release - removes the brigade record, stats are removed by cascade.
+func (c *Config) release(ctx context.Context, j *Journal) error {
+	if _, err := c.DB.Exec(ctx,
+		fmt.Sprintf(sqlDelBrigade, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		j.BrigadeID,
+	); err != nil {
+		return fmt.Errorf("brigade delete: %w", err)
+	}
+
+	return nil
+}
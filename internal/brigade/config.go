@@ -0,0 +1,112 @@
+package brigade
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vpngen/wordsgens/namesgenerator"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/kdname"
+)
+
+const (
+	BrigadeCgnatPrefix = 24
+	BrigadeUlaPrefix   = 64
+)
+
+const SSHKeyRemoteUsername = "_serega_"
+
+// Config - environment for the brigade operations.
+type Config struct {
+	DB *pgxpool.Pool
+
+	BrigadesSchema      string
+	BrigadesStatsSchema string
+	PairsSchema         string
+
+	// Ident - datacenter name, it's a part of the sync files names.
+	Ident string
+
+	SubdomainAPIHost  string
+	SubdomainAPIToken string
+
+	NodeSSHConfig *ssh.ClientConfig
+
+	KdAddrServer        string
+	KdAddrSyncSSHConfig *ssh.ClientConfig
+
+	DelegationServer        string
+	DelegationSyncSSHConfig *ssh.ClientConfig
+
+	KdDomain string
+	// KdNames - keydesk host names in the KdDomain.
+	KdNames  *kdname.Codec
+	KdNS     []string
+	DomainNS []string
+
+	VPNCfgs VPNConfigs
+
+	// RandomAllocation - pick up random free networks and addresses instead of the lowest ones.
+	RandomAllocation bool
+
+	// AsyncDelegation - don't wait for the delegation, CheckDelegations tracks it later.
+	AsyncDelegation bool
+
+	// Placement - pair placement policy, the most free pair by default.
+	Placement Placement
+
+	// ReplacePolicy - the configs refetch of the created brigade is a brigadier replacement.
+	ReplacePolicy kdlib.ReplacePolicy
+
+	// NodeExtensions - the node API extensions served by the nodes.
+	NodeExtensions NodeExtensions
+
+	// DeletionGrace - the deleted brigade is purged after this time, DefaultDeletionGrace if zero.
+	DeletionGrace time.Duration
+
+	LogTag string
+}
+
+// VPNConfigs - vpn configs types requested from the node.
+type VPNConfigs struct {
+	WG      string
+	OVC     string
+	IPSec   string
+	Outline string
+}
+
+// flags - node command flags for the requested configs.
+func (v VPNConfigs) flags() string {
+	var cmd string
+
+	if v.WG != "" {
+		cmd += fmt.Sprintf(" -wg %s", v.WG)
+	}
+
+	if v.OVC != "" {
+		cmd += fmt.Sprintf(" -ovc %s", v.OVC)
+	}
+
+	if v.IPSec != "" {
+		cmd += fmt.Sprintf(" -ipsec %s", v.IPSec)
+	}
+
+	if v.Outline != "" {
+		cmd += fmt.Sprintf(" -outline %s", v.Outline)
+	}
+
+	return cmd
+}
+
+// Opts - brigade creation options.
+type Opts struct {
+	// ID - uuid-style brigade ID.
+	ID      string
+	Name    string
+	ForceIP netip.Addr
+	Person  namesgenerator.Person
+}
@@ -0,0 +1,230 @@
+package brigade
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+// Delegation states.
+const (
+	DelegationPending = "pending"
+	DelegationDone    = "done"
+)
+
+const (
+	sqlDelegationPending = `
+INSERT INTO %s
+	(brigade_id, state)
+VALUES
+	($1, 'pending')
+ON CONFLICT (brigade_id) DO UPDATE SET
+	state='pending',
+	keydesk_ok=false,
+	domain_ok=false,
+	check_time=now()
+`
+
+	sqlDelegationState = `SELECT state FROM %s WHERE brigade_id=$1`
+
+	sqlDelegationList = `
+SELECT
+	d.brigade_id,
+	d.state,
+	d.keydesk_ok,
+	d.domain_ok,
+	d.attempts,
+	d.created_at,
+	d.check_time,
+	b.keydesk_ipv6,
+	COALESCE(b.domain_name, ''),
+	b.endpoint_ipv4
+FROM %s AS d
+	JOIN %s AS b ON b.brigade_id = d.brigade_id
+WHERE
+	($1::uuid IS NULL OR d.brigade_id = $1)
+	AND ($2 OR d.state = 'pending')
+ORDER BY d.created_at
+`
+
+	sqlDelegationCheck = `
+UPDATE %s SET
+	state=$2,
+	keydesk_ok=$3,
+	domain_ok=$4,
+	attempts=attempts+1,
+	check_time=now()
+WHERE
+	brigade_id=$1
+`
+)
+
+// Delegation - the delegation state of the brigade created without waiting.
+type Delegation struct {
+	BrigadeID    string     `json:"brigade_id"`
+	State        string     `json:"state"`
+	KeydeskFQDN  string     `json:"keydesk_fqdn"`
+	KeydeskIPv6  netip.Addr `json:"keydesk_ipv6"`
+	KeydeskOk    bool       `json:"keydesk_ok"`
+	Domain       string     `json:"domain,omitempty"`
+	EndpointIPv4 netip.Addr `json:"endpoint_ipv4"`
+	DomainOk     bool       `json:"domain_ok"`
+	Attempts     int        `json:"attempts"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CheckTime    time.Time  `json:"check_time"`
+}
+
+func (c *Config) delegationTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "brigades_delegation"}.Sanitize()
+}
+
+// delegationPending - the delegation will be checked later by CheckDelegations.
+func (c *Config) delegationPending(ctx context.Context, brigadeID string) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlDelegationPending, c.delegationTable()), brigadeID); err != nil {
+		return fmt.Errorf("delegation pending: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("delegation is pending")
+
+	return nil
+}
+
+// delegationState - pending or done, the brigade without the record is delegated synchronously.
+func (c *Config) delegationState(ctx context.Context, brigadeID string) (string, error) {
+	var state string
+
+	err := c.DB.QueryRow(ctx, fmt.Sprintf(sqlDelegationState, c.delegationTable()), brigadeID).Scan(&state)
+	switch err {
+	case nil:
+		return state, nil
+	case pgx.ErrNoRows:
+		return DelegationDone, nil
+	default:
+		return "", fmt.Errorf("delegation state: %w", err)
+	}
+}
+
+// ListDelegations - delegations of the brigade or all of them, the done ones are included if all is set.
+func ListDelegations(ctx context.Context, c *Config, brigadeID string, all bool) ([]*Delegation, error) {
+	var id *string
+	if brigadeID != "" {
+		id = &brigadeID
+	}
+
+	rows, err := c.DB.Query(ctx,
+		fmt.Sprintf(sqlDelegationList, c.delegationTable(), pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		id, all || brigadeID != "",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("delegation query: %w", err)
+	}
+
+	var list []*Delegation
+
+	for rows.Next() {
+		d := &Delegation{}
+
+		if err := rows.Scan(
+			&d.BrigadeID,
+			&d.State,
+			&d.KeydeskOk,
+			&d.DomainOk,
+			&d.Attempts,
+			&d.CreatedAt,
+			&d.CheckTime,
+			&d.KeydeskIPv6,
+			&d.Domain,
+			&d.EndpointIPv4,
+		); err != nil {
+			rows.Close()
+
+			return nil, fmt.Errorf("delegation row: %w", err)
+		}
+
+		d.KeydeskFQDN, err = c.KdNames.Encode(d.KeydeskIPv6)
+		if err != nil {
+			rows.Close()
+
+			return nil, fmt.Errorf("keydesk name: %w", err)
+		}
+
+		list = append(list, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("delegation rows: %w", err)
+	}
+
+	return list, nil
+}
+
+// CheckDelegations - checks the pending delegations once, no waiting.
+// The resolved ones are marked as done, the old copies of the moved brigades
+// with the done delegation are destroyed.
+func CheckDelegations(ctx context.Context, c *Config, brigadeID string) ([]*Delegation, error) {
+	list, err := ListDelegations(ctx, c, brigadeID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range list {
+		if d.State == DelegationDone {
+			continue
+		}
+
+		log := logging.FromContext(ctx).With(logging.KeyBrigade, d.BrigadeID)
+
+		if !d.KeydeskOk {
+			ok, err := dcmgmtlib.CheckForPresence(d.KeydeskFQDN, d.KeydeskIPv6, c.KdNS...)
+			if err != nil {
+				log.Warn("keydesk delegation", "fqdn", d.KeydeskFQDN, logging.KeyError, err)
+			}
+
+			d.KeydeskOk = ok && err == nil
+		}
+
+		if !d.DomainOk {
+			switch d.Domain {
+			case "":
+				d.DomainOk = true
+			default:
+				ok, err := dcmgmtlib.CheckForPresence(d.Domain, d.EndpointIPv4, c.DomainNS...)
+				if err != nil {
+					log.Warn("domain delegation", "domain", d.Domain, logging.KeyError, err)
+				}
+
+				d.DomainOk = ok && err == nil
+			}
+		}
+
+		if d.KeydeskOk && d.DomainOk {
+			d.State = DelegationDone
+		}
+
+		d.Attempts++
+
+		if _, err := c.DB.Exec(ctx,
+			fmt.Sprintf(sqlDelegationCheck, c.delegationTable()),
+			d.BrigadeID, d.State, d.KeydeskOk, d.DomainOk,
+		); err != nil {
+			return nil, fmt.Errorf("delegation update: %s: %w", d.BrigadeID, err)
+		}
+
+		d.CheckTime = time.Now()
+
+		log.Info("delegation", "state", d.State, "keydesk_fqdn", d.KeydeskFQDN, "keydesk_ok", d.KeydeskOk, "domain", d.Domain, "domain_ok", d.DomainOk)
+	}
+
+	// The failed ones are retried by the next check.
+	if _, err := DestroyLeftovers(ctx, c, netip.Addr{}); err != nil {
+		logging.FromContext(ctx).Warn("can't destroy the old copies", logging.KeyError, err)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,469 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+// DefaultDeletionGrace - the deleted brigade is kept suspended for this time before the purge.
+const DefaultDeletionGrace = 7 * 24 * time.Hour
+
+// Node commands of the deletion.
+const (
+	nodeSuspendCmd   = "suspend -id %s -ch"
+	nodeUnsuspendCmd = "unsuspend -id %s -ch"
+	nodeDestroyCmd   = "destroy -id %s -ch"
+)
+
+const (
+	sqlDeletedColumns = `deleted_at, purge_after, reason, suspended, purge_started_at`
+
+	sqlDeletedMark = `
+INSERT INTO %s
+	(brigade_id, purge_after, reason, suspended)
+VALUES
+	($1, now() + make_interval(secs => $2), $3, $4)
+ON CONFLICT (brigade_id) DO NOTHING
+RETURNING
+	` + sqlDeletedColumns
+
+	sqlDeletedFetch = `SELECT ` + sqlDeletedColumns + ` FROM %s WHERE brigade_id=$1`
+
+	sqlDeletedLock = `SELECT ` + sqlDeletedColumns + ` FROM %s WHERE brigade_id=$1 FOR UPDATE`
+
+	sqlDeletedList = `
+SELECT
+	brigade_id,
+	` + sqlDeletedColumns + `
+FROM %s
+WHERE
+	$1 OR purge_after <= now()
+ORDER BY purge_after
+`
+
+	// sqlDeletedStartPurge - the brigade is still deleted and expired unless forced.
+	sqlDeletedStartPurge = `
+UPDATE %s SET purge_started_at=now()
+WHERE
+	brigade_id=$1
+	AND ($2 OR purge_after <= now())
+RETURNING
+	` + sqlDeletedColumns
+
+	// sqlDeletedStartForcedPurge - the brigade isn't marked as deleted.
+	sqlDeletedStartForcedPurge = `
+INSERT INTO %s
+	(brigade_id, purge_after, reason, purge_started_at)
+VALUES
+	($1, now(), $2, now())
+ON CONFLICT (brigade_id) DO UPDATE SET purge_started_at=now()
+RETURNING
+	` + sqlDeletedColumns
+
+	sqlDeletedStopPurge = `UPDATE %s SET purge_started_at=NULL WHERE brigade_id=$1`
+
+	sqlDeletedUnmark = `DELETE FROM %s WHERE brigade_id=$1`
+
+	sqlPurgeBrigade = `DELETE FROM %s WHERE brigade_id=$1 RETURNING domain_name`
+)
+
+var (
+	ErrBrigadeDeleted    = errors.New("brigade is deleted")
+	ErrBrigadeNotDeleted = errors.New("brigade is not deleted")
+	ErrGraceExpired      = errors.New("grace period is expired")
+	ErrGraceNotExpired   = errors.New("grace period is not expired")
+	ErrBrigadePurging    = errors.New("brigade is being purged")
+)
+
+// Deleted - the brigade marked as deleted, it's purged after the grace period.
+type Deleted struct {
+	BrigadeID  string    `json:"brigade_id"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	PurgeAfter time.Time `json:"purge_after"`
+	Reason     string    `json:"reason,omitempty"`
+	// Suspended - the brigade is suspended on the node, the node may not support it.
+	Suspended bool `json:"suspended"`
+	// PurgeStarted - the purge is started and isn't finished, the brigade may be destroyed on the node.
+	PurgeStarted *time.Time `json:"purge_started_at,omitempty"`
+}
+
+// Expired - the grace period is over, the brigade can be purged.
+func (d *Deleted) Expired() bool {
+	return !time.Now().Before(d.PurgeAfter)
+}
+
+func (c *Config) deletedTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "brigades_deleted"}.Sanitize()
+}
+
+func scanDeleted(brigadeID string, row pgx.Row) (*Deleted, error) {
+	d := &Deleted{BrigadeID: brigadeID}
+
+	if err := row.Scan(&d.DeletedAt, &d.PurgeAfter, &d.Reason, &d.Suspended, &d.PurgeStarted); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// checkNotDeleted - the operations on the deleted brigade are refused.
+func (c *Config) checkNotDeleted(ctx context.Context, brigadeID string) error {
+	_, err := scanDeleted(brigadeID, c.DB.QueryRow(ctx, fmt.Sprintf(sqlDeletedFetch, c.deletedTable()), brigadeID))
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: %s", ErrBrigadeDeleted, brigadeID)
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil
+	default:
+		return fmt.Errorf("deleted query: %w", err)
+	}
+}
+
+// Delete - marks the brigade as deleted and suspends it on the node if the node can.
+// The slot and the domain are held until the brigade is purged,
+// the repeated deletion returns the existing mark.
+// The mark is written first, it's removed if the suspend fails.
+func Delete(ctx context.Context, c *Config, brigadeID, reason string) (*Deleted, error) {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	b, err := c.fetchBrigade(ctx, brigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	suspend := c.NodeExtensions.require(NodeExtSuspend)
+
+	d, err := scanDeleted(brigadeID, c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlDeletedMark, c.deletedTable()),
+		brigadeID, c.deletionGrace().Seconds(), reason, suspend == nil,
+	))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		d, err = scanDeleted(brigadeID, c.DB.QueryRow(ctx, fmt.Sprintf(sqlDeletedFetch, c.deletedTable()), brigadeID))
+		if err != nil {
+			return nil, fmt.Errorf("deleted query: %w", err)
+		}
+
+		logging.FromContext(ctx).Info("brigade is already deleted", "purge_after", d.PurgeAfter)
+
+		return d, nil
+	case err != nil:
+		return nil, fmt.Errorf("deleted mark: %w", err)
+	}
+
+	if suspend != nil {
+		logging.FromContext(ctx).Warn("brigade is deleted, it works on the node until purged",
+			"purge_after", d.PurgeAfter, logging.KeyError, suspend)
+
+		return d, nil
+	}
+
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeSuspendCmd, b.id32())); err != nil {
+		if _, uerr := c.DB.Exec(ctx, fmt.Sprintf(sqlDeletedUnmark, c.deletedTable()), brigadeID); uerr != nil {
+			logging.FromContext(ctx).Error("can't unmark deleted brigade", logging.KeyError, uerr)
+		}
+
+		return nil, fmt.Errorf("suspend: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("brigade is deleted", "purge_after", d.PurgeAfter)
+
+	return d, nil
+}
+
+// Undelete - resumes the suspended brigade on the node and removes the mark.
+// The brigade is restored within the grace period only unless forced,
+// the started purge is never undone.
+func Undelete(ctx context.Context, c *Config, brigadeID string, force bool) error {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	// The row lock keeps the purge away while the node is resumed.
+	d, err := scanDeleted(brigadeID, tx.QueryRow(ctx, fmt.Sprintf(sqlDeletedLock, c.deletedTable()), brigadeID))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return fmt.Errorf("%w: %s", ErrBrigadeNotDeleted, brigadeID)
+	case err != nil:
+		return fmt.Errorf("deleted query: %w", err)
+	}
+
+	if d.Expired() && !force {
+		return fmt.Errorf("%w: %s: %s", ErrGraceExpired, brigadeID, d.PurgeAfter.Format(time.RFC3339))
+	}
+
+	if d.PurgeStarted != nil {
+		return fmt.Errorf("%w: %s: %s", ErrBrigadePurging, brigadeID, d.PurgeStarted.Format(time.RFC3339))
+	}
+
+	if d.Suspended {
+		if err := c.NodeExtensions.require(NodeExtSuspend); err != nil {
+			return fmt.Errorf("unsuspend: %w", err)
+		}
+
+		b, err := c.fetchBrigade(ctx, brigadeID)
+		if err != nil {
+			return fmt.Errorf("fetch brigade: %w", err)
+		}
+
+		if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeUnsuspendCmd, b.id32())); err != nil {
+			return fmt.Errorf("unsuspend: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(sqlDeletedUnmark, c.deletedTable()), brigadeID); err != nil {
+		return fmt.Errorf("deleted unmark: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("brigade is restored")
+
+	return nil
+}
+
+// ListDeleted - the deleted brigades, only the expired ones unless all is set.
+func ListDeleted(ctx context.Context, c *Config, all bool) ([]*Deleted, error) {
+	rows, err := c.DB.Query(ctx, fmt.Sprintf(sqlDeletedList, c.deletedTable()), all)
+	if err != nil {
+		return nil, fmt.Errorf("deleted query: %w", err)
+	}
+
+	defer rows.Close()
+
+	var list []*Deleted
+
+	for rows.Next() {
+		d := &Deleted{}
+
+		if err := rows.Scan(&d.BrigadeID, &d.DeletedAt, &d.PurgeAfter, &d.Reason, &d.Suspended, &d.PurgeStarted); err != nil {
+			return nil, fmt.Errorf("deleted row: %w", err)
+		}
+
+		list = append(list, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("deleted rows: %w", err)
+	}
+
+	return list, nil
+}
+
+// Purge - removes the deleted brigades for real: destroys them on the nodes,
+// frees the slots and the domains, the lists are synced once at the end.
+// Without the brigade ID all the expired brigades are purged.
+// The forced purge ignores the grace period, the brigade may be not marked as deleted,
+// the reason is archived for such a brigade.
+func Purge(ctx context.Context, c *Config, brigadeID, reason string, force bool) ([]*Deleted, error) {
+	var list []*Deleted
+
+	switch brigadeID {
+	case "":
+		var err error
+
+		list, err = ListDeleted(ctx, c, force)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		d, err := scanDeleted(brigadeID, c.DB.QueryRow(ctx, fmt.Sprintf(sqlDeletedFetch, c.deletedTable()), brigadeID))
+		switch {
+		case errors.Is(err, pgx.ErrNoRows) && force:
+			d = &Deleted{BrigadeID: brigadeID, Reason: reason}
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, fmt.Errorf("%w: %s", ErrBrigadeNotDeleted, brigadeID)
+		case err != nil:
+			return nil, fmt.Errorf("deleted query: %w", err)
+		case !d.Expired() && !force:
+			return nil, fmt.Errorf("%w: %s: %s", ErrGraceNotExpired, brigadeID, d.PurgeAfter.Format(time.RFC3339))
+		}
+
+		list = []*Deleted{d}
+	}
+
+	var (
+		purged []*Deleted
+		errs   []error
+	)
+
+	for _, d := range list {
+		if err := c.purge(brigadeContext(ctx, d.BrigadeID), d, force); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.BrigadeID, err))
+
+			continue
+		}
+
+		purged = append(purged, d)
+	}
+
+	if len(purged) > 0 {
+		if err := c.syncLists(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("sync: %w", err))
+		}
+	}
+
+	return purged, errors.Join(errs...)
+}
+
+// purge - destroys the brigade on the node, archives and removes the record,
+// the domain is returned if no other brigade uses it.
+// The purge is marked as started before the node is cleaned, the undelete is refused
+// from then on, so the destroy runs out of the transaction.
+func (c *Config) purge(ctx context.Context, d *Deleted, force bool) error {
+	brigadeID := d.BrigadeID
+
+	b, err := c.fetchBrigade(ctx, brigadeID)
+	if err != nil {
+		return fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	d, err = c.startPurge(ctx, d, force)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeDestroyCmd, b.id32())); err != nil {
+		if _, serr := c.DB.Exec(ctx, fmt.Sprintf(sqlDeletedStopPurge, c.deletedTable()), brigadeID); serr != nil {
+			logging.FromContext(ctx).Error("can't stop purge", logging.KeyError, serr)
+		}
+
+		return fmt.Errorf("destroy: %w", err)
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(sqlDeletedLock, c.deletedTable()), brigadeID); err != nil {
+		return fmt.Errorf("deleted lock: %w", err)
+	}
+
+	if err := c.archive(ctx, tx, d); err != nil {
+		return err
+	}
+
+	// The retiring domains of the not finished rotations go with the brigade,
+	// they refer to it.
+	rows, err := tx.Query(ctx, fmt.Sprintf(sqlPurgeRetiring, c.retiringTable()), brigadeID)
+	if err != nil {
+		return fmt.Errorf("retiring domains delete: %w", err)
+	}
+
+	retiring, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("retiring domains rows: %w", err)
+	}
+
+	var domain pgtype.Text
+
+	// The stats and the deletion mark are removed by cascade.
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlPurgeBrigade, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		brigadeID,
+	).Scan(&domain); err != nil {
+		return fmt.Errorf("brigade delete: %w", err)
+	}
+
+	// The creation journal keeps the answer for the repeated requests, it's obsolete now.
+	if _, err := tx.Exec(ctx, fmt.Sprintf(sqlJournalDelete, c.journalTable()), brigadeID); err != nil {
+		return fmt.Errorf("journal delete: %w", err)
+	}
+
+	freeDomain := false
+
+	if domain.Valid {
+		var num int64
+		if err := tx.QueryRow(ctx,
+			fmt.Sprintf(sqlCountDomainBrigades, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+			domain.String,
+		).Scan(&num); err != nil {
+			return fmt.Errorf("domain brigades query: %w", err)
+		}
+
+		if num == 0 {
+			if _, err := tx.Exec(ctx,
+				fmt.Sprintf(sqlDelPairDomain, pgx.Identifier{c.BrigadesSchema, "domains_endpoints_ipv4"}.Sanitize()),
+				domain.String,
+			); err != nil {
+				return fmt.Errorf("pair domain delete: %w", err)
+			}
+
+			freeDomain = true
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("brigade is purged", "domain", domain.String)
+
+	if freeDomain {
+		retiring = append(retiring, domain.String)
+	}
+
+	// The brigade is purged anyway, the subdomain is left for the operator.
+	for _, name := range retiring {
+		if err := c.deleteSubdomain(ctx, name); err != nil {
+			logging.FromContext(ctx).Error("can't revoke subdomain", "domain", name, logging.KeyError, err)
+		}
+	}
+
+	return nil
+}
+
+// startPurge - marks the purge as started, the brigade is marked as deleted
+// by the forced purge if it isn't.
+func (c *Config) startPurge(ctx context.Context, d *Deleted, force bool) (*Deleted, error) {
+	if d.DeletedAt.IsZero() {
+		d, err := scanDeleted(d.BrigadeID, c.DB.QueryRow(ctx,
+			fmt.Sprintf(sqlDeletedStartForcedPurge, c.deletedTable()),
+			d.BrigadeID, d.Reason,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("deleted purge: %w", err)
+		}
+
+		return d, nil
+	}
+
+	started, err := scanDeleted(d.BrigadeID, c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlDeletedStartPurge, c.deletedTable()),
+		d.BrigadeID, force,
+	))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		// Restored or deleted again meanwhile.
+		return nil, fmt.Errorf("%w: %s", ErrBrigadeNotDeleted, d.BrigadeID)
+	case err != nil:
+		return nil, fmt.Errorf("deleted purge: %w", err)
+	}
+
+	return started, nil
+}
+
+func (c *Config) deletionGrace() time.Duration {
+	if c.DeletionGrace <= 0 {
+		return DefaultDeletionGrace
+	}
+
+	return c.DeletionGrace
+}
@@ -0,0 +1,416 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const defaultDomainParallel = 8
+
+// The brigade domain is a part of the users configs on the node.
+const nodeSetDomainCmd = "setdomain -id %s -dn %s -ch"
+
+const (
+	// The deleted brigades keep their domains until purged.
+	sqlDomainBrigades = `
+SELECT
+	brigades.brigade_id
+FROM %s AS brigades
+WHERE
+	brigades.domain_name IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM %s AS d WHERE d.brigade_id = brigades.brigade_id)
+ORDER BY brigades.brigade_id
+`
+
+	sqlDomainRename = `UPDATE %s SET domain_name=$2 WHERE domain_name=$1`
+
+	sqlDomainRetire = `INSERT INTO %s (domain_name, endpoint_ipv4, brigade_id) VALUES ($1, $2, $3)`
+
+	sqlDomainRetired = `DELETE FROM %s WHERE domain_name=$1`
+
+	sqlMoveRetiring = `UPDATE %s SET endpoint_ipv4=$2 WHERE brigade_id=$1`
+
+	sqlPurgeRetiring = `DELETE FROM %s WHERE brigade_id=$1 RETURNING domain_name`
+
+	sqlRetiringDomains = `
+SELECT
+	brigade_id,
+	domain_name
+FROM %s
+WHERE
+	$1::uuid IS NULL OR brigade_id = $1
+ORDER BY created_at
+`
+)
+
+var (
+	ErrNoDomain        = errors.New("brigade has no domain")
+	ErrNoSubdomainAPI  = errors.New("subdomain api is disabled")
+	ErrDomainNotSynced = errors.New("domain is not synced")
+	ErrDomainChanged   = errors.New("brigade domain is changed during the rotation")
+)
+
+// DomainRotation - the brigade with the new domain. The old domain is released
+// only after the new one is resolved and the node is switched to it.
+type DomainRotation struct {
+	BrigadeID    string     `json:"brigade_id"`
+	EndpointIPv4 netip.Addr `json:"endpoint_ipv4"`
+	OldDomain    string     `json:"old_domain,omitempty"`
+	NewDomain    string     `json:"new_domain,omitempty"`
+	Released     bool       `json:"old_released"`
+	Error        string     `json:"error,omitempty"`
+	Warning      string     `json:"warning,omitempty"`
+
+	b   *brigadeRecord
+	err error
+}
+
+func (r *DomainRotation) fail(err error) {
+	r.err, r.Error = err, err.Error()
+}
+
+// RotateDomain - gives the brigade the new subdomain on the same endpoint.
+func RotateDomain(ctx context.Context, c *Config, brigadeID string) (*DomainRotation, error) {
+	list, err := c.rotateDomains(ctx, []string{brigadeID}, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if list[0].err != nil {
+		return nil, list[0].err
+	}
+
+	return list[0], nil
+}
+
+// RotateAllDomains - gives every brigade with the domain the new one,
+// the lists are synced once, the rest is done by Parallel brigades at once.
+func RotateAllDomains(ctx context.Context, c *Config, parallel int) ([]*DomainRotation, error) {
+	rows, err := c.DB.Query(ctx,
+		fmt.Sprintf(sqlDomainBrigades,
+			pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(),
+			c.deletedTable(),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("brigades query: %w", err)
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("brigades rows: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("rotate all domains", "brigades", len(ids))
+
+	return c.rotateDomains(ctx, ids, parallel)
+}
+
+// ReleaseDomains - resumes the unfinished rotations of the brigade,
+// or of all the brigades if the ID is not set: the lists are synced,
+// the node is switched to the current domain and the retiring one is released.
+func ReleaseDomains(ctx context.Context, c *Config, brigadeID string, parallel int) ([]*DomainRotation, error) {
+	if c.SubdomainAPIToken == dcmgmtlib.NoUseSubdomainAPIToken {
+		return nil, ErrNoSubdomainAPI
+	}
+
+	if err := c.NodeExtensions.require(NodeExtSetDomain); err != nil {
+		return nil, err
+	}
+
+	if parallel < 1 {
+		parallel = defaultDomainParallel
+	}
+
+	rows, err := c.DB.Query(ctx, fmt.Sprintf(sqlRetiringDomains, c.retiringTable()), optional(brigadeID))
+	if err != nil {
+		return nil, fmt.Errorf("retiring domains query: %w", err)
+	}
+
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*DomainRotation, error) {
+		r := &DomainRotation{}
+
+		err := row.Scan(&r.BrigadeID, &r.OldDomain)
+
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("retiring domains rows: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("release domains", "domains", len(list))
+
+	resumed := 0
+
+	for _, r := range list {
+		if err := c.resumeRotation(brigadeContext(ctx, r.BrigadeID), r); err != nil {
+			r.fail(err)
+
+			continue
+		}
+
+		resumed++
+	}
+
+	if resumed > 0 {
+		c.switchDomains(ctx, list, resumed, parallel)
+	}
+
+	return list, nil
+}
+
+// resumeRotation - the current domain of the brigade is the new one.
+func (c *Config) resumeRotation(ctx context.Context, r *DomainRotation) error {
+	if err := c.checkNotDeleted(ctx, r.BrigadeID); err != nil {
+		return err
+	}
+
+	b, err := c.fetchBrigade(ctx, r.BrigadeID)
+	if err != nil {
+		return fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	if !b.domainName.Valid {
+		return fmt.Errorf("%w: %s", ErrNoDomain, r.BrigadeID)
+	}
+
+	r.b, r.EndpointIPv4, r.NewDomain = b, b.endpointIPv4, b.domainName.String
+
+	return nil
+}
+
+// rotateDomains - the new subdomains are picked up and renamed in the database one by one,
+// then the lists are synced, then every brigade waits for its new domain
+// to be resolved, the node is switched and the old domain is released.
+func (c *Config) rotateDomains(ctx context.Context, ids []string, parallel int) ([]*DomainRotation, error) {
+	if c.SubdomainAPIToken == dcmgmtlib.NoUseSubdomainAPIToken {
+		return nil, ErrNoSubdomainAPI
+	}
+
+	if err := c.NodeExtensions.require(NodeExtSetDomain); err != nil {
+		return nil, err
+	}
+
+	if parallel < 1 {
+		parallel = defaultDomainParallel
+	}
+
+	list := make([]*DomainRotation, 0, len(ids))
+	renamed := 0
+
+	for _, id := range ids {
+		r := &DomainRotation{BrigadeID: id}
+		list = append(list, r)
+
+		if err := c.renameDomain(brigadeContext(ctx, id), r); err != nil {
+			r.fail(err)
+
+			continue
+		}
+
+		renamed++
+	}
+
+	if renamed == 0 {
+		return list, nil
+	}
+
+	c.switchDomains(ctx, list, renamed, parallel)
+
+	return list, nil
+}
+
+// switchDomains - syncs the lists once, then switches the brigades by Parallel at once.
+func (c *Config) switchDomains(ctx context.Context, list []*DomainRotation, num, parallel int) {
+	logging.FromContext(ctx).Info("sync lists", "brigades", num)
+
+	if err := c.syncLists(ctx); err != nil {
+		for _, r := range list {
+			if r.err == nil {
+				r.Warning = fmt.Sprintf("sync lists: %s, the old domain is kept", err)
+			}
+		}
+
+		return
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallel)
+	)
+
+	for _, r := range list {
+		if r.err != nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}: // Acquire the semaphore
+		}
+
+		if ctx.Err() != nil {
+			r.Warning = fmt.Sprintf("%s, the old domain is kept", ctx.Err())
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(r *DomainRotation) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release the semaphore
+
+			c.switchDomain(brigadeContext(ctx, r.BrigadeID), r)
+		}(r)
+	}
+
+	wg.Wait()
+}
+
+// renameDomain - picks up the new subdomain and renames the endpoint domain,
+// the new subdomain is returned to the subdomain API on failure.
+func (c *Config) renameDomain(ctx context.Context, r *DomainRotation) error {
+	if err := c.checkNotDeleted(ctx, r.BrigadeID); err != nil {
+		return err
+	}
+
+	b, err := c.fetchBrigade(ctx, r.BrigadeID)
+	if err != nil {
+		return fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	if !b.domainName.Valid {
+		return fmt.Errorf("%w: %s", ErrNoDomain, r.BrigadeID)
+	}
+
+	r.b, r.EndpointIPv4, r.OldDomain = b, b.endpointIPv4, b.domainName.String
+
+	r.NewDomain, err = c.pickSubdomain(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.renameDomainRecord(ctx, r); err != nil {
+		if derr := c.deleteSubdomain(ctx, r.NewDomain); derr != nil {
+			err = errors.Join(err, derr)
+		}
+
+		r.NewDomain = ""
+
+		return err
+	}
+
+	logging.FromContext(ctx).Info("domain is renamed", "old", r.OldDomain, "new", r.NewDomain)
+
+	return nil
+}
+
+// renameDomainRecord - the brigade is detached from the domain while it's renamed,
+// the domain is bound to the endpoint. The old name is retiring, it's still delegated
+// to the endpoint until released.
+func (c *Config) renameDomainRecord(ctx context.Context, r *DomainRotation) error {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlResetBrigadeDomain, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		r.BrigadeID, r.OldDomain,
+	)
+	if err != nil {
+		return fmt.Errorf("brigade domain reset: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrDomainChanged, r.BrigadeID)
+	}
+
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlDomainRename, pgx.Identifier{c.BrigadesSchema, "domains_endpoints_ipv4"}.Sanitize()),
+		r.OldDomain, r.NewDomain,
+	); err != nil {
+		return fmt.Errorf("pair domain update: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlDomainRetire, c.retiringTable()),
+		r.OldDomain, r.EndpointIPv4, r.BrigadeID,
+	); err != nil {
+		return fmt.Errorf("retiring domain insert: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlUpdateBrigadeDomain, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		r.NewDomain, r.BrigadeID,
+	); err != nil {
+		return fmt.Errorf("brigade domain update: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+// switchDomain - waits for the new domain, switches the node to it and releases the old one.
+// The old domain is kept on any failure, the users configs may still use it.
+func (c *Config) switchDomain(ctx context.Context, r *DomainRotation) {
+	log := logging.FromContext(ctx)
+
+	if ok, err := c.waitForDelegation(ctx, r.NewDomain, r.EndpointIPv4, c.DomainNS...); !ok {
+		r.Warning = fmt.Sprintf("%s: %v, the old domain is kept", ErrDomainNotSynced, err)
+
+		log.Warn("domain is not resolved, the old domain is kept", "domain", r.NewDomain, logging.KeyError, err)
+
+		return
+	}
+
+	if _, err := c.runOnNode(ctx, r.b.controlIP, fmt.Sprintf(nodeSetDomainCmd, r.b.id32(), r.NewDomain)); err != nil {
+		r.Warning = fmt.Sprintf("node: %s, the old domain is kept", err)
+
+		log.Warn("can't set domain on the node, the old domain is kept", logging.KeyControlIP, r.b.controlIP, logging.KeyError, err)
+
+		return
+	}
+
+	if err := c.releaseRetiring(ctx, r.OldDomain); err != nil {
+		r.Warning = err.Error()
+
+		return
+	}
+
+	r.Released = true
+
+	log.Info("domain is rotated", "old", r.OldDomain, "new", r.NewDomain)
+}
+
+func (c *Config) retiringTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "domains_retiring"}.Sanitize()
+}
+
+// releaseRetiring - the retiring domain leaves the delegation list by the next sync
+// and is returned to the subdomain API.
+func (c *Config) releaseRetiring(ctx context.Context, domain string) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlDomainRetired, c.retiringTable()), domain); err != nil {
+		return fmt.Errorf("retiring domain delete: %w", err)
+	}
+
+	if err := c.deleteSubdomain(ctx, domain); err != nil {
+		return fmt.Errorf("release subdomain: %w", err)
+	}
+
+	return nil
+}
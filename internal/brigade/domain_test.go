@@ -0,0 +1,24 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRotateDomainsRequiresSetDomain(t *testing.T) {
+	// No database: the rotation must fail before any change.
+	c := &Config{SubdomainAPIToken: "token", NodeExtensions: NodeExtensions{NodeExtSuspend: true}}
+
+	if _, err := c.rotateDomains(context.Background(), []string{"id"}, 1); !errors.Is(err, ErrNodeUnsupported) {
+		t.Errorf("rotate: %v, want %v", err, ErrNodeUnsupported)
+	}
+}
+
+func TestReleaseDomainsRequiresSetDomain(t *testing.T) {
+	c := &Config{SubdomainAPIToken: "token"}
+
+	if _, err := ReleaseDomains(context.Background(), c, "", 1); !errors.Is(err, ErrNodeUnsupported) {
+		t.Errorf("release: %v, want %v", err, ErrNodeUnsupported)
+	}
+}
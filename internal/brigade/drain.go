@@ -0,0 +1,252 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/vpngine/naclkey"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const defaultDrainParallel = 2
+
+const (
+	sqlDrainStatus = `
+SELECT
+	pairs.pair_id,
+	pairs.control_ip,
+	pairs.is_active,
+	pairs.is_draining,
+	COUNT(brigades.brigade_id) FILTER (WHERE brigades_deleted.brigade_id IS NULL),
+	COUNT(brigades_deleted.brigade_id),
+	(SELECT COUNT(*) FROM %s AS l WHERE l.control_ip = pairs.control_ip)
+FROM %s AS pairs
+	LEFT JOIN %s AS brigades ON brigades.pair_id = pairs.pair_id
+	LEFT JOIN %s AS brigades_deleted ON brigades_deleted.brigade_id = brigades.brigade_id
+WHERE
+	($1::uuid IS NOT NULL AND pairs.pair_id = $1)
+	OR ($2::inet IS NOT NULL AND pairs.control_ip = $2)
+GROUP BY pairs.pair_id
+`
+
+	sqlDrainSet = `UPDATE %s SET is_draining=$2 WHERE pair_id=$1`
+
+	// The deleted brigades are left for the purge.
+	sqlDrainBrigades = `
+SELECT
+	brigades.brigade_id
+FROM %s AS brigades
+WHERE
+	brigades.pair_id = $1
+	AND NOT EXISTS (SELECT 1 FROM %s AS d WHERE d.brigade_id = brigades.brigade_id)
+ORDER BY brigades.brigade_id
+`
+)
+
+// DrainStatus - the pair and its brigades left.
+type DrainStatus struct {
+	PairID    string     `json:"pair_id"`
+	ControlIP netip.Addr `json:"control_ip"`
+	Active    bool       `json:"is_active"`
+	Draining  bool       `json:"is_draining"`
+	// Brigades - the brigades to move, Deleted - the deleted brigades to purge,
+	// Leftovers - the old copies of the moved brigades to destroy.
+	Brigades  int `json:"brigades"`
+	Deleted   int `json:"deleted"`
+	Leftovers int `json:"leftovers"`
+}
+
+// Empty - nothing is left on the pair, it's ready to retire.
+func (s *DrainStatus) Empty() bool {
+	return s.Brigades == 0 && s.Deleted == 0 && s.Leftovers == 0
+}
+
+// DrainFailure - the brigade which isn't moved.
+type DrainFailure struct {
+	BrigadeID string `json:"brigade_id"`
+	Error     string `json:"error"`
+}
+
+// DrainReport - the outcome of the drain run. Moved - the old copy is destroyed,
+// Kept - the brigade is moved, but the old copy is kept on the pair.
+type DrainReport struct {
+	Status *DrainStatus    `json:"status"`
+	Total  int             `json:"total"`
+	Moved  []*MoveResult   `json:"moved"`
+	Kept   []*MoveResult   `json:"kept"`
+	Failed []*DrainFailure `json:"failed"`
+}
+
+// DrainOpts - the moves parallelism and the keys for the target routers.
+type DrainOpts struct {
+	Parallel int
+
+	RouterKey    *[naclkey.NaclBoxKeyLength]byte
+	ShufflerKeys *naclkey.NaclBoxKeypair
+}
+
+// FetchDrain - the pair drain status by the pair ID or the control IP.
+func FetchDrain(ctx context.Context, c *Config, pairID string, controlIP netip.Addr) (*DrainStatus, error) {
+	s := &DrainStatus{}
+
+	err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlDrainStatus,
+			c.leftoversTable(),
+			pgx.Identifier{c.PairsSchema, "pairs"}.Sanitize(),
+			pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(),
+			c.deletedTable(),
+		),
+		optional(pairID), optionalAddr(controlIP),
+	).Scan(&s.PairID, &s.ControlIP, &s.Active, &s.Draining, &s.Brigades, &s.Deleted, &s.Leftovers)
+	switch {
+	case err == nil:
+		return s, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, fmt.Errorf("%w: %s%s", ErrPairNotFound, pairID, controlIP)
+	default:
+		return nil, fmt.Errorf("pair query: %w", err)
+	}
+}
+
+// SetDraining - marks the pair as draining, so it's out of the active pairs,
+// or returns it back.
+func SetDraining(ctx context.Context, c *Config, pairID string, controlIP netip.Addr, draining bool) (*DrainStatus, error) {
+	s, err := FetchDrain(ctx, c, pairID, controlIP)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.DB.Exec(ctx,
+		fmt.Sprintf(sqlDrainSet, pgx.Identifier{c.PairsSchema, "pairs"}.Sanitize()),
+		s.PairID, draining,
+	); err != nil {
+		return nil, fmt.Errorf("pair update: %w", err)
+	}
+
+	s.Draining = draining
+
+	logging.FromContext(ctx).Info("pair draining", logging.KeyPair, s.PairID, logging.KeyControlIP, s.ControlIP, "draining", draining)
+
+	return s, nil
+}
+
+// Drain - marks the pair as draining and moves all its brigades to the other pairs
+// chosen by the placement policy, Parallel moves at once. The interrupted drain
+// is continued by the next run, the pair stays draining. The moves in progress
+// are finished on the interruption, the new ones are not started.
+// The old copies kept on the pair are destroyed at the end if their delegation is done.
+func Drain(ctx context.Context, c *Config, pairID string, controlIP netip.Addr, opts DrainOpts) (*DrainReport, error) {
+	s, err := SetDraining(ctx, c, pairID, controlIP, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = logging.With(ctx, logging.KeyPair, s.PairID)
+
+	ids, err := c.drainBrigades(ctx, s.PairID)
+	if err != nil {
+		return nil, err
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = defaultDrainParallel
+	}
+
+	r := &DrainReport{Total: len(ids), Moved: []*MoveResult{}, Kept: []*MoveResult{}, Failed: []*DrainFailure{}}
+
+	log := logging.FromContext(ctx)
+
+	log.Info("drain", logging.KeyControlIP, s.ControlIP, "brigades", len(ids), "parallel", parallel)
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallel)
+	)
+
+	for _, id := range ids {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}: // Acquire the semaphore
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release the semaphore
+
+			res, err := Move(context.WithoutCancel(ctx), c, id, MoveOpts{
+				RouterKey:    opts.RouterKey,
+				ShufflerKeys: opts.ShufflerKeys,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err != nil:
+				r.Failed = append(r.Failed, &DrainFailure{BrigadeID: id, Error: err.Error()})
+			case !res.OldDestroyed:
+				r.Kept = append(r.Kept, res)
+			default:
+				r.Moved = append(r.Moved, res)
+			}
+
+			log.Info("drain progress",
+				logging.KeyBrigade, id,
+				"moved", len(r.Moved),
+				"kept", len(r.Kept),
+				"failed", len(r.Failed),
+				"total", r.Total,
+			)
+		}(id)
+	}
+
+	wg.Wait()
+
+	if _, err := DestroyLeftovers(context.WithoutCancel(ctx), c, s.ControlIP); err != nil {
+		log.Warn("can't destroy the old copies", logging.KeyError, err)
+	}
+
+	r.Status, err = FetchDrain(context.WithoutCancel(ctx), c, s.PairID, netip.Addr{})
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return r, fmt.Errorf("drain is interrupted: %w", ctx.Err())
+	}
+
+	return r, nil
+}
+
+func (c *Config) drainBrigades(ctx context.Context, pairID string) ([]string, error) {
+	rows, err := c.DB.Query(ctx,
+		fmt.Sprintf(sqlDrainBrigades,
+			pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(),
+			c.deletedTable(),
+		),
+		pairID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("brigades query: %w", err)
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("brigades rows: %w", err)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,22 @@
+package brigade
+
+import "testing"
+
+func TestDrainStatusEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		s    DrainStatus
+		want bool
+	}{
+		{name: "empty", want: true},
+		{name: "brigades", s: DrainStatus{Brigades: 1}},
+		{name: "deleted", s: DrainStatus{Deleted: 1}},
+		{name: "old copies", s: DrainStatus{Leftovers: 1}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.s.Empty(); got != tt.want {
+			t.Errorf("%s: %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
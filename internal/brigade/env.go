@@ -0,0 +1,196 @@
+package brigade
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/kdname"
+)
+
+const (
+	defaultBrigadesSchema      = "brigades"
+	defaultBrigadesStatsSchema = "stats"
+	defaultPairsSchema         = "pairs"
+)
+
+const sshkeyDefaultPath = "/etc/vg-dc-vpnapi"
+
+const defaultDatabaseURL = "postgresql:///vgrealm"
+
+const defaultWireguardConfigs = "native"
+
+// Address allocation modes.
+const (
+	AllocationRandom     = "random"
+	AllocationSequential = "sequential"
+)
+
+// Delegation wait modes.
+const (
+	DelegationWaitSync  = "sync"
+	DelegationWaitAsync = "async"
+)
+
+// NewConfigFromEnv - reads the environment, creates ssh configs and the db pool.
+func NewConfigFromEnv(logTag string) (*Config, error) {
+	c := &Config{LogTag: logTag}
+
+	dbURL := os.Getenv("DB_URL")
+	if dbURL == "" {
+		dbURL = defaultDatabaseURL
+	}
+
+	c.BrigadesSchema = os.Getenv("BRIGADES_SCHEMA")
+	if c.BrigadesSchema == "" {
+		c.BrigadesSchema = defaultBrigadesSchema
+	}
+
+	c.BrigadesStatsSchema = os.Getenv("BRIGADES_STATS_SCHEMA")
+	if c.BrigadesStatsSchema == "" {
+		c.BrigadesStatsSchema = defaultBrigadesStatsSchema
+	}
+
+	c.PairsSchema = os.Getenv("PAIRS_SCHEMA")
+	if c.PairsSchema == "" {
+		c.PairsSchema = defaultPairsSchema
+	}
+
+	sshKeyFilename, err := kdlib.LookupForSSHKeyfile(os.Getenv("SSH_KEY"), sshkeyDefaultPath)
+	if err != nil {
+		return nil, fmt.Errorf("lookup for ssh key: %w", err)
+	}
+
+	c.SubdomainAPIHost = os.Getenv("SUBDOMAIN_API_SERVER")
+	if c.SubdomainAPIHost == "" {
+		return nil, errors.New("empty subdomapi host")
+	}
+
+	if _, err := netip.ParseAddrPort(c.SubdomainAPIHost); err != nil {
+		return nil, fmt.Errorf("parse subdomapi host: %w", err)
+	}
+
+	c.SubdomainAPIToken = os.Getenv("SUBDOMAIN_API_TOKEN")
+	if c.SubdomainAPIToken == "" {
+		return nil, errors.New("empty subdomapi token")
+	}
+
+	_, c.Ident, err = dcmgmtlib.ParseDCNameEnv()
+	if err != nil {
+		return nil, fmt.Errorf("dc name: %w", err)
+	}
+
+	delegationUser, delegationServer, err := dcmgmtlib.ParseConnEnv("DELEGATION_SYNC_CONNECT")
+	if err != nil {
+		return nil, fmt.Errorf("delegation sync connect: %w", err)
+	}
+
+	c.DelegationServer = delegationServer
+
+	kdAddrUser, kdAddrServer, err := dcmgmtlib.ParseConnEnv("KEYDESK_ADDRESS_SYNC_CONNECT")
+	if err != nil {
+		return nil, fmt.Errorf("keydesk address sync connect: %w", err)
+	}
+
+	c.KdAddrServer = kdAddrServer
+
+	c.KdDomain = os.Getenv("KEYDESK_DOMAIN")
+	if c.KdDomain == "" {
+		return nil, errors.New("empty keydesk domain")
+	}
+
+	c.KdNames, err = kdname.New(c.KdDomain, os.Getenv("KEYDESK_NAME_SCHEME"))
+	if err != nil {
+		return nil, fmt.Errorf("keydesk names: %w", err)
+	}
+
+	kdNameServers := os.Getenv("KEYDESK_NAMESERVERS")
+	if kdNameServers == "" {
+		return nil, errors.New("empty keydesk nameservers")
+	}
+
+	c.KdNS = strings.Split(kdNameServers, ",")
+
+	domainNameServers := os.Getenv("DOMAIN_NAMESERVERS")
+	if domainNameServers == "" {
+		return nil, errors.New("empty domain nameservers")
+	}
+
+	c.DomainNS = strings.Split(domainNameServers, ",")
+
+	c.VPNCfgs.WG = os.Getenv("WIREGUARD_CONFIGS")
+	if c.VPNCfgs.WG == "" {
+		c.VPNCfgs.WG = defaultWireguardConfigs
+	}
+
+	c.VPNCfgs.OVC = os.Getenv("OVC_CONFIGS")
+	c.VPNCfgs.IPSec = os.Getenv("IPSEC_CONFIGS")
+	c.VPNCfgs.Outline = os.Getenv("OUTLINE_CONFIGS")
+
+	switch mode := os.Getenv("ADDRESS_ALLOCATION"); mode {
+	case "", AllocationRandom:
+		c.RandomAllocation = true
+	case AllocationSequential:
+		c.RandomAllocation = false
+	default:
+		return nil, fmt.Errorf("unknown address allocation: %s", mode)
+	}
+
+	switch mode := os.Getenv("DELEGATION_WAIT"); mode {
+	case "", DelegationWaitSync:
+		c.AsyncDelegation = false
+	case DelegationWaitAsync:
+		c.AsyncDelegation = true
+	default:
+		return nil, fmt.Errorf("unknown delegation wait: %s", mode)
+	}
+
+	c.Placement, err = NewPlacement(os.Getenv("PLACEMENT_POLICY"), ParseLabels(os.Getenv("PLACEMENT_LABELS")))
+	if err != nil {
+		return nil, fmt.Errorf("placement: %w", err)
+	}
+
+	if grace := os.Getenv("DELETION_GRACE"); grace != "" {
+		c.DeletionGrace, err = time.ParseDuration(grace)
+		if err != nil || c.DeletionGrace <= 0 {
+			return nil, fmt.Errorf("invalid deletion grace: %s", grace)
+		}
+	}
+
+	c.NodeExtensions, err = ParseNodeExtensions(os.Getenv("NODE_API_EXTENSIONS"))
+	if err != nil {
+		return nil, fmt.Errorf("node api: %w", err)
+	}
+
+	c.ReplacePolicy, err = kdlib.ReplacePolicyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("replace policy: %w", err)
+	}
+
+	c.NodeSSHConfig, err = kdlib.CreateSSHConfig(sshKeyFilename, SSHKeyRemoteUsername, kdlib.SSHDefaultTimeOut)
+	if err != nil {
+		return nil, fmt.Errorf("node ssh config: %w", err)
+	}
+
+	c.DelegationSyncSSHConfig, err = kdlib.CreateSSHConfig(sshKeyFilename, delegationUser, kdlib.SSHDefaultTimeOut)
+	if err != nil {
+		return nil, fmt.Errorf("delegation sync ssh config: %w", err)
+	}
+
+	c.KdAddrSyncSSHConfig, err = kdlib.CreateSSHConfig(sshKeyFilename, kdAddrUser, kdlib.SSHDefaultTimeOut)
+	if err != nil {
+		return nil, fmt.Errorf("keydesk address ssh config: %w", err)
+	}
+
+	c.DB, err = kdlib.CreateDBPool(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("db pool: %w", err)
+	}
+
+	return c, nil
+}
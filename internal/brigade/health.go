@@ -0,0 +1,330 @@
+package brigade
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/keydesk/keydesk/storage"
+
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+)
+
+// DefaultStatsFreshness - the stats are collected hourly, so two hours old stats are still fresh.
+const DefaultStatsFreshness = 2 * time.Hour
+
+const nodeFetchStatsCmd = "fetchstats -b %s -ch"
+
+var ErrNotOnNode = errors.New("brigade is not found on the pair")
+
+// Health checks.
+const (
+	CheckDeleted           = "not_deleted"
+	CheckEndpoint          = "endpoint"
+	CheckDomain            = "domain"
+	CheckNode              = "node"
+	CheckNodeEndpoint      = "node_endpoint"
+	CheckNodeDomain        = "node_domain"
+	CheckNodeKeydesk       = "node_keydesk"
+	CheckKeydeskDelegation = "keydesk_delegation"
+	CheckDomainDelegation  = "domain_delegation"
+	CheckStats             = "stats"
+)
+
+const (
+	sqlCheckEndpoint = `SELECT pair_id FROM %s WHERE endpoint_ipv4=$1`
+
+	sqlCheckDomain = `SELECT endpoint_ipv4 FROM %s WHERE domain_name=$1`
+
+	sqlCheckStats = `SELECT update_time FROM %s WHERE brigade_id=$1`
+
+	sqlCheckPair = `SELECT pair_id FROM %s WHERE brigade_id=$1`
+)
+
+// HealthCheck - the outcome of the single check.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Pass   bool   `json:"pass"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReport - the deep check of the brigade, it's healthy if all the checks are passed.
+type HealthReport struct {
+	BrigadeID    string         `json:"brigade_id"`
+	ControlIP    netip.Addr     `json:"control_ip"`
+	EndpointIPv4 netip.Addr     `json:"endpoint_ipv4"`
+	Domain       string         `json:"domain,omitempty"`
+	KeydeskIPv6  netip.Addr     `json:"keydesk_ipv6"`
+	KeydeskFQDN  string         `json:"keydesk_fqdn,omitempty"`
+	Pass         bool           `json:"pass"`
+	Checks       []*HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, pass bool, format string, args ...any) {
+	r.Checks = append(r.Checks, &HealthCheck{Name: name, Pass: pass, Detail: fmt.Sprintf(format, args...)})
+
+	if !pass {
+		r.Pass = false
+	}
+}
+
+// CheckHealth - compares the brigade record with the pair, the DNS and the stats.
+// The checks don't stop on the failure, every check has its own outcome.
+func CheckHealth(ctx context.Context, c *Config, brigadeID string, freshness time.Duration) (*HealthReport, error) {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	if freshness <= 0 {
+		freshness = DefaultStatsFreshness
+	}
+
+	b, err := c.fetchBrigade(ctx, brigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	r := &HealthReport{
+		BrigadeID:    brigadeID,
+		ControlIP:    b.controlIP,
+		EndpointIPv4: b.endpointIPv4,
+		Domain:       b.domainName.String,
+		KeydeskIPv6:  b.keydeskIPv6,
+		Pass:         true,
+	}
+
+	r.KeydeskFQDN, err = c.KdNames.Encode(b.keydeskIPv6)
+	if err != nil {
+		return nil, fmt.Errorf("keydesk name: %w", err)
+	}
+
+	c.checkDeleted(ctx, r)
+	c.checkEndpoint(ctx, r)
+	c.checkDomain(ctx, r)
+	c.checkNode(ctx, r, b)
+	c.checkNodeRecord(ctx, r, b)
+	c.checkDelegations(r)
+	c.checkStats(ctx, r, freshness)
+
+	return r, nil
+}
+
+func (c *Config) checkDeleted(ctx context.Context, r *HealthReport) {
+	err := c.checkNotDeleted(ctx, r.BrigadeID)
+	switch {
+	case err == nil:
+		r.add(CheckDeleted, true, "")
+	case errors.Is(err, ErrBrigadeDeleted):
+		r.add(CheckDeleted, false, "brigade is deleted")
+	default:
+		r.add(CheckDeleted, false, "%s", err)
+	}
+}
+
+// checkEndpoint - the endpoint belongs to the brigade pair.
+func (c *Config) checkEndpoint(ctx context.Context, r *HealthReport) {
+	var brigadePair, endpointPair string
+
+	if err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlCheckPair, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		r.BrigadeID,
+	).Scan(&brigadePair); err != nil {
+		r.add(CheckEndpoint, false, "brigade pair: %s", err)
+
+		return
+	}
+
+	if err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlCheckEndpoint, pgx.Identifier{c.PairsSchema, "pairs_endpoints_ipv4"}.Sanitize()),
+		r.EndpointIPv4,
+	).Scan(&endpointPair); err != nil {
+		r.add(CheckEndpoint, false, "endpoint pair: %s", err)
+
+		return
+	}
+
+	if brigadePair != endpointPair {
+		r.add(CheckEndpoint, false, "endpoint %s belongs to the pair %s, not %s", r.EndpointIPv4, endpointPair, brigadePair)
+
+		return
+	}
+
+	r.add(CheckEndpoint, true, "%s", r.EndpointIPv4)
+}
+
+// checkDomain - the brigade domain points to the brigade endpoint.
+func (c *Config) checkDomain(ctx context.Context, r *HealthReport) {
+	if r.Domain == "" {
+		r.add(CheckDomain, true, "no domain")
+
+		return
+	}
+
+	var endpoint netip.Addr
+
+	if err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlCheckDomain, pgx.Identifier{c.BrigadesSchema, "domains_endpoints_ipv4"}.Sanitize()),
+		r.Domain,
+	).Scan(&endpoint); err != nil {
+		r.add(CheckDomain, false, "domain query: %s", err)
+
+		return
+	}
+
+	if endpoint != r.EndpointIPv4 {
+		r.add(CheckDomain, false, "domain %s points to %s", r.Domain, endpoint)
+
+		return
+	}
+
+	r.add(CheckDomain, true, "%s", r.Domain)
+}
+
+// checkNode - the pair knows the brigade and collects its stats.
+func (c *Config) checkNode(ctx context.Context, r *HealthReport, b *brigadeRecord) {
+	updateTime, err := c.nodeStats(ctx, b.controlIP, b.id32())
+	if err != nil {
+		r.add(CheckNode, false, "%s", err)
+
+		return
+	}
+
+	r.add(CheckNode, true, "updated at %s", updateTime.Format(time.RFC3339))
+}
+
+// nodeBrigade - the addresses of the keydesk brigade file.
+type nodeBrigade struct {
+	EndpointIPv4   netip.Addr `json:"endpoint_ipv4"`
+	EndpointDomain string     `json:"endpoint_domain"`
+	KeydeskIPv6    netip.Addr `json:"keydesk_ipv6"`
+}
+
+// checkNodeRecord - the brigade file on the pair has the endpoint, the domain
+// and the keydesk address of the brigade record. The file is exported, so the
+// migrate extension is needed, the checks fail without it.
+func (c *Config) checkNodeRecord(ctx context.Context, r *HealthReport, b *brigadeRecord) {
+	checks := []string{CheckNodeEndpoint, CheckNodeDomain, CheckNodeKeydesk}
+
+	nb, err := c.nodeBrigade(ctx, b)
+	if err != nil {
+		for _, name := range checks {
+			r.add(name, false, "%s", err)
+		}
+
+		return
+	}
+
+	for _, check := range []struct {
+		name       string
+		want, have string
+	}{
+		{CheckNodeEndpoint, b.endpointIPv4.String(), nb.EndpointIPv4.String()},
+		{CheckNodeDomain, b.domainName.String, nb.EndpointDomain},
+		{CheckNodeKeydesk, b.keydeskIPv6.String(), nb.KeydeskIPv6.String()},
+	} {
+		if check.have != check.want {
+			r.add(check.name, false, "%q on the pair, %q expected", check.have, check.want)
+
+			continue
+		}
+
+		r.add(check.name, true, "%s", check.have)
+	}
+}
+
+func (c *Config) nodeBrigade(ctx context.Context, b *brigadeRecord) (*nodeBrigade, error) {
+	if err := c.NodeExtensions.require(NodeExtMigrate); err != nil {
+		return nil, err
+	}
+
+	state, err := c.exportFromNode(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	nb := &nodeBrigade{}
+	if err := json.Unmarshal(state, nb); err != nil {
+		return nil, fmt.Errorf("brigade unmarshal: %w", err)
+	}
+
+	return nb, nil
+}
+
+// nodeStats - the brigade stats update time on the pair, ErrNotOnNode if the pair doesn't know the brigade.
+func (c *Config) nodeStats(ctx context.Context, controlIP netip.Addr, id32 string) (time.Time, error) {
+	output, err := c.runOnNode(ctx, controlIP, fmt.Sprintf(nodeFetchStatsCmd, id32))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	payload, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(output)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("chunk read: %w", err)
+	}
+
+	var stats struct {
+		Stats []*storage.Stats `json:"stats"`
+	}
+
+	if err := json.Unmarshal(payload, &stats); err != nil {
+		return time.Time{}, fmt.Errorf("stats unmarshal: %w", err)
+	}
+
+	for _, s := range stats.Stats {
+		if s != nil && s.BrigadeID == id32 {
+			return s.UpdateTime, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: %s", ErrNotOnNode, controlIP)
+}
+
+// checkDelegations - the keydesk name and the domain are resolved to the brigade addresses.
+func (c *Config) checkDelegations(r *HealthReport) {
+	ok, err := dcmgmtlib.CheckForPresence(r.KeydeskFQDN, r.KeydeskIPv6, c.KdNS...)
+	switch {
+	case err != nil:
+		r.add(CheckKeydeskDelegation, false, "%s: %s", r.KeydeskFQDN, err)
+	default:
+		r.add(CheckKeydeskDelegation, ok, "%s", r.KeydeskFQDN)
+	}
+
+	if r.Domain == "" {
+		r.add(CheckDomainDelegation, true, "no domain")
+
+		return
+	}
+
+	ok, err = dcmgmtlib.CheckForPresence(r.Domain, r.EndpointIPv4, c.DomainNS...)
+	switch {
+	case err != nil:
+		r.add(CheckDomainDelegation, false, "%s: %s", r.Domain, err)
+	default:
+		r.add(CheckDomainDelegation, ok, "%s", r.Domain)
+	}
+}
+
+// checkStats - the collected stats are not older than the freshness.
+func (c *Config) checkStats(ctx context.Context, r *HealthReport, freshness time.Duration) {
+	var updateTime time.Time
+
+	err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlCheckStats, pgx.Identifier{c.BrigadesStatsSchema, "brigades_stats"}.Sanitize()),
+		r.BrigadeID,
+	).Scan(&updateTime)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		r.add(CheckStats, false, "no stats")
+	case err != nil:
+		r.add(CheckStats, false, "stats query: %s", err)
+	case time.Since(updateTime) > freshness:
+		r.add(CheckStats, false, "updated at %s, older than %s", updateTime.Format(time.RFC3339), freshness)
+	default:
+		r.add(CheckStats, true, "updated at %s", updateTime.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,24 @@
+package brigade
+
+import (
+	"context"
+	"testing"
+)
+
+// TestCheckNodeRecordUnsupported - without the export every node record check fails.
+func TestCheckNodeRecordUnsupported(t *testing.T) {
+	c := &Config{}
+	r := &HealthReport{Pass: true}
+
+	c.checkNodeRecord(context.Background(), r, &brigadeRecord{})
+
+	if r.Pass || len(r.Checks) != 3 {
+		t.Fatalf("report: %+v", r)
+	}
+
+	for i, name := range []string{CheckNodeEndpoint, CheckNodeDomain, CheckNodeKeydesk} {
+		if r.Checks[i].Name != name || r.Checks[i].Pass {
+			t.Errorf("check %d: %+v, want failed %s", i, r.Checks[i], name)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package brigade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/vpngen/wordsgens/namesgenerator"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+// Journal operations.
+const (
+	OperationCreate = "create"
+)
+
+// Journal states.
+const (
+	JournalStateRunning = "running"
+	JournalStateFailed  = "failed"
+	JournalStateDone    = "done"
+)
+
+// Brigade creation steps in the order of execution.
+const (
+	StepAllocate   = "allocate"
+	StepSubdomain  = "subdomain"
+	StepSync       = "sync"
+	StepNode       = "node"
+	StepDelegation = "delegation"
+)
+
+var createSteps = []string{StepAllocate, StepSubdomain, StepSync, StepNode, StepDelegation}
+
+// pgUniqueViolation - postgres unique_violation error code.
+const pgUniqueViolation = "23505"
+
+// JournalStaleTime - a running journal is considered abandoned after this time.
+const JournalStaleTime = 10 * time.Minute
+
+// JournalHeartbeat - the running journals of the long operation are touched this often,
+// so they don't look stale while the operation is alive.
+const JournalHeartbeat = JournalStaleTime / 4
+
+// JournalAnswerTime - the node answer of the created brigade is kept for the repeated requests
+// for this time, it holds the brigadier private configs. The configs are refetched later.
+const JournalAnswerTime = time.Hour
+
+var (
+	ErrJournalNotFound = errors.New("journal not found")
+	ErrJournalExists   = errors.New("journal exists")
+	ErrJournalBusy     = errors.New("journal is in progress")
+	ErrJournalDone     = errors.New("journal is finished")
+)
+
+const (
+	sqlJournalBegin = `
+INSERT INTO %s
+	(
+		brigade_id,
+		operation,
+		step,
+		state,
+		payload
+	)
+VALUES
+	(
+		$1,
+		$2,
+		$3,
+		$4,
+		$5
+	)
+`
+
+	sqlJournalFetch = `
+SELECT
+	brigade_id,
+	operation,
+	step,
+	steps_done,
+	state,
+	payload,
+	answer,
+	last_error,
+	created_at,
+	update_time
+FROM %s
+WHERE
+	brigade_id=$1
+`
+
+	sqlJournalList = `
+SELECT
+	brigade_id,
+	operation,
+	step,
+	steps_done,
+	state,
+	payload,
+	answer,
+	last_error,
+	created_at,
+	update_time
+FROM %s
+WHERE
+	state <> 'done'
+ORDER BY created_at
+`
+
+	sqlJournalClaim      = `UPDATE %s SET state=$3, update_time=now() WHERE brigade_id=$1 AND update_time=$2`
+	sqlJournalStep       = `UPDATE %s SET step=$2, state=$3, update_time=now() WHERE brigade_id=$1`
+	sqlJournalStepDone   = `UPDATE %s SET steps_done=array_append(array_remove(steps_done, $2::text), $2::text), update_time=now() WHERE brigade_id=$1`
+	sqlJournalStepUndone = `UPDATE %s SET steps_done=array_remove(steps_done, $2::text), update_time=now() WHERE brigade_id=$1`
+	sqlJournalFinish     = `UPDATE %s SET step='', state=$2, last_error=NULL, update_time=now() WHERE brigade_id=$1`
+	sqlJournalFail       = `UPDATE %s SET state=$2, last_error=$3, update_time=now() WHERE brigade_id=$1`
+	sqlJournalPayload    = `UPDATE %s SET payload=$2, update_time=now() WHERE brigade_id=$1`
+	sqlJournalAnswer     = `UPDATE %s SET answer=$2, update_time=now() WHERE brigade_id=$1`
+	sqlJournalDelete     = `DELETE FROM %s WHERE brigade_id=$1`
+
+	sqlJournalTouch = `UPDATE %s SET update_time=now() WHERE brigade_id=ANY($1::uuid[]) AND state='running'`
+
+	sqlJournalExpireAnswers = `UPDATE %s SET answer=NULL WHERE state='done' AND answer IS NOT NULL AND update_time < now() - make_interval(secs => $1)`
+)
+
+// journalPayload - everything we need to repeat or compensate the steps.
+type journalPayload struct {
+	Name    string                `json:"name"`
+	Person  namesgenerator.Person `json:"person"`
+	ForceIP netip.Addr            `json:"force_ip"`
+
+	// Domain - subdomain picked from the subdomain API.
+	Domain string `json:"domain,omitempty"`
+}
+
+// Journal - recorded state of the brigade operation.
+type Journal struct {
+	BrigadeID  string    `json:"brigade_id"`
+	Operation  string    `json:"operation"`
+	Step       string    `json:"step"`
+	StepsDone  []string  `json:"steps_done"`
+	State      string    `json:"state"`
+	LastError  string    `json:"last_error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdateTime time.Time `json:"update_time"`
+
+	payload journalPayload
+	answer  []byte
+}
+
+// Done - is step done.
+func (j *Journal) Done(step string) bool {
+	return slices.Contains(j.StepsDone, step)
+}
+
+// Touched - is step done or was started.
+func (j *Journal) Touched(step string) bool {
+	return j.Done(step) || j.Step == step
+}
+
+// Same - the journal is for the same brigade creation request.
+func (j *Journal) Same(opts *Opts) bool {
+	return j.payload.Name == opts.Name &&
+		j.payload.Person.Name == opts.Person.Name &&
+		j.payload.Person.Desc == opts.Person.Desc &&
+		j.payload.Person.URL == opts.Person.URL
+}
+
+// nodeUncertain - the node step was started but not finished,
+// we don't know if the node has got the brigade.
+func (j *Journal) nodeUncertain() bool {
+	return j.Step == StepNode && !j.Done(StepNode)
+}
+
+// Stale - the journal is not in progress by anyone.
+func (j *Journal) Stale() bool {
+	return j.State != JournalStateRunning || time.Since(j.UpdateTime) > JournalStaleTime
+}
+
+type execQuerier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func (c *Config) journalTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "brigades_journal"}.Sanitize()
+}
+
+func (c *Config) journalBegin(ctx context.Context, op string, opts *Opts) (*Journal, error) {
+	j := &Journal{
+		BrigadeID: opts.ID,
+		Operation: op,
+		State:     JournalStateRunning,
+		payload: journalPayload{
+			Name:    opts.Name,
+			Person:  opts.Person,
+			ForceIP: opts.ForceIP,
+		},
+	}
+
+	payload, err := json.Marshal(j.payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+
+	if _, err := c.DB.Exec(ctx,
+		fmt.Sprintf(sqlJournalBegin, c.journalTable()),
+		j.BrigadeID, j.Operation, j.Step, j.State, payload,
+	); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			return nil, fmt.Errorf("%w: %s", ErrJournalExists, j.BrigadeID)
+		}
+
+		return nil, fmt.Errorf("insert journal: %w", err)
+	}
+
+	return j, nil
+}
+
+func scanJournal(row pgx.Row) (*Journal, error) {
+	var (
+		j         Journal
+		payload   []byte
+		lastError pgtype.Text
+	)
+
+	if err := row.Scan(
+		&j.BrigadeID,
+		&j.Operation,
+		&j.Step,
+		&j.StepsDone,
+		&j.State,
+		&payload,
+		&j.answer,
+		&lastError,
+		&j.CreatedAt,
+		&j.UpdateTime,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(payload, &j.payload); err != nil {
+		return nil, fmt.Errorf("unmarshal payload: %w", err)
+	}
+
+	j.LastError = lastError.String
+
+	return &j, nil
+}
+
+// FetchJournal - fetch the brigade journal.
+func FetchJournal(ctx context.Context, c *Config, brigadeID string) (*Journal, error) {
+	j, err := scanJournal(c.DB.QueryRow(ctx, fmt.Sprintf(sqlJournalFetch, c.journalTable()), brigadeID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrJournalNotFound, brigadeID)
+		}
+
+		return nil, fmt.Errorf("journal query: %w", err)
+	}
+
+	return j, nil
+}
+
+// ListJournals - list all leftover journals, finished ones are skipped.
+func ListJournals(ctx context.Context, c *Config) ([]*Journal, error) {
+	rows, err := c.DB.Query(ctx, fmt.Sprintf(sqlJournalList, c.journalTable()))
+	if err != nil {
+		return nil, fmt.Errorf("journal query: %w", err)
+	}
+
+	defer rows.Close()
+
+	var list []*Journal
+
+	for rows.Next() {
+		j, err := scanJournal(rows)
+		if err != nil {
+			return nil, fmt.Errorf("journal row: %w", err)
+		}
+
+		list = append(list, j)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("journal rows: %w", err)
+	}
+
+	return list, nil
+}
+
+// journalClaim - takes over the leftover journal, fails if someone else did it first.
+func (c *Config) journalClaim(ctx context.Context, j *Journal) error {
+	tag, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalClaim, c.journalTable()), j.BrigadeID, j.UpdateTime, JournalStateRunning)
+	if err != nil {
+		return fmt.Errorf("journal claim: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrJournalBusy, j.BrigadeID)
+	}
+
+	j.State = JournalStateRunning
+
+	return nil
+}
+
+func (c *Config) journalStep(ctx context.Context, j *Journal, step, state string) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalStep, c.journalTable()), j.BrigadeID, step, state); err != nil {
+		return fmt.Errorf("journal step: %w", err)
+	}
+
+	j.Step = step
+	j.State = state
+
+	return nil
+}
+
+// journalStepDone - marks the step as done, q may be a transaction of the step itself.
+func (c *Config) journalStepDone(ctx context.Context, q execQuerier, j *Journal, step string) error {
+	if _, err := q.Exec(ctx, fmt.Sprintf(sqlJournalStepDone, c.journalTable()), j.BrigadeID, step); err != nil {
+		return fmt.Errorf("journal step done: %w", err)
+	}
+
+	if !j.Done(step) {
+		j.StepsDone = append(j.StepsDone, step)
+	}
+
+	return nil
+}
+
+func (c *Config) journalStepUndone(ctx context.Context, j *Journal, step string) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalStepUndone, c.journalTable()), j.BrigadeID, step); err != nil {
+		return fmt.Errorf("journal step undone: %w", err)
+	}
+
+	j.StepsDone = slices.DeleteFunc(j.StepsDone, func(s string) bool { return s == step })
+
+	return nil
+}
+
+// journalFinish - keeps the journal with the answer to reply on the repeated requests,
+// the answer is cleared after JournalAnswerTime.
+func (c *Config) journalFinish(ctx context.Context, j *Journal) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalFinish, c.journalTable()), j.BrigadeID, JournalStateDone); err != nil {
+		return fmt.Errorf("journal finish: %w", err)
+	}
+
+	j.Step = ""
+	j.State = JournalStateDone
+	j.LastError = ""
+
+	return nil
+}
+
+func (c *Config) journalFail(ctx context.Context, j *Journal, cause error) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalFail, c.journalTable()), j.BrigadeID, JournalStateFailed, cause.Error()); err != nil {
+		return fmt.Errorf("journal fail: %w", err)
+	}
+
+	j.State = JournalStateFailed
+	j.LastError = cause.Error()
+
+	return nil
+}
+
+func (c *Config) journalPayload(ctx context.Context, q execQuerier, j *Journal) error {
+	payload, err := json.Marshal(j.payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+
+	if _, err := q.Exec(ctx, fmt.Sprintf(sqlJournalPayload, c.journalTable()), j.BrigadeID, payload); err != nil {
+		return fmt.Errorf("journal payload: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) journalAnswer(ctx context.Context, j *Journal, answer []byte) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalAnswer, c.journalTable()), j.BrigadeID, answer); err != nil {
+		return fmt.Errorf("journal answer: %w", err)
+	}
+
+	j.answer = answer
+
+	return nil
+}
+
+// heartbeat - keeps the running journals of the operation fresh until stopped.
+type heartbeat struct {
+	mu     sync.Mutex
+	ids    []string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Add - the journal is kept fresh from now on.
+func (h *heartbeat) Add(j *Journal) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ids = append(h.ids, j.BrigadeID)
+}
+
+// Stop - stops the heartbeat and waits for it.
+func (h *heartbeat) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+func (c *Config) journalHeartbeat(ctx context.Context) *heartbeat {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h := &heartbeat{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(JournalHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			h.mu.Lock()
+			ids := slices.Clone(h.ids)
+			h.mu.Unlock()
+
+			if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalTouch, c.journalTable()), ids); err != nil && ctx.Err() == nil {
+				logging.FromContext(ctx).Warn("can't touch journals", logging.KeyError, err)
+			}
+		}
+	}()
+
+	return h
+}
+
+// journalExpireAnswers - clears the answers of the created brigades kept longer than JournalAnswerTime.
+func (c *Config) journalExpireAnswers(ctx context.Context) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalExpireAnswers, c.journalTable()), JournalAnswerTime.Seconds()); err != nil {
+		return fmt.Errorf("journal expire answers: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) journalDelete(ctx context.Context, j *Journal) error {
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlJournalDelete, c.journalTable()), j.BrigadeID); err != nil {
+		return fmt.Errorf("journal delete: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	sqlLeftoverInsert = `INSERT INTO %s (brigade_id, control_ip) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+
+	sqlLeftoverDelete = `DELETE FROM %s WHERE brigade_id=$1 AND control_ip=$2`
+
+	// The old copy is destroyed when the delegation isn't pending,
+	// the purged brigade has no delegation at all.
+	sqlLeftoverReady = `
+SELECT
+	l.brigade_id,
+	l.control_ip
+FROM %s AS l
+	LEFT JOIN %s AS d ON d.brigade_id = l.brigade_id
+WHERE
+	($1::inet IS NULL OR l.control_ip = $1)
+	AND (d.state IS NULL OR d.state = 'done')
+ORDER BY l.created_at
+`
+)
+
+// Leftover - the suspended old copy of the moved brigade.
+type Leftover struct {
+	BrigadeID string     `json:"brigade_id"`
+	ControlIP netip.Addr `json:"control_ip"`
+}
+
+func (c *Config) leftoversTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "brigades_leftovers"}.Sanitize()
+}
+
+// leftoverKeep - the old copy is kept until the delegation follows the new one.
+func (c *Config) leftoverKeep(ctx context.Context, tx pgx.Tx, brigadeID string, controlIP netip.Addr) error {
+	if _, err := tx.Exec(ctx, fmt.Sprintf(sqlLeftoverInsert, c.leftoversTable()), brigadeID, controlIP); err != nil {
+		return fmt.Errorf("leftover insert: %w", err)
+	}
+
+	return nil
+}
+
+// leftoverDestroy - destroys the old copy on the node and forgets it.
+func (c *Config) leftoverDestroy(ctx context.Context, l *Leftover) error {
+	id, err := uuid.Parse(l.BrigadeID)
+	if err != nil {
+		return fmt.Errorf("brigade id: %w", err)
+	}
+
+	if _, err := c.runOnNode(ctx, l.ControlIP, fmt.Sprintf(nodeDestroyCmd, kdlib.BrigadeID32(id))); err != nil {
+		return fmt.Errorf("destroy old copy: %w", err)
+	}
+
+	if _, err := c.DB.Exec(ctx, fmt.Sprintf(sqlLeftoverDelete, c.leftoversTable()), l.BrigadeID, l.ControlIP); err != nil {
+		return fmt.Errorf("leftover delete: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("old copy is destroyed", logging.KeyControlIP, l.ControlIP)
+
+	return nil
+}
+
+// DestroyLeftovers - destroys the old copies of the moved brigades on the pair,
+// or on all the pairs if the control IP is not set, the delegation of the brigade must be done.
+// The failed ones are kept for the next run.
+func DestroyLeftovers(ctx context.Context, c *Config, controlIP netip.Addr) ([]*Leftover, error) {
+	rows, err := c.DB.Query(ctx,
+		fmt.Sprintf(sqlLeftoverReady, c.leftoversTable(), c.delegationTable()),
+		optionalAddr(controlIP),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("leftovers query: %w", err)
+	}
+
+	list, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[Leftover])
+	if err != nil {
+		return nil, fmt.Errorf("leftovers rows: %w", err)
+	}
+
+	var (
+		destroyed []*Leftover
+		errs      []error
+	)
+
+	for _, l := range list {
+		if err := c.leftoverDestroy(brigadeContext(ctx, l.BrigadeID), l); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.BrigadeID, err))
+
+			continue
+		}
+
+		destroyed = append(destroyed, l)
+	}
+
+	return destroyed, errors.Join(errs...)
+}
@@ -0,0 +1,412 @@
+package brigade
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/vpngine/naclkey"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/reset"
+)
+
+// Node commands of the move, the brigade state is the keydesk brigade file.
+const (
+	nodeExportCmd = "export -id %s -ch"
+	nodeImportCmd = "import -id %s -ch"
+)
+
+const (
+	// The target pair takes the brigades only if it's active and not draining.
+	sqlMoveTargetPair = `
+SELECT
+	pair_id,
+	control_ip
+FROM %s
+WHERE
+	(($1::uuid IS NOT NULL AND pair_id = $1)
+		OR ($2::inet IS NOT NULL AND control_ip = $2))
+	AND is_active
+	AND NOT is_draining
+`
+
+	// The free endpoint without the leftover domain, the brigade brings its own.
+	sqlMovePickEndpoint = `
+SELECT
+	endpoint_ipv4
+FROM %s
+WHERE
+	pair_id = $1
+	AND domain_name IS NULL
+ORDER BY random()
+LIMIT 1
+`
+
+	sqlMoveBrigade = `UPDATE %s SET pair_id=$2, endpoint_ipv4=$3 WHERE brigade_id=$1 AND endpoint_ipv4=$4`
+
+	sqlMoveDomain = `UPDATE %s SET endpoint_ipv4=$2 WHERE domain_name=$1`
+)
+
+var (
+	ErrSamePair     = errors.New("brigade is already on the pair")
+	ErrPairNotFound = errors.New("active pair not found")
+	ErrNoEndpoint   = errors.New("no free endpoint on the pair")
+	ErrMoveConflict = errors.New("brigade is changed during the move")
+)
+
+// MoveOpts - the target pair and the keys to re-encrypt the brigade secrets for the target router.
+type MoveOpts struct {
+	// PairID or ControlIP - the target pair, it's picked up by the placement policy if both are empty.
+	PairID    string
+	ControlIP netip.Addr
+
+	RouterKey    *[naclkey.NaclBoxKeyLength]byte
+	ShufflerKeys *naclkey.NaclBoxKeypair
+}
+
+// MoveResult - the moved brigade, the old copy is kept suspended
+// until the delegation follows the new one.
+type MoveResult struct {
+	BrigadeID     string     `json:"brigade_id"`
+	FromControlIP netip.Addr `json:"from_control_ip"`
+	ToControlIP   netip.Addr `json:"to_control_ip"`
+	FromEndpoint  netip.Addr `json:"from_endpoint_ipv4"`
+	ToEndpoint    netip.Addr `json:"to_endpoint_ipv4"`
+	Domain        string     `json:"domain,omitempty"`
+	OldDestroyed  bool       `json:"old_destroyed"`
+	Warning       string     `json:"warning,omitempty"`
+}
+
+// Move - moves the brigade to the free endpoint of the target pair with all its users.
+// The brigade is suspended on the old pair, so nothing is changed after the export,
+// its state is re-encrypted for the new router with the new endpoint and imported
+// to the new pair. The database is switched after the new copy is found on the new pair,
+// then the lists are synced so the domain and the keydesk follow. Any failure before
+// the switch destroys the new copy and resumes the old one.
+// The old copy is destroyed when the delegation is confirmed, otherwise it's kept
+// suspended with the pending delegation and destroyed by DestroyLeftovers later.
+func Move(ctx context.Context, c *Config, brigadeID string, opts MoveOpts) (*MoveResult, error) {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	if err := c.NodeExtensions.require(NodeExtMigrate); err != nil {
+		return nil, err
+	}
+
+	if err := c.NodeExtensions.require(NodeExtSuspend); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkNotDeleted(ctx, brigadeID); err != nil {
+		return nil, err
+	}
+
+	b, err := c.fetchBrigade(ctx, brigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	pairID, controlIP, err := c.moveTarget(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if controlIP == b.controlIP {
+		return nil, fmt.Errorf("%w: %s", ErrSamePair, controlIP)
+	}
+
+	endpoint, err := c.movePickEndpoint(ctx, pairID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &MoveResult{
+		BrigadeID:     brigadeID,
+		FromControlIP: b.controlIP,
+		ToControlIP:   controlIP,
+		FromEndpoint:  b.endpointIPv4,
+		ToEndpoint:    endpoint,
+		Domain:        b.domainName.String,
+	}
+
+	log := logging.FromContext(ctx)
+
+	log.Info("move brigade", "from", b.controlIP, "to", controlIP, "endpoint_ipv4", endpoint)
+
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeSuspendCmd, b.id32())); err != nil {
+		return nil, c.moveUndo(ctx, b, netip.Addr{}, fmt.Errorf("suspend: %w", err))
+	}
+
+	state, err := c.exportFromNode(ctx, b)
+	if err != nil {
+		return nil, c.moveUndo(ctx, b, netip.Addr{}, fmt.Errorf("export: %w", err))
+	}
+
+	state, err = reEncryptState(b.id32(), state, opts, endpoint)
+	if err != nil {
+		return nil, c.moveUndo(ctx, b, netip.Addr{}, fmt.Errorf("re-encrypt: %w", err))
+	}
+
+	if _, err := c.runOnNodeInput(ctx, controlIP, fmt.Sprintf(nodeImportCmd, b.id32()), bytes.NewReader(state)); err != nil {
+		return nil, c.moveUndo(ctx, b, controlIP, fmt.Errorf("import: %w", err))
+	}
+
+	if _, err := c.nodeStats(ctx, controlIP, b.id32()); err != nil {
+		return nil, c.moveUndo(ctx, b, controlIP, fmt.Errorf("verify: %w", err))
+	}
+
+	if err := c.moveRecord(ctx, brigadeID, b, pairID, endpoint); err != nil {
+		return nil, c.moveUndo(ctx, b, controlIP, err)
+	}
+
+	log.Info("brigade is moved in the database, sync lists")
+
+	if err := c.syncLists(ctx); err != nil {
+		return c.moveKeepOld(ctx, res, fmt.Sprintf("sync lists: %s", err)), nil
+	}
+
+	if c.AsyncDelegation || !c.waitForAllDelegations(ctx, b.keydeskIPv6, b.domainName.String, endpoint) {
+		return c.moveKeepOld(ctx, res, "delegation is not confirmed"), nil
+	}
+
+	if err := c.leftoverDestroy(ctx, &Leftover{BrigadeID: brigadeID, ControlIP: b.controlIP}); err != nil {
+		res.Warning = err.Error()
+
+		log.Warn("can't destroy the old copy", logging.KeyControlIP, b.controlIP, logging.KeyError, err)
+
+		return res, nil
+	}
+
+	res.OldDestroyed = true
+
+	log.Info("brigade is moved", "to", controlIP, "endpoint_ipv4", endpoint)
+
+	return res, nil
+}
+
+// moveKeepOld - the old copy is left for DestroyLeftovers, the delegation is checked later.
+func (c *Config) moveKeepOld(ctx context.Context, res *MoveResult, reason string) *MoveResult {
+	log := logging.FromContext(ctx)
+
+	res.Warning = reason + ", the old copy is kept"
+
+	log.Warn(res.Warning, logging.KeyControlIP, res.FromControlIP)
+
+	if err := c.delegationPending(ctx, res.BrigadeID); err != nil {
+		log.Error("can't mark the delegation pending", logging.KeyError, err)
+	}
+
+	return res
+}
+
+// moveUndo - destroys the new copy if the import is started and resumes the old one.
+func (c *Config) moveUndo(ctx context.Context, b *brigadeRecord, newControlIP netip.Addr, cause error) error {
+	errs := []error{cause}
+
+	if newControlIP.IsValid() {
+		if _, err := c.runOnNode(ctx, newControlIP, fmt.Sprintf(nodeDestroyCmd, b.id32())); err != nil {
+			errs = append(errs, fmt.Errorf("destroy new copy: %w", err))
+		}
+	}
+
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeUnsuspendCmd, b.id32())); err != nil {
+		errs = append(errs, fmt.Errorf("unsuspend old copy: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// moveTarget - the active target pair.
+func (c *Config) moveTarget(ctx context.Context, opts MoveOpts) (string, netip.Addr, error) {
+	var (
+		pairID    *string
+		controlIP *netip.Addr
+		id        string
+		ip        netip.Addr
+	)
+
+	if opts.PairID != "" {
+		pairID = &opts.PairID
+	}
+
+	if opts.ControlIP.IsValid() {
+		controlIP = &opts.ControlIP
+	}
+
+	if pairID == nil && controlIP == nil {
+		id, err := c.movePlacement(ctx)
+		if err != nil {
+			return "", netip.Addr{}, err
+		}
+
+		pairID = &id
+	}
+
+	err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlMoveTargetPair, pgx.Identifier{c.PairsSchema, "pairs"}.Sanitize()),
+		pairID, controlIP,
+	).Scan(&id, &ip)
+	switch {
+	case err == nil:
+		return id, ip, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return "", netip.Addr{}, fmt.Errorf("%w: %s%s", ErrPairNotFound, opts.PairID, opts.ControlIP)
+	default:
+		return "", netip.Addr{}, fmt.Errorf("pair query: %w", err)
+	}
+}
+
+// movePlacement - the target pair by the placement policy, the draining pairs are out of the active pairs.
+func (c *Config) movePlacement(ctx context.Context) (string, error) {
+	placement := c.Placement
+	if placement == nil {
+		placement = mostFree{}
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	pairID, reason, err := placement.Pick(ctx, tx, c)
+	switch {
+	case err == nil:
+	case errors.Is(err, pgx.ErrNoRows):
+		return "", fmt.Errorf("%w: %s", ErrNoEndpoint, placement.Name())
+	default:
+		return "", err
+	}
+
+	logging.FromContext(ctx).Info("placement", "policy", placement.Name(), logging.KeyPair, pairID, "reason", reason)
+
+	return pairID, nil
+}
+
+func (c *Config) movePickEndpoint(ctx context.Context, pairID string) (netip.Addr, error) {
+	var endpoint netip.Addr
+
+	err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlMovePickEndpoint, pgx.Identifier{c.BrigadesSchema, "slots"}.Sanitize()),
+		pairID,
+	).Scan(&endpoint)
+	switch {
+	case err == nil:
+		return endpoint, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrNoEndpoint, pairID)
+	default:
+		return netip.Addr{}, fmt.Errorf("endpoint query: %w", err)
+	}
+}
+
+// exportFromNode - the keydesk brigade file from the pair.
+func (c *Config) exportFromNode(ctx context.Context, b *brigadeRecord) ([]byte, error) {
+	output, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeExportCmd, b.id32()))
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(output)))
+	if err != nil {
+		return nil, fmt.Errorf("chunk read: %w", err)
+	}
+
+	return payload, nil
+}
+
+// reEncryptState - the reset of the brigade file for the new router and the new endpoint.
+func reEncryptState(id32 string, state []byte, opts MoveOpts, endpoint netip.Addr) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "movebrigade-")
+	if err != nil {
+		return nil, fmt.Errorf("temp dir: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, id32+".json")
+
+	if err := os.WriteFile(filename, state, 0o600); err != nil {
+		return nil, fmt.Errorf("write state: %w", err)
+	}
+
+	db, err := reset.Storage(id32, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := reset.Do(db, opts.RouterKey, opts.ShufflerKeys, endpoint); err != nil {
+		return nil, err
+	}
+
+	state, err = os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+
+	return state, nil
+}
+
+// moveRecord - switches the brigade and its domain to the new endpoint,
+// the old copy is recorded to be destroyed.
+func (c *Config) moveRecord(ctx context.Context, brigadeID string, b *brigadeRecord, pairID string, endpoint netip.Addr) error {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	if err := c.switchEndpoint(ctx, tx, brigadeID, b, pairID, endpoint); err != nil {
+		return err
+	}
+
+	if err := c.leftoverKeep(ctx, tx, brigadeID, b.controlIP); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+// switchEndpoint - the brigade and its domain are on the new endpoint, if the brigade is still on the old one.
+func (c *Config) switchEndpoint(ctx context.Context, tx pgx.Tx, brigadeID string, b *brigadeRecord, pairID string, endpoint netip.Addr) error {
+	tag, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlMoveBrigade, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		brigadeID, pairID, endpoint, b.endpointIPv4,
+	)
+	if err != nil {
+		return fmt.Errorf("brigade update: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrMoveConflict, brigadeID)
+	}
+
+	if b.domainName.Valid {
+		if _, err := tx.Exec(ctx,
+			fmt.Sprintf(sqlMoveDomain, pgx.Identifier{c.BrigadesSchema, "domains_endpoints_ipv4"}.Sanitize()),
+			b.domainName.String, endpoint,
+		); err != nil {
+			return fmt.Errorf("domain update: %w", err)
+		}
+	}
+
+	// The retiring domains of the brigade may still be used by the users configs.
+	if _, err := tx.Exec(ctx, fmt.Sprintf(sqlMoveRetiring, c.retiringTable()), brigadeID, endpoint); err != nil {
+		return fmt.Errorf("retiring domain update: %w", err)
+	}
+
+	return nil
+}
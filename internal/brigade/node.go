@@ -0,0 +1,68 @@
+package brigade
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Node API extensions. The base node commands (create, replace, destroy,
+// fetchstats, fetchsnaps) are served by every node, the extensions are used
+// only when they are listed in NODE_API_EXTENSIONS, i.e. the nodes are updated.
+const (
+	// NodeExtSuspend - suspend and unsuspend of the brigade.
+	NodeExtSuspend = "suspend"
+	// NodeExtMigrate - export and import of the keydesk brigade file.
+	// The imported brigade is up and not suspended. The import of the existing
+	// brigade replaces it only if the new one is up, the old one is kept on any failure.
+	NodeExtMigrate = "migrate"
+	// NodeExtSetDomain - the brigade domain change in the users configs.
+	NodeExtSetDomain = "setdomain"
+)
+
+var knownNodeExtensions = []string{NodeExtSuspend, NodeExtMigrate, NodeExtSetDomain}
+
+// ErrNodeUnsupported - the node API extension isn't enabled.
+var ErrNodeUnsupported = errors.New("node command is not supported")
+
+// NodeExtensions - the node API extensions served by the nodes.
+type NodeExtensions map[string]bool
+
+// ParseNodeExtensions - parses the comma separated list of the extensions.
+func ParseNodeExtensions(s string) (NodeExtensions, error) {
+	e := NodeExtensions{}
+
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			continue
+		}
+
+		known := false
+
+		for _, k := range knownNodeExtensions {
+			if ext == k {
+				known = true
+
+				break
+			}
+		}
+
+		if !known {
+			return nil, fmt.Errorf("unknown node extension: %s", ext)
+		}
+
+		e[ext] = true
+	}
+
+	return e, nil
+}
+
+// require - the operation needs the extension, it fails before any change.
+func (e NodeExtensions) require(ext string) error {
+	if !e[ext] {
+		return fmt.Errorf("%w: %s", ErrNodeUnsupported, ext)
+	}
+
+	return nil
+}
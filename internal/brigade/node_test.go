@@ -0,0 +1,51 @@
+package brigade
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseNodeExtensions(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", in: ""},
+		{name: "suspend", in: "suspend", want: []string{NodeExtSuspend}},
+		{name: "spaces", in: " suspend , ", want: []string{NodeExtSuspend}},
+		{name: "unknown", in: "suspend,teleport", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseNodeExtensions(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v, want error: %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if len(e) != len(tt.want) {
+				t.Fatalf("extensions: %v, want %v", e, tt.want)
+			}
+
+			for _, ext := range tt.want {
+				if err := e.require(ext); err != nil {
+					t.Errorf("require %s: %s", ext, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeExtensionsRequire(t *testing.T) {
+	var e NodeExtensions
+
+	if err := e.require(NodeExtSuspend); !errors.Is(err, ErrNodeUnsupported) {
+		t.Errorf("nil extensions: %v, want %v", err, ErrNodeUnsupported)
+	}
+}
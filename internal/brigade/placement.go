@@ -0,0 +1,309 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+// Placement policies names.
+const (
+	PlacementMostFree         = "most-free"
+	PlacementLeastActiveUsers = "least-active-users"
+	PlacementRoundRobin       = "round-robin"
+	PlacementLabels           = "labels"
+)
+
+var (
+	ErrUnknownPlacement = errors.New("unknown placement policy")
+	ErrNoLabels         = errors.New("no labels for the labels placement")
+)
+
+const (
+	sqlPickPairMostFree = `
+SELECT
+	pair_id,
+	free_slots_count
+FROM %s
+ORDER BY free_slots_count DESC, pair_id
+LIMIT 1
+`
+
+	sqlPickPairLeastActiveUsers = `
+SELECT
+	active_pairs.pair_id,
+	active_pairs.free_slots_count,
+	COALESCE(SUM(brigades_stats.active_users_count), 0)::bigint AS active_users
+FROM %s AS active_pairs
+	LEFT JOIN %s AS brigades ON brigades.pair_id = active_pairs.pair_id
+	LEFT JOIN %s AS brigades_stats ON brigades_stats.brigade_id = brigades.brigade_id
+GROUP BY active_pairs.pair_id, active_pairs.free_slots_count
+ORDER BY active_users ASC, active_pairs.free_slots_count DESC, active_pairs.pair_id
+LIMIT 1
+`
+
+	// The pair next to the pair of the last created brigade.
+	sqlPickPairRoundRobin = `
+WITH last AS (
+	SELECT
+		brigades.pair_id
+	FROM %s AS brigades
+		JOIN %s AS brigades_stats ON brigades_stats.brigade_id = brigades.brigade_id
+	ORDER BY brigades_stats.created_at DESC
+	LIMIT 1
+)
+SELECT
+	active_pairs.pair_id,
+	active_pairs.free_slots_count,
+	(SELECT pair_id FROM last)
+FROM %s AS active_pairs
+ORDER BY
+	active_pairs.pair_id <= COALESCE((SELECT pair_id FROM last), '00000000-0000-0000-0000-000000000000'::uuid),
+	active_pairs.pair_id
+LIMIT 1
+`
+
+	sqlPickPairLabels = `
+SELECT
+	active_pairs.pair_id,
+	active_pairs.free_slots_count,
+	pairs.labels
+FROM %s AS active_pairs
+	JOIN %s AS pairs ON pairs.pair_id = active_pairs.pair_id
+WHERE
+	pairs.labels @> $1::text[]
+ORDER BY active_pairs.free_slots_count DESC, active_pairs.pair_id
+LIMIT 1
+`
+
+	sqlPickPairForcedIP = `
+SELECT
+	pair_id,
+	control_ip,
+	endpoint_ipv4,
+	domain_name
+FROM %s
+WHERE
+	control_ip=$1
+ORDER BY domain_name NULLS LAST
+LIMIT 1
+`
+
+	sqlPickPairSlot = `
+SELECT
+	pair_id,
+	control_ip,
+	endpoint_ipv4,
+	domain_name
+FROM %s
+WHERE
+	pair_id = $1
+ORDER BY domain_name NULLS LAST
+LIMIT 1
+`
+)
+
+// PairSlot - free endpoint of the pair.
+type PairSlot struct {
+	PairID       string
+	ControlIP    netip.Addr
+	EndpointIPv4 netip.Addr
+	DomainName   pgtype.Text
+
+	// Placement - policy name and the reason of the choice.
+	Placement string
+	Reason    string
+}
+
+// Placement - policy which chooses the pair for the new brigade.
+type Placement interface {
+	// Name - policy name to log.
+	Name() string
+	// Pick - picks up the pair, returns the reason of the choice.
+	Pick(ctx context.Context, tx pgx.Tx, c *Config) (string, string, error)
+}
+
+// NewPlacement - returns the placement policy by name.
+func NewPlacement(name string, labels []string) (Placement, error) {
+	switch name {
+	case "", PlacementMostFree:
+		return mostFree{}, nil
+	case PlacementLeastActiveUsers:
+		return leastActiveUsers{}, nil
+	case PlacementRoundRobin:
+		return roundRobin{}, nil
+	case PlacementLabels:
+		if len(labels) == 0 {
+			return nil, ErrNoLabels
+		}
+
+		return byLabels{labels: labels}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPlacement, name)
+	}
+}
+
+// ParseLabels - comma separated labels list.
+func ParseLabels(s string) []string {
+	var labels []string
+
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+
+	return labels
+}
+
+type mostFree struct{}
+
+func (mostFree) Name() string { return PlacementMostFree }
+
+func (mostFree) Pick(ctx context.Context, tx pgx.Tx, c *Config) (string, string, error) {
+	var (
+		pairID string
+		free   int64
+	)
+
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlPickPairMostFree, pgx.Identifier{c.BrigadesSchema, "active_pairs"}.Sanitize()),
+	).Scan(&pairID, &free); err != nil {
+		return "", "", fmt.Errorf("most free query: %w", err)
+	}
+
+	return pairID, fmt.Sprintf("most free slots: %d", free), nil
+}
+
+type leastActiveUsers struct{}
+
+func (leastActiveUsers) Name() string { return PlacementLeastActiveUsers }
+
+func (leastActiveUsers) Pick(ctx context.Context, tx pgx.Tx, c *Config) (string, string, error) {
+	var (
+		pairID string
+		free   int64
+		active int64
+	)
+
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlPickPairLeastActiveUsers,
+			pgx.Identifier{c.BrigadesSchema, "active_pairs"}.Sanitize(),
+			pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(),
+			pgx.Identifier{c.BrigadesStatsSchema, "brigades_stats"}.Sanitize(),
+		),
+	).Scan(&pairID, &free, &active); err != nil {
+		return "", "", fmt.Errorf("least active users query: %w", err)
+	}
+
+	return pairID, fmt.Sprintf("least active users: %d, free slots: %d", active, free), nil
+}
+
+type roundRobin struct{}
+
+func (roundRobin) Name() string { return PlacementRoundRobin }
+
+func (roundRobin) Pick(ctx context.Context, tx pgx.Tx, c *Config) (string, string, error) {
+	var (
+		pairID string
+		free   int64
+		last   pgtype.Text
+	)
+
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlPickPairRoundRobin,
+			pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(),
+			pgx.Identifier{c.BrigadesStatsSchema, "brigades_stats"}.Sanitize(),
+			pgx.Identifier{c.BrigadesSchema, "active_pairs"}.Sanitize(),
+		),
+	).Scan(&pairID, &free, &last); err != nil {
+		return "", "", fmt.Errorf("round robin query: %w", err)
+	}
+
+	if !last.Valid {
+		return pairID, fmt.Sprintf("first pair, free slots: %d", free), nil
+	}
+
+	return pairID, fmt.Sprintf("next to the last used pair %s, free slots: %d", last.String, free), nil
+}
+
+type byLabels struct {
+	labels []string
+}
+
+func (byLabels) Name() string { return PlacementLabels }
+
+func (p byLabels) Pick(ctx context.Context, tx pgx.Tx, c *Config) (string, string, error) {
+	var (
+		pairID string
+		free   int64
+		labels []string
+	)
+
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlPickPairLabels,
+			pgx.Identifier{c.BrigadesSchema, "active_pairs"}.Sanitize(),
+			pgx.Identifier{c.PairsSchema, "pairs"}.Sanitize(),
+		),
+		p.labels,
+	).Scan(&pairID, &free, &labels); err != nil {
+		return "", "", fmt.Errorf("labels query: %v: %w", p.labels, err)
+	}
+
+	return pairID, fmt.Sprintf("labels %v match %v, free slots: %d", p.labels, labels, free), nil
+}
+
+// pickSlot - picks up the pair by the policy and the free endpoint on it,
+// endpoints with domains are preferred.
+func (c *Config) pickSlot(ctx context.Context, tx pgx.Tx, forceIP netip.Addr) (*PairSlot, error) {
+	s := &PairSlot{}
+
+	if forceIP.IsValid() {
+		if err := tx.QueryRow(
+			ctx,
+			fmt.Sprintf(
+				sqlPickPairForcedIP,
+				pgx.Identifier{c.BrigadesSchema, "slots"}.Sanitize()),
+			forceIP.String(),
+		).Scan(&s.PairID, &s.ControlIP, &s.EndpointIPv4, &s.DomainName); err != nil {
+			return nil, fmt.Errorf("pair query: %w", err)
+		}
+
+		s.Placement, s.Reason = "forced", "control ip "+forceIP.String()
+
+		logging.FromContext(ctx).Info("placement", "policy", s.Placement, logging.KeyPair, s.PairID, "reason", s.Reason)
+
+		return s, nil
+	}
+
+	placement := c.Placement
+	if placement == nil {
+		placement = mostFree{}
+	}
+
+	pairID, reason, err := placement.Pick(ctx, tx, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", placement.Name(), err)
+	}
+
+	if err := tx.QueryRow(
+		ctx,
+		fmt.Sprintf(sqlPickPairSlot, pgx.Identifier{c.BrigadesSchema, "slots"}.Sanitize()),
+		pairID,
+	).Scan(&s.PairID, &s.ControlIP, &s.EndpointIPv4, &s.DomainName); err != nil {
+		return nil, fmt.Errorf("slot query: %w", err)
+	}
+
+	s.Placement, s.Reason = placement.Name(), reason
+
+	logging.FromContext(ctx).Info("placement", "policy", s.Placement, logging.KeyPair, s.PairID, "reason", s.Reason)
+
+	return s, nil
+}
@@ -0,0 +1,87 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/jackc/pgx/v5"
+
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+)
+
+// Subdomain decisions.
+const (
+	// SubdomainEndpoint - the endpoint already has a domain.
+	SubdomainEndpoint = "endpoint"
+	// SubdomainPick - a new subdomain would be picked up from the subdomain API.
+	SubdomainPick = "pick"
+	// SubdomainSkip - the subdomain API is disabled.
+	SubdomainSkip = "skip"
+)
+
+var ErrBrigadeExists = errors.New("brigade exists")
+
+// Allocation - the pair, the endpoint and the addresses picked up for the brigade.
+type Allocation struct {
+	Placement     string       `json:"placement"`
+	Reason        string       `json:"reason"`
+	PairID        string       `json:"pair_id"`
+	ControlIP     netip.Addr   `json:"control_ip"`
+	EndpointIPv4  netip.Addr   `json:"endpoint_ipv4"`
+	Domain        string       `json:"domain,omitempty"`
+	CGNATWindow   netip.Prefix `json:"ipv4_cgnat_window"`
+	CGNAT         netip.Prefix `json:"ipv4_cgnat"`
+	ULAWindow     netip.Prefix `json:"ipv6_ula_window"`
+	ULA           netip.Prefix `json:"ipv6_ula"`
+	KeydeskWindow netip.Prefix `json:"keydesk_ipv6_window"`
+	KeydeskIPv6   netip.Addr   `json:"keydesk_ipv6"`
+}
+
+// Plan - what Create would do for the brigade.
+type Plan struct {
+	BrigadeID string `json:"brigade_id"`
+	Allocation
+	Subdomain string `json:"subdomain"`
+}
+
+// MakePlan - runs the brigade allocation inside a rolled back transaction.
+// Nothing is stored, the node, the subdomain API and the delegation servers are not touched.
+func MakePlan(ctx context.Context, c *Config, opts *Opts) (*Plan, error) {
+	if _, err := c.fetchBrigade(ctx, opts.ID); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrBrigadeExists, opts.ID)
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	a, err := c.pickAllocation(ctx, tx, opts.ForceIP)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the allocation against the schema constraints too.
+	if err := c.insertBrigade(ctx, tx, opts.ID, opts.Name, opts.Person, a); err != nil {
+		return nil, err
+	}
+
+	p := &Plan{BrigadeID: opts.ID, Allocation: *a}
+
+	switch {
+	case a.Domain != "":
+		p.Subdomain = SubdomainEndpoint
+	case c.SubdomainAPIToken == dcmgmtlib.NoUseSubdomainAPIToken:
+		p.Subdomain = SubdomainSkip
+	default:
+		p.Subdomain = SubdomainPick
+	}
+
+	return p, nil
+}
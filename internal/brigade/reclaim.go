@@ -0,0 +1,512 @@
+package brigade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const defaultReclaimListLimit = 20
+
+// Reclaim run states.
+const (
+	ReclaimStateRunning = "running"
+	ReclaimStateDone    = "done"
+)
+
+// Reclaim item states.
+const (
+	ReclaimItemPending = "pending"
+	ReclaimItemDone    = "done"
+	ReclaimItemSkipped = "skipped"
+	ReclaimItemFailed  = "failed"
+)
+
+const (
+	sqlReclaimRunInsert = `
+INSERT INTO %s
+	(params, op_id)
+VALUES
+	($1, $2)
+RETURNING
+	run_id, state, created_at, update_time
+`
+
+	sqlReclaimItemInsert = `INSERT INTO %s (run_id, brigade_id) VALUES ($1, $2)`
+
+	sqlReclaimRunFetch = `SELECT run_id, params, state, op_id, created_at, update_time FROM %s WHERE run_id=$1`
+
+	sqlReclaimRunList = `
+SELECT
+	run_id, params, state, op_id, created_at, update_time
+FROM %s
+ORDER BY run_id DESC
+LIMIT $1
+`
+
+	sqlReclaimRunActive = `SELECT run_id FROM %s WHERE state='running' ORDER BY run_id LIMIT 1`
+
+	sqlReclaimRunState = `UPDATE %s SET state=$2, update_time=now() WHERE run_id=$1`
+
+	// sqlReclaimRunLock - the run is processed by one call, the other ones skip it.
+	sqlReclaimRunLock = `SELECT run_id FROM %s WHERE run_id=$1 FOR UPDATE SKIP LOCKED`
+
+	sqlReclaimItems = `
+SELECT
+	i.brigade_id,
+	COALESCE(host(m.control_ip), ''),
+	i.state,
+	i.error,
+	i.update_time
+FROM %s AS i
+	LEFT JOIN %s AS m ON m.brigade_id = i.brigade_id
+WHERE
+	i.run_id = $1
+ORDER BY i.brigade_id
+`
+
+	sqlReclaimItemState = `UPDATE %s SET state=$3, error=$4, update_time=now() WHERE run_id=$1 AND brigade_id=$2`
+
+	sqlReclaimItemsRetry = `UPDATE %s SET state='pending', error='', update_time=now() WHERE run_id=$1 AND state='failed'`
+)
+
+var (
+	ErrReclaimRunning  = errors.New("reclaim run is not finished")
+	ErrReclaimBusy     = errors.New("reclaim run is processed by another call")
+	ErrReclaimNotFound = errors.New("reclaim run not found")
+	ErrReclaimGone     = errors.New("brigade is gone")
+)
+
+// ReclaimParams - the reclaim run parameters, the selection number is the run cap.
+type ReclaimParams struct {
+	kdlib.WastedParams
+
+	// Rate - max deletions per minute for the whole run, unlimited if zero.
+	Rate int `json:"rate,omitempty"`
+}
+
+// ReclaimItem - the brigade selected by the run.
+type ReclaimItem struct {
+	BrigadeID  string    `json:"brigade_id"`
+	ControlIP  string    `json:"control_ip,omitempty"`
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+// ReclaimCounts - the run items by the states.
+type ReclaimCounts struct {
+	Total   int `json:"total"`
+	Pending int `json:"pending"`
+	Done    int `json:"done"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// ReclaimRun - the report of the reclaim run.
+type ReclaimRun struct {
+	RunID      int64          `json:"run_id"`
+	Params     ReclaimParams  `json:"params"`
+	State      string         `json:"state"`
+	OpID       string         `json:"op_id,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdateTime time.Time      `json:"update_time"`
+	Counts     ReclaimCounts  `json:"counts"`
+	Items      []*ReclaimItem `json:"items,omitempty"`
+}
+
+func (c *Config) reclaimRunsTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "reclaim_runs"}.Sanitize()
+}
+
+func (c *Config) reclaimItemsTable() string {
+	return pgx.Identifier{c.BrigadesSchema, "reclaim_items"}.Sanitize()
+}
+
+// StartReclaim - selects the wasted brigades, records the run and deletes them.
+// Only one run is processed at a time, the unfinished one must be resumed first,
+// the database refuses the second running one.
+func StartReclaim(ctx context.Context, c *Config, p ReclaimParams) (*ReclaimRun, error) {
+	var active int64
+
+	err := c.DB.QueryRow(ctx, fmt.Sprintf(sqlReclaimRunActive, c.reclaimRunsTable())).Scan(&active)
+	switch {
+	case err == nil:
+		return nil, fmt.Errorf("%w: %d", ErrReclaimRunning, active)
+	case !errors.Is(err, pgx.ErrNoRows):
+		return nil, fmt.Errorf("active run query: %w", err)
+	}
+
+	ids, err := kdlib.SelectWasted(ctx, c.DB, c.BrigadesSchema, c.BrigadesStatsSchema, p.WastedParams)
+	if err != nil {
+		return nil, fmt.Errorf("select: %w", err)
+	}
+
+	run, err := c.reclaimBegin(ctx, p, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Info("reclaim run is started", "run_id", run.RunID, "selector", p.Selector, "brigades", len(ids))
+
+	return c.reclaim(ctx, run, false)
+}
+
+// ResumeReclaim - deletes the pending brigades of the interrupted run,
+// the failed ones are retried if the retry is set.
+func ResumeReclaim(ctx context.Context, c *Config, runID int64, retry bool) (*ReclaimRun, error) {
+	run, err := c.fetchReclaim(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Info("reclaim run is resumed", "run_id", runID)
+
+	return c.reclaim(ctx, run, retry)
+}
+
+// FetchReclaim - the report of the run.
+func FetchReclaim(ctx context.Context, c *Config, runID int64) (*ReclaimRun, error) {
+	run, err := c.fetchReclaim(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.reclaimItems(ctx, run); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// ListReclaims - the last runs without the items.
+func ListReclaims(ctx context.Context, c *Config, limit int) ([]*ReclaimRun, error) {
+	if limit <= 0 {
+		limit = defaultReclaimListLimit
+	}
+
+	rows, err := c.DB.Query(ctx, fmt.Sprintf(sqlReclaimRunList, c.reclaimRunsTable()), limit)
+	if err != nil {
+		return nil, fmt.Errorf("runs query: %w", err)
+	}
+
+	defer rows.Close()
+
+	var list []*ReclaimRun
+
+	for rows.Next() {
+		run, err := scanReclaimRun(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, run)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("runs rows: %w", err)
+	}
+
+	return list, nil
+}
+
+func scanReclaimRun(row pgx.Row) (*ReclaimRun, error) {
+	var (
+		run    ReclaimRun
+		params []byte
+	)
+
+	if err := row.Scan(&run.RunID, &params, &run.State, &run.OpID, &run.CreatedAt, &run.UpdateTime); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(params, &run.Params); err != nil {
+		return nil, fmt.Errorf("params: %w", err)
+	}
+
+	return &run, nil
+}
+
+func (c *Config) fetchReclaim(ctx context.Context, runID int64) (*ReclaimRun, error) {
+	run, err := scanReclaimRun(c.DB.QueryRow(ctx, fmt.Sprintf(sqlReclaimRunFetch, c.reclaimRunsTable()), runID))
+	switch {
+	case err == nil:
+		return run, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, fmt.Errorf("%w: %d", ErrReclaimNotFound, runID)
+	default:
+		return nil, fmt.Errorf("run query: %w", err)
+	}
+}
+
+// reclaimBegin - records the run with all the selected brigades as pending.
+func (c *Config) reclaimBegin(ctx context.Context, p ReclaimParams, ids []string) (*ReclaimRun, error) {
+	params, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("params: %w", err)
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	run := &ReclaimRun{Params: p, OpID: logging.OpID()}
+
+	err = tx.QueryRow(ctx,
+		fmt.Sprintf(sqlReclaimRunInsert, c.reclaimRunsTable()),
+		params, run.OpID,
+	).Scan(&run.RunID, &run.State, &run.CreatedAt, &run.UpdateTime)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			return nil, fmt.Errorf("run insert: %w", ErrReclaimRunning)
+		}
+
+		return nil, fmt.Errorf("run insert: %w", err)
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(sqlReclaimItemInsert, c.reclaimItemsTable()), run.RunID, id); err != nil {
+			return nil, fmt.Errorf("item insert: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+
+	return run, nil
+}
+
+// reclaimItems - loads the run items and counts them.
+func (c *Config) reclaimItems(ctx context.Context, run *ReclaimRun) error {
+	rows, err := c.DB.Query(ctx,
+		fmt.Sprintf(sqlReclaimItems,
+			c.reclaimItemsTable(),
+			pgx.Identifier{c.BrigadesSchema, "meta_brigades"}.Sanitize(),
+		),
+		run.RunID,
+	)
+	if err != nil {
+		return fmt.Errorf("items query: %w", err)
+	}
+
+	defer rows.Close()
+
+	run.Items = nil
+	run.Counts = ReclaimCounts{}
+
+	for rows.Next() {
+		var item ReclaimItem
+
+		if err := rows.Scan(&item.BrigadeID, &item.ControlIP, &item.State, &item.Error, &item.UpdateTime); err != nil {
+			return fmt.Errorf("item row: %w", err)
+		}
+
+		run.Items = append(run.Items, &item)
+		run.Counts.add(item.State)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("items rows: %w", err)
+	}
+
+	return nil
+}
+
+func (rc *ReclaimCounts) add(state string) {
+	rc.Total++
+
+	switch state {
+	case ReclaimItemPending:
+		rc.Pending++
+	case ReclaimItemDone:
+		rc.Done++
+	case ReclaimItemSkipped:
+		rc.Skipped++
+	case ReclaimItemFailed:
+		rc.Failed++
+	}
+}
+
+// reclaim - deletes the pending brigades of the run, the pairs are in parallel,
+// the brigades of the pair are one by one. The rate limit is shared by all the pairs.
+// Every item state is saved at once, so the interrupted run is resumed from the pending items.
+// The run is done when nothing is pending. The run row is locked for the whole processing,
+// so the concurrent resume is refused instead of deleting the same brigades.
+func (c *Config) reclaim(ctx context.Context, run *ReclaimRun, retry bool) (*ReclaimRun, error) {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	var runID int64
+
+	err = tx.QueryRow(ctx, fmt.Sprintf(sqlReclaimRunLock, c.reclaimRunsTable()), run.RunID).Scan(&runID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, fmt.Errorf("%w: %d", ErrReclaimBusy, run.RunID)
+	case err != nil:
+		return nil, fmt.Errorf("run lock: %w", err)
+	}
+
+	if retry {
+		tag, err := tx.Exec(ctx, fmt.Sprintf(sqlReclaimItemsRetry, c.reclaimItemsTable()), run.RunID)
+		if err != nil {
+			return nil, fmt.Errorf("retry items: %w", err)
+		}
+
+		// The retried run is running again, it's refused while another one is.
+		if tag.RowsAffected() > 0 && run.State == ReclaimStateDone {
+			if _, err := tx.Exec(ctx, fmt.Sprintf(sqlReclaimRunState, c.reclaimRunsTable()), run.RunID, ReclaimStateRunning); err != nil {
+				var pgErr *pgconn.PgError
+				if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+					return nil, fmt.Errorf("run state: %w", ErrReclaimRunning)
+				}
+
+				return nil, fmt.Errorf("run state: %w", err)
+			}
+
+			run.State = ReclaimStateRunning
+		}
+
+		// The items are visible to the deletions out of the transaction.
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("commit: %w", err)
+		}
+
+		return c.reclaim(ctx, run, false)
+	}
+
+	if err := c.reclaimItems(ctx, run); err != nil {
+		return nil, err
+	}
+
+	pairs := make(map[string][]*ReclaimItem)
+
+	for _, item := range run.Items {
+		if item.State != ReclaimItemPending {
+			continue
+		}
+
+		if item.ControlIP == "" {
+			c.reclaimItemState(ctx, run, item, ReclaimItemSkipped, ErrReclaimGone)
+
+			continue
+		}
+
+		pairs[item.ControlIP] = append(pairs[item.ControlIP], item)
+	}
+
+	var tick <-chan time.Time
+
+	if run.Params.Rate > 0 {
+		ticker := time.NewTicker(time.Minute / time.Duration(run.Params.Rate))
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	reason := fmt.Sprintf("reclaim %s run %d", run.Params.Selector, run.RunID)
+
+	wg := &sync.WaitGroup{}
+
+	for controlIP, items := range pairs {
+		wg.Add(1)
+
+		go func(controlIP string, items []*ReclaimItem) {
+			defer wg.Done()
+
+			logging.FromContext(ctx).Info("reclaim", logging.KeyControlIP, controlIP, "brigades", len(items))
+
+			for _, item := range items {
+				if tick != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tick:
+					}
+				}
+
+				if ctx.Err() != nil {
+					return
+				}
+
+				if _, err := Delete(ctx, c, item.BrigadeID, reason); err != nil {
+					c.reclaimItemState(ctx, run, item, ReclaimItemFailed, err)
+
+					continue
+				}
+
+				c.reclaimItemState(ctx, run, item, ReclaimItemDone, nil)
+			}
+		}(controlIP, items)
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("reclaim run %d is interrupted: %w", run.RunID, err)
+	}
+
+	if err := c.reclaimItems(ctx, run); err != nil {
+		return nil, err
+	}
+
+	if run.Counts.Pending == 0 {
+		// The run row is locked by this transaction.
+		if _, err := tx.Exec(ctx, fmt.Sprintf(sqlReclaimRunState, c.reclaimRunsTable()), run.RunID, ReclaimStateDone); err != nil {
+			return nil, fmt.Errorf("run state: %w", err)
+		}
+
+		run.State = ReclaimStateDone
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("reclaim run is finished",
+		"run_id", run.RunID,
+		"done", run.Counts.Done,
+		"skipped", run.Counts.Skipped,
+		"failed", run.Counts.Failed,
+		"pending", run.Counts.Pending,
+	)
+
+	return run, nil
+}
+
+// reclaimItemState - saves the item outcome, the save error leaves the item pending.
+func (c *Config) reclaimItemState(ctx context.Context, run *ReclaimRun, item *ReclaimItem, state string, cause error) {
+	var msg string
+
+	ctx = brigadeContext(ctx, item.BrigadeID)
+
+	if cause != nil {
+		msg = cause.Error()
+
+		logging.FromContext(ctx).Warn("reclaim item", "state", state, logging.KeyError, cause)
+	}
+
+	if _, err := c.DB.Exec(ctx,
+		fmt.Sprintf(sqlReclaimItemState, c.reclaimItemsTable()),
+		run.RunID, item.BrigadeID, state, msg,
+	); err != nil {
+		logging.FromContext(ctx).Error("reclaim item state", logging.KeyError, err)
+	}
+}
@@ -0,0 +1,25 @@
+package brigade
+
+import "testing"
+
+func TestReclaimCounts(t *testing.T) {
+	states := []string{
+		ReclaimItemPending,
+		ReclaimItemDone,
+		ReclaimItemDone,
+		ReclaimItemSkipped,
+		ReclaimItemFailed,
+		"unknown",
+	}
+
+	var rc ReclaimCounts
+
+	for _, state := range states {
+		rc.add(state)
+	}
+
+	want := ReclaimCounts{Total: 6, Pending: 1, Done: 2, Skipped: 1, Failed: 1}
+	if rc != want {
+		t.Errorf("counts: %+v, want %+v", rc, want)
+	}
+}
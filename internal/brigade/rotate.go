@@ -0,0 +1,284 @@
+package brigade
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/vpngine/naclkey"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	sqlQuarantineInsert = `
+INSERT INTO %s
+	(endpoint_ipv4, brigade_id, reason, op_id)
+VALUES
+	($1, $2, $3, $4)
+`
+
+	sqlQuarantineList = `
+SELECT
+	q.endpoint_ipv4,
+	pe.pair_id,
+	COALESCE(q.brigade_id::text, ''),
+	q.reason,
+	q.quarantined_at,
+	q.op_id
+FROM %s AS q
+	JOIN %s AS pe ON pe.endpoint_ipv4 = q.endpoint_ipv4
+ORDER BY q.quarantined_at DESC
+`
+
+	sqlQuarantineRelease = `DELETE FROM %s WHERE endpoint_ipv4=$1`
+)
+
+var ErrNotQuarantined = errors.New("endpoint is not quarantined")
+
+// RotateOpts - the old endpoint fate and the keys to re-encrypt the brigade secrets.
+type RotateOpts struct {
+	// Quarantine - the old endpoint isn't given to the brigades until released.
+	Quarantine bool
+	Reason     string
+
+	RouterKey    *[naclkey.NaclBoxKeyLength]byte
+	ShufflerKeys *naclkey.NaclBoxKeypair
+}
+
+// RotateResult - the brigade on the new endpoint.
+type RotateResult struct {
+	BrigadeID    string     `json:"brigade_id"`
+	ControlIP    netip.Addr `json:"control_ip"`
+	FromEndpoint netip.Addr `json:"from_endpoint_ipv4"`
+	ToEndpoint   netip.Addr `json:"to_endpoint_ipv4"`
+	Domain       string     `json:"domain,omitempty"`
+	Quarantined  bool       `json:"quarantined"`
+	Warning      string     `json:"warning,omitempty"`
+}
+
+// Quarantined - the quarantined endpoint.
+type Quarantined struct {
+	EndpointIPv4  netip.Addr `json:"endpoint_ipv4"`
+	PairID        string     `json:"pair_id"`
+	BrigadeID     string     `json:"brigade_id,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	QuarantinedAt time.Time  `json:"quarantined_at"`
+	OpID          string     `json:"op_id,omitempty"`
+}
+
+// Rotate - moves the brigade to the free endpoint of the same pair.
+// The brigade is suspended, so nothing is changed after the export, its state
+// is re-encrypted with the new endpoint and imported over the old one, the node
+// keeps the old one if the import fails. The old state is imported back on any failure
+// before the database is switched. Then the lists are synced so the domain follows.
+func Rotate(ctx context.Context, c *Config, brigadeID string, opts RotateOpts) (*RotateResult, error) {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	if err := c.NodeExtensions.require(NodeExtMigrate); err != nil {
+		return nil, err
+	}
+
+	if err := c.NodeExtensions.require(NodeExtSuspend); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkNotDeleted(ctx, brigadeID); err != nil {
+		return nil, err
+	}
+
+	b, err := c.fetchBrigade(ctx, brigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	var pairID string
+
+	if err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlCheckPair, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		brigadeID,
+	).Scan(&pairID); err != nil {
+		return nil, fmt.Errorf("pair query: %w", err)
+	}
+
+	endpoint, err := c.movePickEndpoint(ctx, pairID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RotateResult{
+		BrigadeID:    brigadeID,
+		ControlIP:    b.controlIP,
+		FromEndpoint: b.endpointIPv4,
+		ToEndpoint:   endpoint,
+		Domain:       b.domainName.String,
+	}
+
+	log := logging.FromContext(ctx)
+
+	log.Info("rotate endpoint", "from", b.endpointIPv4, "to", endpoint)
+
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeSuspendCmd, b.id32())); err != nil {
+		return nil, c.rotateResume(ctx, b, fmt.Errorf("suspend: %w", err))
+	}
+
+	oldState, err := c.exportFromNode(ctx, b)
+	if err != nil {
+		return nil, c.rotateResume(ctx, b, fmt.Errorf("export: %w", err))
+	}
+
+	state, err := reEncryptState(b.id32(), oldState, MoveOpts{RouterKey: opts.RouterKey, ShufflerKeys: opts.ShufflerKeys}, endpoint)
+	if err != nil {
+		return nil, c.rotateResume(ctx, b, fmt.Errorf("re-encrypt: %w", err))
+	}
+
+	if err := c.importOnNode(ctx, b, state); err != nil {
+		return nil, c.rotateResume(ctx, b, err)
+	}
+
+	if _, err := c.nodeStats(ctx, b.controlIP, b.id32()); err != nil {
+		return nil, c.restoreOnNode(ctx, b, oldState, fmt.Errorf("verify: %w", err))
+	}
+
+	if err := c.rotateRecord(ctx, brigadeID, b, pairID, endpoint, opts); err != nil {
+		return nil, c.restoreOnNode(ctx, b, oldState, err)
+	}
+
+	res.Quarantined = opts.Quarantine
+
+	log.Info("brigade endpoint is rotated in the database, sync lists", "quarantine", opts.Quarantine)
+
+	if err := c.syncLists(ctx); err != nil {
+		res.Warning = fmt.Sprintf("sync lists: %s", err)
+
+		log.Warn("can't sync lists", logging.KeyError, err)
+
+		return res, nil
+	}
+
+	if !c.AsyncDelegation && !c.waitForAllDelegations(ctx, b.keydeskIPv6, b.domainName.String, endpoint) {
+		res.Warning = "delegation is not confirmed"
+
+		log.Warn("delegation is not confirmed")
+	}
+
+	return res, nil
+}
+
+// importOnNode - the brigade is replaced with the state, the old one is kept on failure.
+func (c *Config) importOnNode(ctx context.Context, b *brigadeRecord, state []byte) error {
+	if _, err := c.runOnNodeInput(ctx, b.controlIP, fmt.Sprintf(nodeImportCmd, b.id32()), bytes.NewReader(state)); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	return nil
+}
+
+// rotateResume - the brigade is still the old one, it's resumed.
+func (c *Config) rotateResume(ctx context.Context, b *brigadeRecord, cause error) error {
+	if _, err := c.runOnNode(ctx, b.controlIP, fmt.Sprintf(nodeUnsuspendCmd, b.id32())); err != nil {
+		logging.FromContext(ctx).Error("can't resume the brigade on the node", logging.KeyControlIP, b.controlIP, logging.KeyError, err)
+
+		return errors.Join(cause, fmt.Errorf("unsuspend: %w", err))
+	}
+
+	return cause
+}
+
+// restoreOnNode - imports the old state back, the imported brigade is up.
+func (c *Config) restoreOnNode(ctx context.Context, b *brigadeRecord, oldState []byte, cause error) error {
+	if err := c.importOnNode(ctx, b, oldState); err != nil {
+		logging.FromContext(ctx).Error("can't restore the brigade on the node", logging.KeyControlIP, b.controlIP, logging.KeyError, err)
+
+		return errors.Join(cause, fmt.Errorf("restore: %w", err))
+	}
+
+	return cause
+}
+
+// rotateRecord - switches the brigade and its domain to the new endpoint
+// and quarantines the old one if asked.
+func (c *Config) rotateRecord(ctx context.Context, brigadeID string, b *brigadeRecord, pairID string, endpoint netip.Addr, opts RotateOpts) error {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	if err := c.switchEndpoint(ctx, tx, brigadeID, b, pairID, endpoint); err != nil {
+		return err
+	}
+
+	if opts.Quarantine {
+		if _, err := tx.Exec(ctx,
+			fmt.Sprintf(sqlQuarantineInsert, c.quarantineTable()),
+			b.endpointIPv4, brigadeID, opts.Reason, logging.OpID(),
+		); err != nil {
+			return fmt.Errorf("quarantine insert: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) quarantineTable() string {
+	return pgx.Identifier{c.PairsSchema, "endpoints_quarantine"}.Sanitize()
+}
+
+// ListQuarantined - the quarantined endpoints, the last first.
+func ListQuarantined(ctx context.Context, c *Config) ([]*Quarantined, error) {
+	rows, err := c.DB.Query(ctx,
+		fmt.Sprintf(sqlQuarantineList,
+			c.quarantineTable(),
+			pgx.Identifier{c.PairsSchema, "pairs_endpoints_ipv4"}.Sanitize(),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("quarantine query: %w", err)
+	}
+
+	defer rows.Close()
+
+	list := []*Quarantined{}
+
+	for rows.Next() {
+		var q Quarantined
+
+		if err := rows.Scan(&q.EndpointIPv4, &q.PairID, &q.BrigadeID, &q.Reason, &q.QuarantinedAt, &q.OpID); err != nil {
+			return nil, fmt.Errorf("quarantine row: %w", err)
+		}
+
+		list = append(list, &q)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("quarantine rows: %w", err)
+	}
+
+	return list, nil
+}
+
+// ReleaseQuarantined - the endpoint is free for the brigades again.
+func ReleaseQuarantined(ctx context.Context, c *Config, endpoint netip.Addr) error {
+	tag, err := c.DB.Exec(ctx, fmt.Sprintf(sqlQuarantineRelease, c.quarantineTable()), endpoint)
+	if err != nil {
+		return fmt.Errorf("quarantine delete: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrNotQuarantined, endpoint)
+	}
+
+	logging.FromContext(ctx).Info("endpoint is released", "endpoint_ipv4", endpoint)
+
+	return nil
+}
@@ -0,0 +1,442 @@
+package brigade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vpngen/keydesk/gen/models"
+	"github.com/vpngen/keydesk/keydesk"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+var (
+	ErrNoNodeAnswer    = errors.New("no node answer")
+	ErrBrigadeMismatch = errors.New("brigade exists with another name or person")
+)
+
+// Result - created brigade.
+type Result struct {
+	Configs     models.Newuser
+	KeydeskIPv6 netip.Addr
+	FreeSlots   int32
+
+	// Delegation - pending if the brigade is created without waiting for the delegation.
+	Delegation string
+}
+
+// Create - creates the brigade step by step, every step is recorded in the journal.
+// If a step fails the done steps are compensated in the reverse order.
+// The repeated request for the same brigade gets the same answer,
+// a partially created brigade is resumed from the step where it stopped.
+func Create(ctx context.Context, c *Config, opts *Opts) (*Result, error) {
+	return c.create(brigadeContext(ctx, opts.ID), opts)
+}
+
+func (c *Config) create(ctx context.Context, opts *Opts) (*Result, error) {
+	if err := c.journalExpireAnswers(ctx); err != nil {
+		return nil, err
+	}
+
+	// The deleted brigade is suspended, it's restored by Undelete only.
+	if err := c.checkNotDeleted(ctx, opts.ID); err != nil {
+		return nil, err
+	}
+
+	j, err := FetchJournal(ctx, c, opts.ID)
+	switch {
+	case err == nil:
+		return c.repeat(ctx, j, opts)
+	case !errors.Is(err, ErrJournalNotFound):
+		return nil, err
+	}
+
+	// The brigade might be created before the journal was introduced.
+	if _, err := c.fetchBrigade(ctx, opts.ID); err == nil {
+		return c.adopt(ctx, opts)
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	j, err = c.journalBegin(ctx, OperationCreate, opts)
+	if err != nil {
+		if errors.Is(err, ErrJournalExists) {
+			return nil, fmt.Errorf("%w: %s", ErrJournalBusy, opts.ID)
+		}
+
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+
+	return c.run(ctx, j)
+}
+
+// Actions on the repeated request for the journaled brigade.
+const (
+	repeatAnswer = iota // the brigade is created, reply with the kept answer
+	repeatBusy          // someone is creating the brigade right now
+	repeatResume        // the creation is abandoned, take it over
+)
+
+// repeatAction - what to do with the repeated request.
+func (j *Journal) repeatAction(opts *Opts) (int, error) {
+	switch {
+	case !j.Same(opts):
+		return 0, fmt.Errorf("%w: %s", ErrBrigadeMismatch, j.BrigadeID)
+	case j.State == JournalStateDone:
+		return repeatAnswer, nil
+	case !j.Stale():
+		return repeatBusy, nil
+	}
+
+	return repeatResume, nil
+}
+
+// repeat - handles the repeated request for the journaled brigade.
+func (c *Config) repeat(ctx context.Context, j *Journal, opts *Opts) (*Result, error) {
+	action, err := j.repeatAction(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case repeatAnswer:
+		res, err := c.result(ctx, j)
+		if errors.Is(err, ErrNoNodeAnswer) {
+			logging.FromContext(ctx).Info("brigade is already created, the answer is expired")
+
+			res, err = c.refetch(ctx, j)
+		}
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The brigade was deleted since, it's a new request.
+			if err := c.journalDelete(ctx, j); err != nil {
+				return nil, err
+			}
+
+			return c.create(ctx, opts)
+		}
+
+		logging.FromContext(ctx).Info("brigade is already created")
+
+		return res, err
+	case repeatBusy:
+		return nil, fmt.Errorf("%w: %s: %s", ErrJournalBusy, j.BrigadeID, j.Step)
+	}
+
+	logging.FromContext(ctx).Info("resume brigade", logging.KeyStep, j.Step)
+
+	if err := c.journalClaim(ctx, j); err != nil {
+		return nil, err
+	}
+
+	return c.resume(ctx, j)
+}
+
+// adopt - the brigade exists without the journal, the configs are refetched from the node.
+func (c *Config) adopt(ctx context.Context, opts *Opts) (*Result, error) {
+	b, err := c.fetchBrigade(ctx, opts.ID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	if !b.same(opts) {
+		return nil, fmt.Errorf("%w: %s", ErrBrigadeMismatch, opts.ID)
+	}
+
+	logging.FromContext(ctx).Info("brigade is already created, refetch configs")
+
+	j, err := c.journalBegin(ctx, OperationCreate, opts)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+
+	answer, err := c.refetchConfigs(ctx, opts.ID, b)
+	if err != nil {
+		if derr := c.journalDelete(ctx, j); derr != nil {
+			return nil, errors.Join(err, derr)
+		}
+
+		return nil, err
+	}
+
+	if err := c.journalAnswer(ctx, j, answer); err != nil {
+		return nil, err
+	}
+
+	for _, step := range createSteps {
+		if err := c.journalStepDone(ctx, c.DB, j, step); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.finish(ctx, j)
+}
+
+// refetch - the created brigade configs are refetched from the node, the answer is expired.
+func (c *Config) refetch(ctx context.Context, j *Journal) (*Result, error) {
+	b, err := c.fetchBrigade(ctx, j.BrigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	answer, err := c.refetchConfigs(ctx, j.BrigadeID, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.journalAnswer(ctx, j, answer); err != nil {
+		return nil, err
+	}
+
+	return c.result(ctx, j)
+}
+
+// refetchConfigs - the brigadier configs are regenerated on the node, so it's recorded
+// as the brigadier replacement and it's limited by the replacements policy.
+func (c *Config) refetchConfigs(ctx context.Context, brigadeID string, b *brigadeRecord) ([]byte, error) {
+	r := &kdlib.Replacement{
+		Caller: c.LogTag,
+		Reason: "repeated creation",
+		OpID:   logging.OpID(),
+	}
+
+	if err := kdlib.ReserveReplacement(ctx, c.DB, c.BrigadesSchema, brigadeID, c.ReplacePolicy, r); err != nil {
+		return nil, fmt.Errorf("replacement: %w", err)
+	}
+
+	// The node might have replaced the brigadier even on failure, so the record is kept.
+	answer, err := c.replaceOnNode(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("replace: %w", err)
+	}
+
+	return answer, nil
+}
+
+// Resume - continues the leftover brigade creation from the first undone step.
+func Resume(ctx context.Context, c *Config, brigadeID string, force bool) (*Result, error) {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	j, err := c.takeOver(ctx, brigadeID, force)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.resume(ctx, j)
+}
+
+func (c *Config) resume(ctx context.Context, j *Journal) (*Result, error) {
+	// Clean up the node before the new attempt.
+	if j.nodeUncertain() {
+		if err := c.destroyOnNode(ctx, j); err != nil {
+			logging.FromContext(ctx).Warn("can't cleanup the node", logging.KeyError, err)
+		}
+	}
+
+	return c.run(ctx, j)
+}
+
+// Rollback - compensates the leftover brigade creation and removes the journal.
+func Rollback(ctx context.Context, c *Config, brigadeID string, force bool) error {
+	ctx = brigadeContext(ctx, brigadeID)
+
+	j, err := c.takeOver(ctx, brigadeID, force)
+	if err != nil {
+		return err
+	}
+
+	if err := c.compensate(ctx, j, force); err != nil {
+		if ferr := c.journalFail(ctx, j, err); ferr != nil {
+			return errors.Join(err, ferr)
+		}
+
+		return fmt.Errorf("rollback: %w", err)
+	}
+
+	return c.journalDelete(ctx, j)
+}
+
+// FreeSlots - the number of free slots on the active pairs.
+func FreeSlots(ctx context.Context, c *Config) (int32, error) {
+	return c.freeSlots(ctx)
+}
+
+func (c *Config) freeSlots(ctx context.Context) (int32, error) {
+	num := int32(0)
+	if err := c.DB.QueryRow(ctx, kdlib.GetFreeSlotsNumberStatement(c.BrigadesSchema, true)).Scan(&num); err != nil {
+		return 0, fmt.Errorf("slots query: %w", err)
+	}
+
+	return num, nil
+}
+
+// brigadeContext - the brigade ID is attached to the log records of the operation.
+func brigadeContext(ctx context.Context, brigadeID string) context.Context {
+	return logging.With(ctx, logging.KeyBrigade, brigadeID)
+}
+
+func (c *Config) takeOver(ctx context.Context, brigadeID string, force bool) (*Journal, error) {
+	j, err := FetchJournal(ctx, c, brigadeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.State == JournalStateDone {
+		return nil, fmt.Errorf("%w: %s", ErrJournalDone, j.BrigadeID)
+	}
+
+	if !force && !j.Stale() {
+		return nil, fmt.Errorf("%w: %s: %s", ErrJournalBusy, j.BrigadeID, j.Step)
+	}
+
+	if err := c.journalClaim(ctx, j); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (c *Config) run(ctx context.Context, j *Journal) (*Result, error) {
+	if err := c.runSteps(ctx, j, createSteps); err != nil {
+		return nil, err
+	}
+
+	return c.finish(ctx, j)
+}
+
+// runSteps - runs the undone steps, the brigade is rolled back on failure.
+func (c *Config) runSteps(ctx context.Context, j *Journal, steps []string) error {
+	for _, step := range steps {
+		if j.Done(step) {
+			continue
+		}
+
+		if err := c.journalStep(ctx, j, step, JournalStateRunning); err != nil {
+			return err
+		}
+
+		if err := c.doStep(logging.With(ctx, logging.KeyStep, step), j, step); err != nil {
+			err = fmt.Errorf("%s: %w", step, err)
+
+			return c.abort(ctx, j, err)
+		}
+	}
+
+	return nil
+}
+
+// finish - closes the journal of the created brigade.
+func (c *Config) finish(ctx context.Context, j *Journal) (*Result, error) {
+	res, err := c.result(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.journalFinish(ctx, j); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *Config) doStep(ctx context.Context, j *Journal, step string) error {
+	switch step {
+	case StepAllocate:
+		return c.allocate(ctx, j)
+	case StepSubdomain:
+		return c.applySubdomain(ctx, j)
+	case StepSync:
+		if err := c.syncLists(ctx); err != nil {
+			return err
+		}
+	case StepNode:
+		answer, err := c.createOnNode(ctx, j)
+		if err != nil {
+			return err
+		}
+
+		if err := c.journalAnswer(ctx, j, answer); err != nil {
+			return err
+		}
+	case StepDelegation:
+		if c.AsyncDelegation {
+			if err := c.delegationPending(ctx, j.BrigadeID); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := c.waitDelegation(ctx, j); err != nil {
+			return err
+		}
+	}
+
+	return c.journalStepDone(ctx, c.DB, j, step)
+}
+
+// abort - records the failure and rolls the brigade back.
+func (c *Config) abort(ctx context.Context, j *Journal, cause error) error {
+	if err := c.journalFail(ctx, j, cause); err != nil {
+		return errors.Join(cause, err)
+	}
+
+	if err := c.compensate(ctx, j, false); err != nil {
+		return c.rollbackIncomplete(ctx, j, cause, err)
+	}
+
+	if err := c.journalDelete(ctx, j); err != nil {
+		return errors.Join(cause, err)
+	}
+
+	return cause
+}
+
+// rollbackIncomplete - the journal is kept with the rollback error for the later resume.
+func (c *Config) rollbackIncomplete(ctx context.Context, j *Journal, cause, err error) error {
+	logging.FromContext(ctx).Error("rollback is incomplete, the journal is kept", logging.KeyError, err)
+
+	if ferr := c.journalFail(ctx, j, fmt.Errorf("%w; rollback: %w", cause, err)); ferr != nil {
+		return errors.Join(cause, err, ferr)
+	}
+
+	return errors.Join(cause, fmt.Errorf("rollback: %w", err))
+}
+
+func (c *Config) result(ctx context.Context, j *Journal) (*Result, error) {
+	if len(j.answer) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoNodeAnswer, j.BrigadeID)
+	}
+
+	wgconf := &keydesk.Answer{}
+	if err := json.Unmarshal(j.answer, &wgconf); err != nil {
+		return nil, fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	b, err := c.fetchBrigade(ctx, j.BrigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	num, err := c.freeSlots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	delegation, err := c.delegationState(ctx, j.BrigadeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Configs:     wgconf.Configs,
+		KeydeskIPv6: b.keydeskIPv6,
+		FreeSlots:   num,
+		Delegation:  delegation,
+	}, nil
+}
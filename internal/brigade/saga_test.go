@@ -0,0 +1,178 @@
+package brigade
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vpngen/wordsgens/namesgenerator"
+)
+
+func TestUndoPlan(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  string
+		done  []string
+		skip  []string
+		plan  []string
+		nodes bool // the node is cleaned up on resume
+	}{
+		{
+			name: "allocation failed",
+			step: StepAllocate,
+			plan: []string{StepAllocate},
+		},
+		{
+			name: "subdomain failed",
+			step: StepSubdomain,
+			done: []string{StepAllocate},
+			plan: []string{StepSubdomain, StepAllocate},
+		},
+		{
+			name: "sync failed",
+			step: StepSync,
+			done: []string{StepAllocate, StepSubdomain},
+			plan: []string{StepSubdomain, StepAllocate, StepSync},
+		},
+		{
+			name: "batch sync failed",
+			step: StepSync,
+			done: []string{StepAllocate, StepSubdomain},
+			skip: []string{StepSync},
+			plan: []string{StepSubdomain, StepAllocate},
+		},
+		{
+			name:  "node failed",
+			step:  StepNode,
+			done:  []string{StepAllocate, StepSubdomain, StepSync},
+			plan:  []string{StepNode, StepSubdomain, StepAllocate, StepSync},
+			nodes: true,
+		},
+		{
+			name: "delegation failed",
+			step: StepDelegation,
+			done: []string{StepAllocate, StepSubdomain, StepSync, StepNode},
+			plan: []string{StepNode, StepSubdomain, StepAllocate, StepSync},
+		},
+		{
+			name:  "partially undone",
+			step:  StepNode,
+			done:  []string{StepAllocate},
+			plan:  []string{StepNode, StepAllocate},
+			nodes: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Journal{Step: tt.step, StepsDone: tt.done}
+
+			if plan := j.undoPlan(tt.skip...); !slices.Equal(plan, tt.plan) {
+				t.Errorf("plan: got %v, want %v", plan, tt.plan)
+			}
+
+			if j.nodeUncertain() != tt.nodes {
+				t.Errorf("node cleanup: got %v, want %v", j.nodeUncertain(), tt.nodes)
+			}
+		})
+	}
+}
+
+func TestRepeatAction(t *testing.T) {
+	person := namesgenerator.Person{Name: "Ada Lovelace", Desc: "mathematician", URL: "https://example.org"}
+	opts := &Opts{ID: "brigade", Name: "Ada", Person: person}
+
+	tests := []struct {
+		name    string
+		state   string
+		update  time.Duration // since the last journal update
+		payload journalPayload
+		action  int
+		err     error
+	}{
+		{
+			name:    "done",
+			state:   JournalStateDone,
+			payload: journalPayload{Name: "Ada", Person: person},
+			action:  repeatAnswer,
+		},
+		{
+			name:    "running",
+			state:   JournalStateRunning,
+			update:  time.Minute,
+			payload: journalPayload{Name: "Ada", Person: person},
+			action:  repeatBusy,
+		},
+		{
+			name:    "running stale",
+			state:   JournalStateRunning,
+			update:  JournalStaleTime + time.Minute,
+			payload: journalPayload{Name: "Ada", Person: person},
+			action:  repeatResume,
+		},
+		{
+			name:    "failed",
+			state:   JournalStateFailed,
+			update:  time.Minute,
+			payload: journalPayload{Name: "Ada", Person: person},
+			action:  repeatResume,
+		},
+		{
+			name:    "another name",
+			state:   JournalStateDone,
+			payload: journalPayload{Name: "Bob", Person: person},
+			err:     ErrBrigadeMismatch,
+		},
+		{
+			name:    "another person",
+			state:   JournalStateRunning,
+			payload: journalPayload{Name: "Ada", Person: namesgenerator.Person{Name: "Bob"}},
+			err:     ErrBrigadeMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Journal{
+				BrigadeID:  opts.ID,
+				State:      tt.state,
+				UpdateTime: time.Now().Add(-tt.update),
+				payload:    tt.payload,
+			}
+
+			action, err := j.repeatAction(opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error: got %v, want %v", err, tt.err)
+			}
+
+			if err == nil && action != tt.action {
+				t.Errorf("action: got %d, want %d", action, tt.action)
+			}
+		})
+	}
+}
+
+func TestBrigadeSame(t *testing.T) {
+	person := namesgenerator.Person{Name: "Ada Lovelace", Desc: "mathematician", URL: "https://example.org"}
+	b := &brigadeRecord{fullname: "Ada", person: person}
+
+	tests := []struct {
+		name string
+		opts *Opts
+		same bool
+	}{
+		{"same", &Opts{Name: "Ada", Person: person}, true},
+		{"another name", &Opts{Name: "Bob", Person: person}, false},
+		{"another desc", &Opts{Name: "Ada", Person: namesgenerator.Person{Name: person.Name, URL: person.URL}}, false},
+		{"another url", &Opts{Name: "Ada", Person: namesgenerator.Person{Name: person.Name, Desc: person.Desc}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if b.same(tt.opts) != tt.same {
+				t.Errorf("same: got %v, want %v", !tt.same, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package brigade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/vpngen/wordsgens/namesgenerator"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 1000
+)
+
+const (
+	// sqlSearchWhere - the names are LIKE patterns escaped by likeEscape.
+	sqlSearchWhere = `
+WHERE
+	($1::text IS NULL OR m.brigadier ILIKE '%%' || $1 || '%%' ESCAPE '\')
+	AND ($2::text IS NULL OR m.domain_name ILIKE '%%' || $2 || '%%' ESCAPE '\')
+	AND ($3::inet IS NULL OR m.endpoint_ipv4 <<= $3)
+	AND ($4::inet IS NULL OR m.keydesk_ipv6 <<= $4)
+	AND ($5::inet IS NULL OR m.ipv4_cgnat >>= $5 OR m.ipv6_ula >>= $5)
+	AND ($6::uuid IS NULL OR m.pair_id = $6)
+	AND ($7::inet IS NULL OR m.control_ip = $7)
+	AND ($8::uuid IS NULL OR m.brigade_id = $8)
+`
+
+	sqlSearchBrigades = `
+SELECT
+	m.brigade_id,
+	m.brigadier,
+	m.pair_id,
+	m.control_ip,
+	m.endpoint_ipv4,
+	COALESCE(m.domain_name, ''),
+	m.keydesk_ipv6,
+	m.ipv4_cgnat,
+	m.ipv6_ula,
+	m.person,
+	COALESCE(s.total_users_count, 0),
+	COALESCE(s.active_users_count, 0),
+	s.created_at,
+	s.first_visit,
+	s.update_time
+FROM %s AS m
+	LEFT JOIN %s AS s ON s.brigade_id = m.brigade_id
+` + sqlSearchWhere + `
+ORDER BY m.brigadier, m.brigade_id
+LIMIT $9 OFFSET $10
+`
+
+	sqlSearchCount = `SELECT COUNT(*) FROM %s AS m` + sqlSearchWhere
+)
+
+// SearchQuery - the brigades search conditions, the empty ones are ignored.
+// The names are matched partially and case insensitive,
+// the endpoint and the keydesk address may be the prefixes.
+type SearchQuery struct {
+	BrigadeID string
+	Brigadier string
+	Domain    string
+	// EndpointIPv4 - the endpoint or the endpoints network.
+	EndpointIPv4 netip.Prefix
+	// KeydeskIPv6 - the keydesk address or the keydesk network.
+	KeydeskIPv6 netip.Prefix
+	// Addr - an address within the brigade CGNAT or ULA network.
+	Addr netip.Addr
+	// PairID or ControlIP - the pair of the brigade.
+	PairID    string
+	ControlIP netip.Addr
+
+	Limit  int
+	Offset int
+}
+
+// Found - the brigade with its last stats.
+type Found struct {
+	BrigadeID        string                `json:"brigade_id"`
+	Brigadier        string                `json:"brigadier"`
+	PairID           string                `json:"pair_id"`
+	ControlIP        netip.Addr            `json:"control_ip"`
+	EndpointIPv4     netip.Addr            `json:"endpoint_ipv4"`
+	Domain           string                `json:"domain,omitempty"`
+	KeydeskIPv6      netip.Addr            `json:"keydesk_ipv6"`
+	IPv4CGNAT        netip.Prefix          `json:"ipv4_cgnat"`
+	IPv6ULA          netip.Prefix          `json:"ipv6_ula"`
+	Person           namesgenerator.Person `json:"person"`
+	TotalUsersCount  int                   `json:"total_users_count"`
+	ActiveUsersCount int                   `json:"active_users_count"`
+	CreatedAt        *time.Time            `json:"created_at,omitempty"`
+	FirstVisit       *time.Time            `json:"first_visit,omitempty"`
+	UpdateTime       *time.Time            `json:"update_time,omitempty"`
+}
+
+// SearchResult - the page of the found brigades.
+type SearchResult struct {
+	Total    int      `json:"total"`
+	Offset   int      `json:"offset"`
+	Limit    int      `json:"limit"`
+	Brigades []*Found `json:"brigades"`
+}
+
+func optional[T comparable](v T) *T {
+	var zero T
+	if v == zero {
+		return nil
+	}
+
+	return &v
+}
+
+// likeEscape - the string is matched literally by LIKE ... ESCAPE '\'.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func optionalPrefix(p netip.Prefix) *netip.Prefix {
+	if !p.IsValid() {
+		return nil
+	}
+
+	return &p
+}
+
+func optionalAddr(a netip.Addr) *netip.Addr {
+	if !a.IsValid() {
+		return nil
+	}
+
+	return &a
+}
+
+func timePtr(t pgtype.Timestamp) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
+
+// Search - the brigades matching all the query conditions, ordered by the brigadier name.
+func Search(ctx context.Context, c *Config, q SearchQuery) (*SearchResult, error) {
+	limit := q.Limit
+	switch {
+	case limit <= 0:
+		limit = defaultSearchLimit
+	case limit > maxSearchLimit:
+		limit = maxSearchLimit
+	}
+
+	offset := q.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	args := []any{
+		optional(likeEscape(q.Brigadier)),
+		optional(likeEscape(q.Domain)),
+		optionalPrefix(q.EndpointIPv4),
+		optionalPrefix(q.KeydeskIPv6),
+		optionalAddr(q.Addr),
+		optional(q.PairID),
+		optionalAddr(q.ControlIP),
+		optional(q.BrigadeID),
+	}
+
+	// The total and the page are from the same snapshot.
+	tx, err := c.DB.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	res := &SearchResult{Offset: offset, Limit: limit, Brigades: []*Found{}}
+
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlSearchCount, pgx.Identifier{c.BrigadesSchema, "meta_brigades"}.Sanitize()),
+		args...,
+	).Scan(&res.Total); err != nil {
+		return nil, fmt.Errorf("count query: %w", err)
+	}
+
+	rows, err := tx.Query(ctx,
+		fmt.Sprintf(sqlSearchBrigades,
+			pgx.Identifier{c.BrigadesSchema, "meta_brigades"}.Sanitize(),
+			pgx.Identifier{c.BrigadesStatsSchema, "brigades_stats"}.Sanitize(),
+		),
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("search query: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			f                                Found
+			pjson                            []byte
+			createdAt, firstVisit, updatedAt pgtype.Timestamp
+		)
+
+		if err := rows.Scan(
+			&f.BrigadeID,
+			&f.Brigadier,
+			&f.PairID,
+			&f.ControlIP,
+			&f.EndpointIPv4,
+			&f.Domain,
+			&f.KeydeskIPv6,
+			&f.IPv4CGNAT,
+			&f.IPv6ULA,
+			&pjson,
+			&f.TotalUsersCount,
+			&f.ActiveUsersCount,
+			&createdAt,
+			&firstVisit,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("search row: %w", err)
+		}
+
+		if err := json.Unmarshal(pjson, &f.Person); err != nil {
+			return nil, fmt.Errorf("person: %w", err)
+		}
+
+		f.CreatedAt, f.FirstVisit, f.UpdateTime = timePtr(createdAt), timePtr(firstVisit), timePtr(updatedAt)
+
+		res.Brigades = append(res.Brigades, &f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search rows: %w", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,22 @@
+package brigade
+
+import "testing"
+
+func TestLikeEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "", want: ""},
+		{in: "Ivan", want: "Ivan"},
+		{in: "100%", want: `100\%`},
+		{in: "a_b", want: `a\_b`},
+		{in: `c:\x`, want: `c:\\x`},
+		{in: `\%_`, want: `\\\%\_`},
+	}
+
+	for _, tt := range tests {
+		if got := likeEscape(tt.in); got != tt.want {
+			t.Errorf("likeEscape(%q): %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
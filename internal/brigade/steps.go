@@ -0,0 +1,755 @@
+package brigade
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgtype/zeronull"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vpngen/wordsgens/namesgenerator"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib"
+	dcmgmtlib "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
+)
+
+const (
+	subdomainAPIAttempts = 5
+	subdomainAPISleep    = 2 * time.Second
+)
+
+const (
+	DomainCheckPause         = 5 * time.Second
+	DomainDelegationWaitTime = 120 * time.Second
+)
+
+// AllocateAttempts - how many times the allocation is retried on the conflict.
+const (
+	AllocateAttempts   = 16
+	AllocateRetryPause = 50 * time.Millisecond
+)
+
+// allocationConstraints - unique constraints which may be violated by concurrent allocations.
+var allocationConstraints = []string{
+	"brigades_endpoint_ipv4_key",
+	"brigades_ipv4_cgnat_net_key",
+	"brigades_ipv6_ula_net_key",
+	"brigades_keydesk_ipv6_key",
+}
+
+var (
+	ErrNotDelegated         = errors.New("not delegated")
+	ErrCheckAttemptExceeded = errors.New("check attempt exceeded")
+)
+
+const (
+	sqlUsedAddrs = `
+SELECT
+	host(%s)::inet
+FROM %s
+WHERE
+	%s <<= $1
+`
+
+	sqlPickCGNATNet = `
+SELECT
+	ipv4_net
+FROM %s
+ORDER BY weight DESC, id
+LIMIT 1
+`
+
+	sqlPickULANet = `
+SELECT
+	ipv6_net
+FROM %s
+ORDER BY iweight ASC, id
+LIMIT 1
+`
+
+	sqlPickKeydeskNet = `
+SELECT
+	ipv6_net
+FROM %s
+ORDER BY iweight ASC, id
+LIMIT 1
+`
+
+	sqlCreateBrigade = `
+INSERT INTO %s
+		(
+			brigade_id,
+			pair_id,
+			brigadier,
+			endpoint_ipv4,
+			domain_name,
+			dns_ipv4,
+			dns_ipv6,
+			keydesk_ipv6,
+			ipv4_cgnat,
+			ipv6_ula,
+			person
+		)
+VALUES
+		(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11
+		)
+`
+
+	sqlFetchBrigade = `
+SELECT
+	meta_brigades.brigade_id,
+	meta_brigades.brigadier,
+	meta_brigades.endpoint_ipv4,
+	meta_brigades.domain_name,
+	meta_brigades.dns_ipv4,
+	meta_brigades.dns_ipv6,
+	meta_brigades.keydesk_ipv6,
+	meta_brigades.ipv4_cgnat,
+	meta_brigades.ipv6_ula,
+	meta_brigades.person,
+	meta_brigades.control_ip
+FROM %s
+WHERE
+	meta_brigades.brigade_id=$1
+`
+	sqlInsertStats      = `INSERT INTO %s (brigade_id) VALUES ($1);`
+	sqlInsertPairDomain = `INSERT INTO %s (domain_name, endpoint_ipv4) VALUES ($1,$2)`
+
+	sqlUpdateBrigadeDomain = `UPDATE %s SET domain_name=$1 WHERE brigade_id=$2`
+)
+
+// brigadeRecord - brigade as it's stored in the database.
+type brigadeRecord struct {
+	brigadeID    []byte
+	fullname     string
+	endpointIPv4 netip.Addr
+	domainName   pgtype.Text
+	dnsIPv4      netip.Addr
+	dnsIPv6      netip.Addr
+	keydeskIPv6  netip.Addr
+	ipv4CGNAT    netip.Prefix
+	ipv6ULA      netip.Prefix
+	person       namesgenerator.Person
+	controlIP    netip.Addr
+}
+
+func (b *brigadeRecord) id32() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b.brigadeID)
+}
+
+// same - the brigade is created by the same request.
+func (b *brigadeRecord) same(opts *Opts) bool {
+	return b.fullname == opts.Name &&
+		b.person.Name == opts.Person.Name &&
+		b.person.Desc == opts.Person.Desc &&
+		b.person.URL == opts.Person.URL
+}
+
+func (c *Config) fetchBrigade(ctx context.Context, brigadeID string) (*brigadeRecord, error) {
+	var (
+		b     brigadeRecord
+		pjson []byte
+	)
+
+	if err := c.DB.QueryRow(ctx,
+		fmt.Sprintf(sqlFetchBrigade,
+			(pgx.Identifier{c.BrigadesSchema, "meta_brigades"}.Sanitize()),
+		),
+		brigadeID,
+	).Scan(
+		&b.brigadeID,
+		&b.fullname,
+		&b.endpointIPv4,
+		&b.domainName,
+		&b.dnsIPv4,
+		&b.dnsIPv6,
+		&b.keydeskIPv6,
+		&b.ipv4CGNAT,
+		&b.ipv6ULA,
+		&pjson,
+		&b.controlIP,
+	); err != nil {
+		return nil, fmt.Errorf("brigade query: %w", err)
+	}
+
+	if err := json.Unmarshal(pjson, &b.person); err != nil {
+		return nil, fmt.Errorf("person: %w", err)
+	}
+
+	return &b, nil
+}
+
+// allocate - stores the brigade with a pair, an endpoint and addresses picked up.
+// There is no table lock, concurrent allocations are serialized by unique constraints,
+// the loser of the race retries with the fresh data.
+func (c *Config) allocate(ctx context.Context, j *Journal) error {
+	for attempt := 1; ; attempt++ {
+		err := c.tryAllocate(ctx, j)
+		if err == nil || !isAllocationConflict(err) || attempt >= AllocateAttempts {
+			return err
+		}
+
+		logging.FromContext(ctx).Warn("allocation conflict", "attempt", attempt, logging.KeyError, err)
+
+		time.Sleep(time.Duration(rand.Int63n(int64(AllocateRetryPause) * int64(attempt))))
+	}
+}
+
+// isAllocationConflict - someone else took the same endpoint or addresses.
+func isAllocationConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgUniqueViolation {
+		return false
+	}
+
+	return slices.Contains(allocationConstraints, pgErr.ConstraintName)
+}
+
+func (c *Config) tryAllocate(ctx context.Context, j *Journal) error {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	a, err := c.pickAllocation(ctx, tx, j.payload.ForceIP)
+	if err != nil {
+		return err
+	}
+
+	if err := c.insertBrigade(ctx, tx, j.BrigadeID, j.payload.Name, j.payload.Person, a); err != nil {
+		return err
+	}
+
+	if err := c.journalStepDone(ctx, tx, j, StepAllocate); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+// pickAllocation - picks up the pair, the endpoint and free addresses for the new brigade.
+func (c *Config) pickAllocation(ctx context.Context, tx pgx.Tx, forceIP netip.Addr) (*Allocation, error) {
+	// pick up the pair by the placement policy
+
+	slot, err := c.pickSlot(ctx, tx, forceIP)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logging.FromContext(ctx).With(logging.KeyPair, slot.PairID, logging.KeyControlIP, slot.ControlIP)
+
+	log.Info("endpoint", "endpoint_ipv4", slot.EndpointIPv4, "domain", slot.DomainName.String)
+
+	a := &Allocation{
+		Placement:    slot.Placement,
+		Reason:       slot.Reason,
+		PairID:       slot.PairID,
+		ControlIP:    slot.ControlIP,
+		EndpointIPv4: slot.EndpointIPv4,
+		Domain:       slot.DomainName.String,
+	}
+
+	// pick up cgnat
+
+	if err := tx.QueryRow(
+		ctx,
+		fmt.Sprintf(sqlPickCGNATNet, pgx.Identifier{c.BrigadesSchema, "ipv4_cgnat_nets_weight"}.Sanitize()),
+	).Scan(&a.CGNATWindow); err != nil {
+		return nil, fmt.Errorf("cgnat weight query: %w", err)
+	}
+
+	cgnat, err := c.usedAddrs(ctx, tx, "ipv4_cgnat", a.CGNATWindow)
+	if err != nil {
+		return nil, fmt.Errorf("cgnat: %w", err)
+	}
+
+	a.CGNAT, err = c.pickNet(a.CGNATWindow, BrigadeCgnatPrefix, cgnat)
+	if err != nil {
+		return nil, fmt.Errorf("cgnat: %w", err)
+	}
+
+	log.Info("cgnat", "window", a.CGNATWindow, "net", a.CGNAT)
+
+	// pick up ula
+
+	if err := tx.QueryRow(ctx, fmt.Sprintf(sqlPickULANet, (pgx.Identifier{c.BrigadesSchema, "ipv6_ula_nets_iweight"}.Sanitize()))).Scan(&a.ULAWindow); err != nil {
+		return nil, fmt.Errorf("ula weight query: %w", err)
+	}
+
+	ula, err := c.usedAddrs(ctx, tx, "ipv6_ula", a.ULAWindow)
+	if err != nil {
+		return nil, fmt.Errorf("ula: %w", err)
+	}
+
+	a.ULA, err = c.pickNet(a.ULAWindow, BrigadeUlaPrefix, ula)
+	if err != nil {
+		return nil, fmt.Errorf("ula: %w", err)
+	}
+
+	log.Info("ula", "window", a.ULAWindow, "net", a.ULA)
+
+	// pick up keydesk
+
+	if err := tx.QueryRow(ctx, fmt.Sprintf(sqlPickKeydeskNet, (pgx.Identifier{c.BrigadesSchema, "ipv6_keydesk_nets_iweight"}.Sanitize()))).Scan(&a.KeydeskWindow); err != nil {
+		return nil, fmt.Errorf("keydesk iweight query: %w", err)
+	}
+
+	kd6, err := c.usedAddrs(ctx, tx, "keydesk_ipv6", a.KeydeskWindow)
+	if err != nil {
+		return nil, fmt.Errorf("keydesk: %w", err)
+	}
+
+	a.KeydeskIPv6, err = c.pickAddr(a.KeydeskWindow, kd6)
+	if err != nil {
+		return nil, fmt.Errorf("keydesk: %w", err)
+	}
+
+	log.Info("keydesk", "window", a.KeydeskWindow, "addr", a.KeydeskIPv6)
+
+	return a, nil
+}
+
+// insertBrigade - stores the brigade and its stats row.
+func (c *Config) insertBrigade(ctx context.Context, tx pgx.Tx, id, name string, person namesgenerator.Person, a *Allocation) error {
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlCreateBrigade, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		id,
+		a.PairID,
+		name,
+		a.EndpointIPv4.String(),
+		zeronull.Text(a.Domain),
+		a.CGNAT.Addr().String(),
+		a.ULA.Addr().String(),
+		a.KeydeskIPv6.String(),
+		a.CGNAT.String(),
+		a.ULA.String(),
+		person,
+	); err != nil {
+		return fmt.Errorf("create brigade: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(sqlInsertStats, (pgx.Identifier{c.BrigadesStatsSchema, "brigades_stats"}.Sanitize())),
+		id,
+	); err != nil {
+		return fmt.Errorf("create stats: %w", err)
+	}
+
+	return nil
+}
+
+// usedAddrs - addresses of the column inside the window.
+func (c *Config) usedAddrs(ctx context.Context, tx pgx.Tx, column string, window netip.Prefix) ([]netip.Addr, error) {
+	col := pgx.Identifier{column}.Sanitize()
+
+	rows, err := tx.Query(ctx,
+		fmt.Sprintf(sqlUsedAddrs, col, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize(), col),
+		window,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("used query: %w", err)
+	}
+
+	var (
+		addr netip.Addr
+		used []netip.Addr
+	)
+
+	if _, err := pgx.ForEachRow(rows, []any{&addr}, func() error {
+		used = append(used, addr)
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("used row: %w", err)
+	}
+
+	return used, nil
+}
+
+// pickNet - picks up a free subnet of the window, the subnet address is a host inside it.
+func (c *Config) pickNet(window netip.Prefix, bits int, used []netip.Addr) (netip.Prefix, error) {
+	pool, err := kdlib.NewPool(window, bits, used)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("pool: %w", err)
+	}
+
+	slot, err := pool.Pick(c.RandomAllocation)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("pick: %w", err)
+	}
+
+	addr, err := kdlib.HostInSlot(slot, c.RandomAllocation)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("host: %w", err)
+	}
+
+	return netip.PrefixFrom(addr, bits), nil
+}
+
+// pickAddr - picks up a free address of the window, zero ending addresses are skipped.
+func (c *Config) pickAddr(window netip.Prefix, used []netip.Addr) (netip.Addr, error) {
+	pool, err := kdlib.NewPool(window, window.Addr().BitLen(), used)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("pool: %w", err)
+	}
+
+	pool.Skip = func(slot netip.Prefix) bool {
+		return kdlib.IsZeroEnding(slot.Addr())
+	}
+
+	slot, err := pool.Pick(c.RandomAllocation)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("pick: %w", err)
+	}
+
+	return slot.Addr(), nil
+}
+
+// applySubdomain - picks up a subdomain for the brigade endpoint if the endpoint has no domain yet.
+func (c *Config) applySubdomain(ctx context.Context, j *Journal) error {
+	b, err := c.fetchBrigade(ctx, j.BrigadeID)
+	if err != nil {
+		return fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	if b.domainName.Valid {
+		return c.journalStepDone(ctx, c.DB, j, StepSubdomain)
+	}
+
+	if c.SubdomainAPIToken == dcmgmtlib.NoUseSubdomainAPIToken {
+		logging.FromContext(ctx).Info("subdomain api token is set to dry-run")
+
+		return c.journalStepDone(ctx, c.DB, j, StepSubdomain)
+	}
+
+	subdomain, err := c.pickSubdomain(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Remember the subdomain before using it, to release it on rollback.
+	j.payload.Domain = subdomain
+	if err := c.journalPayload(ctx, c.DB, j); err != nil {
+		return err
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	var domainName pgtype.Text
+
+	if err := domainName.Scan(subdomain); err != nil {
+		return fmt.Errorf("scan subdomain: %w", err)
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		fmt.Sprintf(sqlInsertPairDomain, pgx.Identifier{c.BrigadesSchema, "domains_endpoints_ipv4"}.Sanitize()),
+		domainName, b.endpointIPv4,
+	); err != nil {
+		return fmt.Errorf("pair domain update: %w", err)
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		fmt.Sprintf(sqlUpdateBrigadeDomain, pgx.Identifier{c.BrigadesSchema, "brigades"}.Sanitize()),
+		domainName, j.BrigadeID,
+	); err != nil {
+		return fmt.Errorf("brigade domain update: %w", err)
+	}
+
+	if err := c.journalStepDone(ctx, tx, j, StepSubdomain); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+// pickSubdomain - picks up the new subdomain from the subdomain API.
+func (c *Config) pickSubdomain(ctx context.Context) (string, error) {
+	for i := 0; ; i++ {
+		subdomain, err := kdlib.SubdomainPick(c.SubdomainAPIHost, c.SubdomainAPIToken)
+		if err == nil {
+			return subdomain, nil
+		}
+
+		logging.FromContext(ctx).Warn("can't pick subdomain", "attempt", i+1, logging.KeyError, err)
+		if i == subdomainAPIAttempts-1 {
+			return "", fmt.Errorf("pick subdomain: %w", err)
+		}
+
+		time.Sleep(subdomainAPISleep)
+	}
+}
+
+// syncLists - pushes delegation and keydesk address lists.
+// Every list is built and pushed under the advisory lock,
+// so the list built before a concurrent change never overwrites the newer one.
+// The lists follow the database, the failed sync isn't rolled back:
+// the lists are synced by the next change or by hand.
+func (c *Config) syncLists(ctx context.Context) error {
+	// Sync delegation list.
+
+	if err := dcmgmtlib.WithAdvisoryLock(ctx, c.DB, c.BrigadesSchema, dcmgmtlib.DelegationSyncLock, func(conn *pgxpool.Conn) error {
+		delegationList, err := dcmgmtlib.NewDelegationList(ctx, conn, c.BrigadesSchema)
+		if err != nil {
+			return fmt.Errorf("delegation list: %w", err)
+		}
+
+		logging.FromContext(ctx).Info("delegation sync", "user", c.DelegationSyncSSHConfig.User, "server", c.DelegationServer)
+		cleanup, err := dcmgmtlib.SyncDelegationList(c.DelegationSyncSSHConfig, c.DelegationServer, c.Ident, delegationList)
+		cleanup(c.LogTag)
+
+		if err != nil {
+			return fmt.Errorf("delegation sync: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Sync keydesk address list
+
+	return dcmgmtlib.WithAdvisoryLock(ctx, c.DB, c.BrigadesSchema, dcmgmtlib.KdAddrSyncLock, func(conn *pgxpool.Conn) error {
+		kdAddrList, err := dcmgmtlib.NewKdAddrList(ctx, conn, c.BrigadesSchema)
+		if err != nil {
+			return fmt.Errorf("keydesk addr list: %w", err)
+		}
+
+		logging.FromContext(ctx).Info("keydesk address sync", "user", c.KdAddrSyncSSHConfig.User, "server", c.KdAddrServer)
+		cleanup, err := dcmgmtlib.SyncKdAddrList(c.KdAddrSyncSSHConfig, c.KdAddrServer, c.Ident, kdAddrList)
+		cleanup(c.LogTag)
+
+		if err != nil {
+			return fmt.Errorf("keydesk address sync: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// createOnNode - creates the brigade on the pair, returns the node answer.
+func (c *Config) createOnNode(ctx context.Context, j *Journal) ([]byte, error) {
+	b, err := c.fetchBrigade(ctx, j.BrigadeID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	cmd := fmt.Sprintf("create -id %s -ep4 %s -int4 %s -int6 %s -dns4 %s -dns6 %s -kd6 %s -name %s -person %s -desc %s -url %s -dn %s -ch -j",
+		b.id32(),
+		b.endpointIPv4,
+		b.ipv4CGNAT,
+		b.ipv6ULA,
+		b.dnsIPv4,
+		b.dnsIPv6,
+		b.keydeskIPv6,
+		base64.StdEncoding.WithPadding(base64.StdPadding).EncodeToString([]byte(b.fullname)),
+		base64.StdEncoding.WithPadding(base64.StdPadding).EncodeToString([]byte(b.person.Name)),
+		base64.StdEncoding.WithPadding(base64.StdPadding).EncodeToString([]byte(b.person.Desc)),
+		base64.StdEncoding.WithPadding(base64.StdPadding).EncodeToString([]byte(b.person.URL)),
+		b.domainName.String,
+	)
+
+	cmd += c.VPNCfgs.flags()
+
+	output, err := c.runOnNode(ctx, b.controlIP, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(output)))
+	if err != nil {
+		return nil, fmt.Errorf("chunk read: %w", err)
+	}
+
+	return payload, nil
+}
+
+// replaceOnNode - regenerates the brigadier configs on the pair, returns the node answer.
+func (c *Config) replaceOnNode(ctx context.Context, b *brigadeRecord) ([]byte, error) {
+	cmd := fmt.Sprintf("replace -id %s -ch -j", b.id32())
+
+	cmd += c.VPNCfgs.flags()
+
+	output, err := c.runOnNode(ctx, b.controlIP, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(output)))
+	if err != nil {
+		return nil, fmt.Errorf("chunk read: %w", err)
+	}
+
+	return payload, nil
+}
+
+// runOnNode - runs the command on the pair and returns its stdout,
+// the operation ID is passed to the node.
+func (c *Config) runOnNode(ctx context.Context, controlIP netip.Addr, cmd string) ([]byte, error) {
+	return c.runOnNodeInput(ctx, controlIP, cmd, nil)
+}
+
+// runOnNodeInput - runOnNode with the command stdin.
+func (c *Config) runOnNodeInput(ctx context.Context, controlIP netip.Addr, cmd string, stdin io.Reader) ([]byte, error) {
+	log := logging.FromContext(ctx).With(logging.KeyControlIP, controlIP)
+
+	log.Info("node command", "user", SSHKeyRemoteUsername, "cmd", cmd)
+
+	client, b, e, _, err := kdlib.NewSSHCient(c.NodeSSHConfig, fmt.Sprintf("%s:22", controlIP))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if e.Len() > 0 {
+			log.Info("node stderr", "stderr", logging.Lines(e.String()))
+		}
+	}()
+
+	defer client.Close()
+
+	switch stdin {
+	case nil:
+		err = kdlib.SSHSessionRun(client, b, e, cmd)
+	default:
+		err = kdlib.SSHSessionStart(client, b, e, cmd, stdin)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("ssh run: %w", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+// waitDelegation - waits until the keydesk and the domain are resolved.
+func (c *Config) waitDelegation(ctx context.Context, j *Journal) error {
+	b, err := c.fetchBrigade(ctx, j.BrigadeID)
+	if err != nil {
+		return fmt.Errorf("fetch brigade: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("waiting for delegation", "keydesk", b.keydeskIPv6, "domain", b.domainName.String, "endpoint_ipv4", b.endpointIPv4)
+
+	if !c.waitForAllDelegations(
+		ctx,
+		b.keydeskIPv6,
+		b.domainName.String,
+		b.endpointIPv4,
+	) {
+		return fmt.Errorf("delegation: %w", ErrNotDelegated)
+	}
+
+	return nil
+}
+
+func (c *Config) waitForAllDelegations(ctx context.Context, keydeskAddr netip.Addr, domain string, endpointIPv4 netip.Addr) bool {
+	log := logging.FromContext(ctx)
+
+	// The brigade without the domain has nothing to wait for.
+	kdOk, domainOk := false, domain == ""
+
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		fqdn, err := c.KdNames.Encode(keydeskAddr)
+		if err != nil {
+			log.Error("keydesk name", "keydesk", keydeskAddr, logging.KeyError, err)
+
+			return
+		}
+
+		ok, err := c.waitForDelegation(ctx, fqdn, keydeskAddr, c.KdNS...)
+		if err != nil {
+			log.Warn("keydesk delegation", "keydesk", keydeskAddr, logging.KeyError, err)
+		}
+
+		kdOk = ok
+	}()
+
+	if domain != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ok, err := c.waitForDelegation(ctx, domain, endpointIPv4, c.DomainNS...)
+			if err != nil {
+				log.Warn("domain delegation", "domain", domain, "endpoint_ipv4", endpointIPv4, logging.KeyError, err)
+			}
+
+			domainOk = ok
+		}()
+	}
+
+	wg.Wait()
+
+	return kdOk && domainOk
+}
+
+func (c *Config) waitForDelegation(ctx context.Context, fqdn string, ip netip.Addr, ns ...string) (bool, error) {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+
+	finish := time.Now().Add(DomainDelegationWaitTime)
+
+	logging.FromContext(ctx).Debug("waiting for delegation", "fqdn", fqdn, "addr", ip, "ns", ns)
+
+	for ts := range timer.C {
+		if ok, err := dcmgmtlib.CheckForPresence(fqdn, ip, ns...); ok && err == nil {
+			return ok, nil
+		}
+
+		if ts.After(finish) {
+			return false, ErrCheckAttemptExceeded
+		}
+
+		timer.Reset(DomainCheckPause)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,48 @@
+package kdlib
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ErrBrigadeIDForms - the brigade ID is given in both forms.
+var ErrBrigadeIDForms = errors.New("brigade id is given both in base32 and in uuid form")
+
+// ParseBrigadeID - the brigade ID given in the base32 or in the uuid form,
+// uuid.Nil if none is given.
+func ParseBrigadeID(id32, id string) (uuid.UUID, error) {
+	switch {
+	case id32 != "" && id != "":
+		return uuid.Nil, ErrBrigadeIDForms
+	case id32 != "":
+		// id32 must be base32 decodable.
+		buf, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(id32)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("id base32: %s: %w", id32, err)
+		}
+
+		u, err := uuid.FromBytes(buf)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("id uuid: %s: %w", id32, err)
+		}
+
+		return u, nil
+	case id != "":
+		u, err := uuid.Parse(id)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("id uuid: %s: %w", id, err)
+		}
+
+		return u, nil
+	default:
+		return uuid.Nil, nil
+	}
+}
+
+// BrigadeID32 - the base32 form of the brigade ID.
+func BrigadeID32(id uuid.UUID) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id[:])
+}
@@ -0,0 +1,47 @@
+package kdlib
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestParseBrigadeID(t *testing.T) {
+	id := uuid.MustParse("0c4d6c9e-5f4b-4b3a-9a59-1e0c8f3a2b71")
+	id32 := BrigadeID32(id)
+
+	tests := []struct {
+		name    string
+		id32    string
+		id      string
+		want    uuid.UUID
+		wantErr bool
+	}{
+		{name: "none", want: uuid.Nil},
+		{name: "base32", id32: id32, want: id},
+		{name: "uuid", id: id.String(), want: id},
+		{name: "both", id32: id32, id: id.String(), wantErr: true},
+		{name: "bad base32", id32: "!!!", wantErr: true},
+		{name: "short base32", id32: "AAAA", wantErr: true},
+		{name: "bad uuid", id: "not-a-uuid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBrigadeID(tt.id32, tt.id)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v, want error: %t", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("id: %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseBrigadeID(id32, id.String()); !errors.Is(err, ErrBrigadeIDForms) {
+		t.Errorf("both forms: %v, want %v", err, ErrBrigadeIDForms)
+	}
+}
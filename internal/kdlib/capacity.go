@@ -0,0 +1,164 @@
+package kdlib
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Address pools names in addition to the brigades ones.
+const (
+	PoolKeydeskIPv6 = "keydesk_ipv6"
+	PoolControlIPv4 = "control_ipv4"
+)
+
+const (
+	// Free slots are counted by the slots view, so the quarantined
+	// endpoints are neither free nor used.
+	sqlCapacityPairs = `
+SELECT
+	p.pair_id,
+	p.control_ip,
+	p.is_active,
+	p.is_draining,
+	EXISTS (SELECT 1 FROM %s AS ap WHERE ap.pair_id = p.pair_id),
+	COUNT(pe.endpoint_ipv4),
+	COUNT(b.brigade_id),
+	(SELECT COUNT(*) FROM %s AS s WHERE s.pair_id = p.pair_id)
+FROM %s AS p
+	LEFT JOIN %s AS pe ON pe.pair_id = p.pair_id
+	LEFT JOIN %s AS b ON b.endpoint_ipv4 = pe.endpoint_ipv4
+GROUP BY p.pair_id
+ORDER BY p.pair_id
+`
+
+	// The pool net gives out the addresses of the bits wide slots,
+	// the weight views are the relative weights for the random pick.
+	sqlCapacityPool = `
+SELECT
+	n.%[3]s,
+	2^(%[5]d - masklen(n.%[3]s)) - %[6]d,
+	COUNT(u.%[4]s)::float8
+FROM %[1]s AS n
+	LEFT JOIN %[2]s AS u ON u.%[4]s <<= n.%[3]s
+GROUP BY n.%[3]s
+ORDER BY n.%[3]s
+`
+)
+
+// PairCapacity - the endpoint slots of the pair.
+// Placeable pairs are the ones the new brigades are placed on.
+type PairCapacity struct {
+	PairID    string     `json:"pair_id"`
+	ControlIP netip.Addr `json:"control_ip"`
+	Active    bool       `json:"active"`
+	Draining  bool       `json:"draining"`
+	Placeable bool       `json:"placeable"`
+	Total     int64      `json:"total"`
+	Used      int64      `json:"used"`
+	Free      int64      `json:"free"`
+}
+
+// PoolCapacity - the slots of the address pool net.
+type PoolCapacity struct {
+	Pool string       `json:"pool"`
+	Net  netip.Prefix `json:"net"`
+	Size float64      `json:"size"`
+	Used float64      `json:"used"`
+	Free float64      `json:"free"`
+}
+
+// Utilization - the used part, 0 for the empty pool.
+func (p PoolCapacity) Utilization() float64 {
+	if p.Size <= 0 {
+		return 0
+	}
+
+	return p.Used / p.Size
+}
+
+// Capacity - where the datacenter capacity is.
+type Capacity struct {
+	Pairs []PairCapacity `json:"pairs"`
+	Pools []PoolCapacity `json:"pools"`
+}
+
+// CollectCapacity - the per-pair and per-pool capacity in the single read-only transaction.
+func CollectCapacity(ctx context.Context, db *pgxpool.Pool, pairsSchema, brigadesSchema string) (*Capacity, error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		fmt.Sprintf(sqlCapacityPairs,
+			pgx.Identifier{brigadesSchema, "active_pairs"}.Sanitize(),
+			pgx.Identifier{brigadesSchema, "slots"}.Sanitize(),
+			pgx.Identifier{pairsSchema, "pairs"}.Sanitize(),
+			pgx.Identifier{pairsSchema, "pairs_endpoints_ipv4"}.Sanitize(),
+			pgx.Identifier{brigadesSchema, "brigades"}.Sanitize(),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("pairs query: %w", err)
+	}
+
+	pairs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PairCapacity, error) {
+		var p PairCapacity
+
+		err := row.Scan(&p.PairID, &p.ControlIP, &p.Active, &p.Draining, &p.Placeable, &p.Total, &p.Used, &p.Free)
+
+		return p, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pairs rows: %w", err)
+	}
+
+	c := &Capacity{Pairs: pairs, Pools: []PoolCapacity{}}
+
+	pairsTable := pgx.Identifier{pairsSchema, "pairs"}.Sanitize()
+	brigades := pgx.Identifier{brigadesSchema, "brigades"}.Sanitize()
+
+	for _, q := range []struct {
+		pool     string
+		nets     string
+		users    string
+		netCol   string
+		userCol  string
+		bits     int
+		reserved int
+	}{
+		{PoolEndpointIPv4, pgx.Identifier{pairsSchema, "ipv4_nets"}.Sanitize(), pgx.Identifier{pairsSchema, "pairs_endpoints_ipv4"}.Sanitize(), "ipv4_net", "endpoint_ipv4", 32, 2},
+		{PoolControlIPv4, pgx.Identifier{pairsSchema, "private_cidr_nets"}.Sanitize(), pairsTable, "ipv4_net", "control_ip", 32, 2},
+		{PoolCGNATIPv4, pgx.Identifier{brigadesSchema, "ipv4_cgnat_nets"}.Sanitize(), brigades, "ipv4_net", "ipv4_cgnat", 24, 0},
+		{PoolULAIPv6, pgx.Identifier{brigadesSchema, "ipv6_ula_nets"}.Sanitize(), brigades, "ipv6_net", "ipv6_ula", 64, 0},
+		{PoolKeydeskIPv6, pgx.Identifier{brigadesSchema, "ipv6_keydesk_nets"}.Sanitize(), brigades, "ipv6_net", "keydesk_ipv6", 128, 0},
+	} {
+		rows, err := tx.Query(ctx, fmt.Sprintf(sqlCapacityPool, q.nets, q.users, q.netCol, q.userCol, q.bits, q.reserved))
+		if err != nil {
+			return nil, fmt.Errorf("%s pools query: %w", q.pool, err)
+		}
+
+		pools, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PoolCapacity, error) {
+			p := PoolCapacity{Pool: q.pool}
+
+			err := row.Scan(&p.Net, &p.Size, &p.Used)
+
+			p.Free = max(p.Size-p.Used, 0)
+
+			return p, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s pools rows: %w", q.pool, err)
+		}
+
+		c.Pools = append(c.Pools, pools...)
+	}
+
+	return c, nil
+}
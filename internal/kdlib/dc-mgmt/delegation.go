@@ -7,7 +7,6 @@ import (
 	"strings"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
 	"golang.org/x/crypto/ssh"
 )
@@ -45,7 +44,7 @@ func SyncDelegationList(sshconf *ssh.ClientConfig, delegationSyncServer, ident,
 	return cleanup, nil
 }
 
-func NewDelegationList(ctx context.Context, db *pgxpool.Pool, schema string) (string, error) {
+func NewDelegationList(ctx context.Context, db Beginner, schema string) (string, error) {
 	tx, err := db.Begin(ctx)
 	if err != nil {
 		return "", fmt.Errorf("begin: %w", err)
@@ -53,12 +52,19 @@ func NewDelegationList(ctx context.Context, db *pgxpool.Pool, schema string) (st
 
 	defer tx.Rollback(ctx)
 
+	// The retiring domains of the rotated brigades are still delegated.
 	sqlGetDelegationList := `
 SELECT 
 	domain_name,
 	endpoint_ipv4 
 FROM 
 	%s
+UNION ALL
+SELECT
+	domain_name,
+	endpoint_ipv4
+FROM
+	%s
 	`
 
 	rows, err := tx.Query(
@@ -66,6 +72,7 @@ FROM
 		fmt.Sprintf(
 			sqlGetDelegationList,
 			pgx.Identifier{schema, "domains_endpoints_ipv4"}.Sanitize(),
+			pgx.Identifier{schema, "domains_retiring"}.Sanitize(),
 		),
 	)
 	if err != nil {
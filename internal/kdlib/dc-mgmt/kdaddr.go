@@ -7,7 +7,6 @@ import (
 	"strings"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
 	"golang.org/x/crypto/ssh"
 )
@@ -45,7 +44,7 @@ func SyncKdAddrList(sshconf *ssh.ClientConfig, kdAddrSyncServer, ident, kdAddrLi
 	return cleanup, nil
 }
 
-func NewKdAddrList(ctx context.Context, db *pgxpool.Pool, schema string) (string, error) {
+func NewKdAddrList(ctx context.Context, db Beginner, schema string) (string, error) {
 	tx, err := db.Begin(ctx)
 	if err != nil {
 		return "", fmt.Errorf("begin: %w", err)
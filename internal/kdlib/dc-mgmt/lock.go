@@ -0,0 +1,50 @@
+package dcmgmt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Advisory lock names.
+const (
+	DelegationSyncLock = "delegation_sync"
+	KdAddrSyncLock     = "kdaddr_sync"
+)
+
+// Beginner - the pool or the connection.
+type Beginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// WithAdvisoryLock - runs f under the session advisory lock,
+// it serializes the actions between all the hosts sharing the database.
+// f gets the locked connection, so it doesn't take another one from the pool.
+func WithAdvisoryLock(ctx context.Context, db *pgxpool.Pool, schema, name string, f func(conn *pgxpool.Conn) error) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire: %w", err)
+	}
+
+	defer conn.Release()
+
+	key := schema + "." + name
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", key); err != nil {
+		return fmt.Errorf("advisory lock: %w", err)
+	}
+
+	ferr := f(conn)
+
+	if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", key); err != nil {
+		// The session lock stays with the connection, don't return it to the pool.
+		conn.Conn().Close(context.Background())
+
+		return errors.Join(ferr, fmt.Errorf("advisory unlock: %w", err))
+	}
+
+	return ferr
+}
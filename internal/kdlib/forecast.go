@@ -0,0 +1,242 @@
+package kdlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The forecasted resources, the brigades take one of every kind
+// except the control IPs which are taken by the pairs.
+const (
+	ResourceEndpointSlots = "endpoint_slots"
+	ResourceCGNAT         = "cgnat_24"
+	ResourceULA           = "ula_64"
+	ResourceKeydesk       = "keydesk_ipv6"
+	ResourceControlIP     = "control_ipv4"
+)
+
+const (
+	DefaultForecastDays  = 30
+	DefaultForecastAlert = 30
+	// ForecastHorizonDays - no exhaustion date beyond, it's out of the time range anyway.
+	ForecastHorizonDays = 3650
+	// DefaultForecastTTL - the forecast of the metrics is recollected not more often.
+	DefaultForecastTTL = 10 * time.Minute
+)
+
+// The purged brigades have left their stats in the archive.
+// The resources are taken on creation and released on purge,
+// the deleted brigades keep them until purged.
+const sqlForecastRates = `
+SELECT
+	(SELECT COUNT(DISTINCT brigade_id) FROM %[1]s WHERE created_at >= now() - make_interval(days => $1))
+		+ (SELECT COUNT(*) FROM %[2]s WHERE (stats->>'created_at')::timestamp >= now() - make_interval(days => $1)),
+	(SELECT COUNT(*) FROM %[3]s WHERE deleted_at >= now() - make_interval(days => $1))
+		+ (SELECT COUNT(*) FROM %[2]s WHERE deleted_at >= now() - make_interval(days => $1)),
+	(SELECT COUNT(*) FROM %[2]s WHERE purged_at >= now() - make_interval(days => $1))
+`
+
+// ForecastParams - the rates are averaged over Days,
+// the resources with less than AlertDays left are alerted.
+type ForecastParams struct {
+	Days      int
+	AlertDays int
+}
+
+// ForecastRates - the brigades created, deleted and purged within the window.
+type ForecastRates struct {
+	Created int64 `json:"created"`
+	Deleted int64 `json:"deleted"`
+	Purged  int64 `json:"purged"`
+}
+
+// ResourceForecast - the projected exhaustion of the resource,
+// no date if the resource isn't consumed or lasts beyond the horizon.
+type ResourceForecast struct {
+	Resource    string     `json:"resource"`
+	Remaining   float64    `json:"remaining"`
+	PerDay      float64    `json:"per_day"`
+	DaysLeft    *float64   `json:"days_left,omitempty"`
+	ExhaustedAt *time.Time `json:"exhausted_at,omitempty"`
+	Alert       bool       `json:"alert"`
+}
+
+// Forecast - when the datacenter resources run out.
+type Forecast struct {
+	Days      int                `json:"window_days"`
+	AlertDays int                `json:"alert_days"`
+	Rates     ForecastRates      `json:"rates"`
+	PerDay    float64            `json:"brigades_per_day"`
+	Resources []ResourceForecast `json:"resources"`
+	Alert     bool               `json:"alert"`
+}
+
+// CollectForecast - the rates over the window and the current capacity.
+func CollectForecast(ctx context.Context, db *pgxpool.Pool, pairsSchema, brigadesSchema, statsSchema string, p ForecastParams) (*Forecast, error) {
+	var r ForecastRates
+
+	if err := db.QueryRow(ctx,
+		fmt.Sprintf(sqlForecastRates,
+			pgx.Identifier{statsSchema, "brigades_stats"}.Sanitize(),
+			pgx.Identifier{brigadesSchema, "brigades_archive"}.Sanitize(),
+			pgx.Identifier{brigadesSchema, "brigades_deleted"}.Sanitize(),
+		),
+		p.Days,
+	).Scan(&r.Created, &r.Deleted, &r.Purged); err != nil {
+		return nil, fmt.Errorf("rates query: %w", err)
+	}
+
+	c, err := CollectCapacity(ctx, db, pairsSchema, brigadesSchema)
+	if err != nil {
+		return nil, fmt.Errorf("capacity: %w", err)
+	}
+
+	return NewForecast(c, r, p, time.Now()), nil
+}
+
+// ForecastCache - the last forecast is kept for TTL, the collection errors aren't cached.
+type ForecastCache struct {
+	TTL time.Duration
+
+	mu sync.Mutex
+	at time.Time
+	f  *Forecast
+}
+
+// Get - the cached forecast or the new one.
+func (c *ForecastCache) Get(now time.Time, collect func() (*Forecast, error)) (*Forecast, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.f != nil && now.Sub(c.at) < c.TTL {
+		return c.f, nil
+	}
+
+	f, err := collect()
+	if err != nil {
+		return nil, err
+	}
+
+	c.f, c.at = f, now
+
+	return f, nil
+}
+
+// NewForecast - projects the net brigades rate on the remaining capacity.
+// The control IPs are consumed by the new pairs as fast as the endpoint slots
+// of the average pair are filled.
+func NewForecast(c *Capacity, r ForecastRates, p ForecastParams, now time.Time) *Forecast {
+	f := &Forecast{
+		Days:      p.Days,
+		AlertDays: p.AlertDays,
+		Rates:     r,
+		Resources: []ResourceForecast{},
+	}
+
+	if p.Days > 0 {
+		f.PerDay = float64(r.Created-r.Purged) / float64(p.Days)
+	}
+
+	remaining := map[string]float64{}
+
+	var endpoints, pairs int64
+
+	for _, pair := range c.Pairs {
+		endpoints += pair.Total
+		pairs++
+
+		if pair.Active && !pair.Draining {
+			remaining[ResourceEndpointSlots] += float64(pair.Free)
+		}
+	}
+
+	for _, pool := range c.Pools {
+		switch pool.Pool {
+		case PoolCGNATIPv4:
+			remaining[ResourceCGNAT] += pool.Free
+		case PoolULAIPv6:
+			remaining[ResourceULA] += pool.Free
+		case PoolKeydeskIPv6:
+			remaining[ResourceKeydesk] += pool.Free
+		case PoolControlIPv4:
+			remaining[ResourceControlIP] += pool.Free
+		}
+	}
+
+	pairRate := 0.0
+	if endpoints > 0 {
+		pairRate = f.PerDay * float64(pairs) / float64(endpoints)
+	}
+
+	for _, res := range []struct {
+		name   string
+		perDay float64
+	}{
+		{ResourceEndpointSlots, f.PerDay},
+		{ResourceCGNAT, f.PerDay},
+		{ResourceULA, f.PerDay},
+		{ResourceKeydesk, f.PerDay},
+		{ResourceControlIP, pairRate},
+	} {
+		rf := ResourceForecast{
+			Resource:  res.name,
+			Remaining: remaining[res.name],
+			PerDay:    res.perDay,
+		}
+
+		if res.perDay > 0 {
+			days := rf.Remaining / res.perDay
+
+			rf.DaysLeft = &days
+			rf.Alert = days <= float64(p.AlertDays)
+
+			if days <= ForecastHorizonDays {
+				at := now.Add(time.Duration(days * float64(24*time.Hour))).UTC().Truncate(time.Second)
+				rf.ExhaustedAt = &at
+			}
+		}
+
+		f.Alert = f.Alert || rf.Alert
+		f.Resources = append(f.Resources, rf)
+	}
+
+	return f
+}
+
+// WritePrometheus - the days left per resource, +Inf if it isn't consumed,
+// and the alert threshold.
+func (f *Forecast) WritePrometheus(w io.Writer, dcName, dcID string) error {
+	p := newPromWriter(w, dcName, dcID)
+
+	left := make([]sample, 0, len(f.Resources))
+	alert := make([]sample, 0, len(f.Resources))
+
+	for _, r := range f.Resources {
+		days := math.Inf(1)
+		if r.DaysLeft != nil {
+			days = *r.DaysLeft
+		}
+
+		a := 0.0
+		if r.Alert {
+			a = 1
+		}
+
+		left = append(left, promSample(days, "resource", r.Resource))
+		alert = append(alert, promSample(a, "resource", r.Resource))
+	}
+
+	p.gauge("vg_dc_brigades_per_day", "Brigades created minus purged per day.", promSample(f.PerDay))
+	p.gauge("vg_dc_exhaustion_days", "Days until the resource runs out.", left...)
+	p.gauge("vg_dc_exhaustion_alert_days", "Alert threshold of the days until the resource runs out.", promSample(float64(f.AlertDays)))
+	p.gauge("vg_dc_exhaustion_alert", "The resource runs out within the alert threshold.", alert...)
+
+	return p.Flush()
+}
@@ -0,0 +1,141 @@
+package kdlib
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestNewForecast(t *testing.T) {
+	c := &Capacity{
+		Pairs: []PairCapacity{
+			{Active: true, Total: 10, Used: 4, Free: 6},
+			{Active: true, Draining: true, Total: 10, Used: 2, Free: 8}, // not placeable
+			{Active: false, Total: 10, Free: 10},                        // not placeable
+		},
+		Pools: []PoolCapacity{
+			{Pool: PoolCGNATIPv4, Net: netip.MustParsePrefix("100.64.0.0/16"), Free: 200},
+			{Pool: PoolCGNATIPv4, Net: netip.MustParsePrefix("100.65.0.0/16"), Free: 100},
+			{Pool: PoolControlIPv4, Net: netip.MustParsePrefix("10.0.0.0/24"), Free: 2},
+		},
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	f := NewForecast(c, ForecastRates{Created: 40, Deleted: 30, Purged: 10}, ForecastParams{Days: 10, AlertDays: 5}, now)
+
+	if f.PerDay != 3 {
+		t.Fatalf("per day: %v", f.PerDay)
+	}
+
+	want := map[string]struct {
+		remaining float64
+		days      float64
+		alert     bool
+	}{
+		ResourceEndpointSlots: {6, 2, true},
+		ResourceCGNAT:         {300, 100, false},
+		ResourceControlIP:     {2, 20.0 / 3, false}, // 3 brigades per day fill 0.3 pairs of 10 endpoints
+		ResourceULA:           {0, 0, true},
+		ResourceKeydesk:       {0, 0, true},
+	}
+
+	for _, r := range f.Resources {
+		w, ok := want[r.Resource]
+		if !ok {
+			t.Fatalf("unexpected resource: %s", r.Resource)
+		}
+
+		if r.Remaining != w.remaining {
+			t.Errorf("%s remaining: got %v, want %v", r.Resource, r.Remaining, w.remaining)
+		}
+
+		if r.DaysLeft == nil || math.Abs(*r.DaysLeft-w.days) > 1e-9 {
+			t.Errorf("%s days left: got %v, want %v", r.Resource, r.DaysLeft, w.days)
+		}
+
+		if r.Alert != w.alert {
+			t.Errorf("%s alert: got %v, want %v", r.Resource, r.Alert, w.alert)
+		}
+	}
+
+	if at := f.Resources[0].ExhaustedAt; at == nil || !at.Equal(now.Add(48*time.Hour)) {
+		t.Errorf("exhausted at: %v", at)
+	}
+
+	if !f.Alert {
+		t.Errorf("no alert")
+	}
+}
+
+func TestNewForecastNotConsumed(t *testing.T) {
+	f := NewForecast(&Capacity{}, ForecastRates{Created: 5, Purged: 10}, ForecastParams{Days: 10, AlertDays: 5}, time.Now())
+
+	for _, r := range f.Resources {
+		if r.DaysLeft != nil || r.ExhaustedAt != nil || r.Alert {
+			t.Errorf("%s is forecasted: %+v", r.Resource, r)
+		}
+	}
+
+	if f.Alert {
+		t.Errorf("alert")
+	}
+}
+
+func TestNewForecastHorizon(t *testing.T) {
+	c := &Capacity{Pools: []PoolCapacity{{Pool: PoolKeydeskIPv6, Free: math.Pow(2, 64)}}}
+
+	f := NewForecast(c, ForecastRates{Created: 10}, ForecastParams{Days: 10, AlertDays: 5}, time.Now())
+
+	for _, r := range f.Resources {
+		if r.Resource != ResourceKeydesk {
+			continue
+		}
+
+		if r.DaysLeft == nil || r.ExhaustedAt != nil || r.Alert {
+			t.Errorf("beyond the horizon: %+v", r)
+		}
+	}
+}
+
+func TestForecastCache(t *testing.T) {
+	c := &ForecastCache{TTL: time.Minute}
+	now := time.Now()
+	calls := 0
+
+	collect := func() (*Forecast, error) {
+		calls++
+
+		return &Forecast{Days: calls}, nil
+	}
+
+	for _, tt := range []struct {
+		at    time.Duration
+		calls int
+	}{
+		{0, 1},
+		{30 * time.Second, 1},
+		{time.Minute, 2},
+	} {
+		f, err := c.Get(now.Add(tt.at), collect)
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+
+		if calls != tt.calls || f.Days != tt.calls {
+			t.Errorf("at %s: calls %d, forecast %d, want %d", tt.at, calls, f.Days, tt.calls)
+		}
+	}
+
+	errCollect := errors.New("collect")
+
+	if _, err := c.Get(now.Add(2*time.Minute), func() (*Forecast, error) { return nil, errCollect }); !errors.Is(err, errCollect) {
+		t.Errorf("error: %v", err)
+	}
+
+	if f, _ := c.Get(now.Add(2*time.Minute), collect); f.Days != 3 {
+		t.Errorf("error is cached: %+v", f)
+	}
+}
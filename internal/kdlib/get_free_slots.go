@@ -10,8 +10,8 @@ const (
 	sqlGetActiveFreeSlotsNumber = "SELECT COALESCE(SUM(free_slots_count),0) FROM %s"
 	sqlGetTotalFreeSlotsNumber  = "SELECT COUNT(*) FROM %s"
 
-	sqlGetTotalAllSlotsNumber  = "SELECT COUNT(*) FROM %s"                                                               // pairs.pairs_endpoints_ipv4
-	sqlGetActiveAllSlotsNumber = "SELECT COUNT(p.*) FROM %s p JOIN %s pe ON p.pair_id=pe.pair_id WHERE p.is_active=true" // pairs.pairs, pairs.pairs_endpoints_ipv4
+	sqlGetTotalAllSlotsNumber  = "SELECT COUNT(*) FROM %s"                                                                                       // pairs.pairs_endpoints_ipv4
+	sqlGetActiveAllSlotsNumber = "SELECT COUNT(p.*) FROM %s p JOIN %s pe ON p.pair_id=pe.pair_id WHERE p.is_active=true AND p.is_draining=false" // pairs.pairs, pairs.pairs_endpoints_ipv4
 )
 
 const (
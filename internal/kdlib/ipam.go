@@ -0,0 +1,292 @@
+package kdlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// maxSlotIndexBits - slots are numbered by uint64, larger windows use the first 2^64 slots only.
+const maxSlotIndexBits = 64
+
+var (
+	ErrPoolExhausted  = errors.New("pool exhausted")
+	ErrInvalidPool    = errors.New("invalid pool")
+	ErrNotInPool      = errors.New("address is not in pool")
+	ErrSlotIsTooSmall = errors.New("slot is too small")
+)
+
+// Pool - free-list of the equal sized slots (subnets or addresses) inside the window prefix.
+// Used slots are kept as a sorted list of the slot indexes, so the free slot
+// is found by the binary search over the gaps between used slots.
+type Pool struct {
+	window netip.Prefix
+	bits   int // slot prefix length
+	shift  int // address bits inside the slot
+	size   uint64
+	base   u128
+	used   []uint64
+
+	// Skip - slots which must never be picked, e.g. zero ending addresses.
+	Skip func(slot netip.Prefix) bool
+}
+
+// NewPool - creates the pool of /slotBits slots inside the window.
+// The used addresses may be any addresses inside the slots, others are ignored.
+func NewPool(window netip.Prefix, slotBits int, used []netip.Addr) (*Pool, error) {
+	if !window.IsValid() || slotBits < window.Bits() || slotBits > window.Addr().BitLen() {
+		return nil, fmt.Errorf("%w: %s/%d", ErrInvalidPool, window, slotBits)
+	}
+
+	window = window.Masked()
+
+	p := &Pool{
+		window: window,
+		bits:   slotBits,
+		shift:  window.Addr().BitLen() - slotBits,
+		base:   u128From(window.Addr()),
+	}
+
+	switch n := slotBits - window.Bits(); {
+	case n >= maxSlotIndexBits:
+		p.size = ^uint64(0)
+	default:
+		p.size = uint64(1) << n
+	}
+
+	p.used = make([]uint64, 0, len(used))
+
+	for _, addr := range used {
+		if idx, ok := p.index(addr); ok {
+			p.used = append(p.used, idx)
+		}
+	}
+
+	slices.Sort(p.used)
+	p.used = slices.Compact(p.used)
+
+	return p, nil
+}
+
+// Window - the pool prefix.
+func (p *Pool) Window() netip.Prefix {
+	return p.window
+}
+
+// Size - number of the slots in the pool.
+func (p *Pool) Size() uint64 {
+	return p.size
+}
+
+// Free - number of the unused slots, skipped slots are counted as free.
+func (p *Pool) Free() uint64 {
+	return p.size - uint64(len(p.used))
+}
+
+// Use - marks the slot containing addr as used.
+func (p *Pool) Use(addr netip.Addr) error {
+	idx, ok := p.index(addr)
+	if !ok {
+		return fmt.Errorf("%w: %s: %s", ErrNotInPool, addr, p.window)
+	}
+
+	i, found := slices.BinarySearch(p.used, idx)
+	if !found {
+		p.used = slices.Insert(p.used, i, idx)
+	}
+
+	return nil
+}
+
+// Pick - finds the free slot. The lowest free slot is picked if random is false,
+// otherwise every free slot has the equal chance. The skipped slot is replaced
+// by the next free one. Both ways take O(log(used)) per a skipped slot.
+func (p *Pool) Pick(random bool) (netip.Prefix, error) {
+	idx, ok := p.freeFrom(0)
+	if ok && random {
+		idx = p.nthFree(randUint64n(p.Free()))
+	}
+
+	for tries := uint64(0); ok && tries <= p.Free(); tries++ {
+		slot := p.slot(idx)
+		if p.Skip == nil || !p.Skip(slot) {
+			return slot, nil
+		}
+
+		if idx < p.size-1 {
+			idx, ok = p.freeFrom(idx + 1)
+		} else {
+			ok = false
+		}
+
+		if !ok {
+			idx, ok = p.freeFrom(0)
+		}
+	}
+
+	return netip.Prefix{}, fmt.Errorf("%w: %s/%d", ErrPoolExhausted, p.window, p.bits)
+}
+
+// freeFrom - the first free slot index not less than start.
+func (p *Pool) freeFrom(start uint64) (uint64, bool) {
+	k := sort.Search(len(p.used), func(i int) bool { return p.used[i] >= start })
+	if k == len(p.used) || p.used[k] != start {
+		return start, start < p.size
+	}
+
+	// used[k:] starts with the run of the consecutive slots,
+	// the run ends where used[j]-used[k] breaks from j-k.
+	n := sort.Search(len(p.used)-k, func(i int) bool { return p.used[k+i]-p.used[k] != uint64(i) })
+	next := p.used[k] + uint64(n)
+
+	return next, next < p.size && next >= start
+}
+
+// nthFree - the index of the n-th free slot counting from zero, n must be less than Free.
+// There are used[i]-i free slots below used[i].
+func (p *Pool) nthFree(n uint64) uint64 {
+	k := sort.Search(len(p.used), func(i int) bool { return p.used[i]-uint64(i) > n })
+
+	return n + uint64(k)
+}
+
+func (p *Pool) index(addr netip.Addr) (uint64, bool) {
+	if !p.window.Contains(addr) {
+		return 0, false
+	}
+
+	off := u128From(addr).sub(p.base).rsh(p.shift)
+	if off.hi != 0 || off.lo >= p.size {
+		return 0, false
+	}
+
+	return off.lo, true
+}
+
+func (p *Pool) slot(idx uint64) netip.Prefix {
+	addr := p.base.or(u128{lo: idx}.lsh(p.shift)).addr(p.window.Addr().Is4())
+
+	return netip.PrefixFrom(addr, p.bits)
+}
+
+// HostInSlot - host address inside the slot, network, last and zero ending addresses are avoided.
+// The first host is returned if random is false.
+func HostInSlot(slot netip.Prefix, random bool) (netip.Addr, error) {
+	slot = slot.Masked()
+
+	n := slot.Addr().BitLen() - slot.Bits()
+	if n < 2 {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrSlotIsTooSmall, slot)
+	}
+
+	x := uint64(1)
+	if random {
+		last := ^uint64(0)
+		if n < 64 {
+			last = uint64(1)<<n - 1
+		}
+
+		// [1, last-1]
+		x = 1 + randUint64n(last-1)
+	}
+
+	addr := u128From(slot.Addr()).or(u128{lo: x}).addr(slot.Addr().Is4())
+	if IsZeroEnding(addr) {
+		addr = u128From(addr).or(u128{lo: 1}).addr(addr.Is4())
+	}
+
+	return addr, nil
+}
+
+// randUint64n - random value in [0, n).
+func randUint64n(n uint64) uint64 {
+	if n <= 1 {
+		return 0
+	}
+
+	if n < 1<<63 {
+		return uint64(rand.Int63n(int64(n)))
+	}
+
+	for {
+		if x := rand.Uint64(); x < n {
+			return x
+		}
+	}
+}
+
+// u128 - ip address as the 128 bit number.
+type u128 struct {
+	hi, lo uint64
+}
+
+func u128From(addr netip.Addr) u128 {
+	if addr.Is4() {
+		b := addr.As4()
+
+		return u128{lo: uint64(binary.BigEndian.Uint32(b[:]))}
+	}
+
+	b := addr.As16()
+
+	return u128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (u u128) addr(is4 bool) netip.Addr {
+	if is4 {
+		var b [4]byte
+
+		binary.BigEndian.PutUint32(b[:], uint32(u.lo))
+
+		return netip.AddrFrom4(b)
+	}
+
+	var b [16]byte
+
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+
+	return netip.AddrFrom16(b)
+}
+
+func (u u128) sub(v u128) u128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	hi, _ := bits.Sub64(u.hi, v.hi, borrow)
+
+	return u128{hi: hi, lo: lo}
+}
+
+func (u u128) or(v u128) u128 {
+	return u128{hi: u.hi | v.hi, lo: u.lo | v.lo}
+}
+
+func (u u128) rsh(n int) u128 {
+	switch {
+	case n == 0:
+		return u
+	case n >= 128:
+		return u128{}
+	case n >= 64:
+		return u128{lo: u.hi >> (n - 64)}
+	default:
+		return u128{hi: u.hi >> n, lo: u.lo>>n | u.hi<<(64-n)}
+	}
+}
+
+func (u u128) lsh(n int) u128 {
+	switch {
+	case n == 0:
+		return u
+	case n >= 128:
+		return u128{}
+	case n >= 64:
+		return u128{hi: u.lo << (n - 64)}
+	default:
+		return u128{hi: u.hi<<n | u.lo>>(64-n), lo: u.lo << n}
+	}
+}
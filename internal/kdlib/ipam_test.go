@@ -0,0 +1,234 @@
+package kdlib
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// fillPool - returns all slot addresses of the window except the free ones.
+func fillPool(t testing.TB, window netip.Prefix, slotBits int, free map[uint64]struct{}) []netip.Addr {
+	p, err := NewPool(window, slotBits, nil)
+	if err != nil {
+		t.Fatalf("new pool: %s", err)
+	}
+
+	used := make([]netip.Addr, 0, p.Size())
+
+	for i := uint64(0); i < p.Size(); i++ {
+		if _, ok := free[i]; ok {
+			continue
+		}
+
+		used = append(used, p.slot(i).Addr())
+	}
+
+	return used
+}
+
+func TestPoolPickSequential(t *testing.T) {
+	window := netip.MustParsePrefix("100.64.0.0/16")
+
+	used := []netip.Addr{
+		netip.MustParseAddr("100.64.0.1"),
+		netip.MustParseAddr("100.64.1.17"),
+		netip.MustParseAddr("100.64.1.200"), // the same /24
+		netip.MustParseAddr("100.64.3.1"),
+		netip.MustParseAddr("10.0.0.1"), // out of the window
+	}
+
+	p, err := NewPool(window, 24, used)
+	if err != nil {
+		t.Fatalf("new pool: %s", err)
+	}
+
+	if p.Free() != 256-3 {
+		t.Errorf("free: want %d got %d", 256-3, p.Free())
+	}
+
+	for _, want := range []string{"100.64.2.0/24", "100.64.4.0/24", "100.64.5.0/24"} {
+		slot, err := p.Pick(false)
+		if err != nil {
+			t.Fatalf("pick: %s", err)
+		}
+
+		if slot.String() != want {
+			t.Errorf("pick: want %s got %s", want, slot)
+		}
+
+		if err := p.Use(slot.Addr()); err != nil {
+			t.Fatalf("use: %s", err)
+		}
+	}
+}
+
+func TestPoolPickRandom(t *testing.T) {
+	window := netip.MustParsePrefix("fd00::/48")
+	// The free slots are clustered, every one must have the equal chance anyway.
+	free := map[uint64]struct{}{7: {}, 8: {}, 43690: {}}
+
+	p, err := NewPool(window, 64, fillPool(t, window, 64, free))
+	if err != nil {
+		t.Fatalf("new pool: %s", err)
+	}
+
+	seen := make(map[string]int)
+
+	for i := 0; i < attempts; i++ {
+		slot, err := p.Pick(true)
+		if err != nil {
+			t.Fatalf("pick: %s", err)
+		}
+
+		idx, ok := p.index(slot.Addr())
+		if !ok {
+			t.Fatalf("pick: %s is out of %s", slot, window)
+		}
+
+		if _, ok := free[idx]; !ok {
+			t.Errorf("pick: %s is used", slot)
+		}
+
+		seen[slot.String()]++
+	}
+
+	// About a third of the attempts each, the bound is far below to never flake.
+	for idx := range free {
+		if n := seen[p.slot(idx).String()]; n < attempts/len(free)/3 {
+			t.Errorf("pick: not uniform: %v", seen)
+		}
+	}
+
+	for range free {
+		slot, err := p.Pick(true)
+		if err != nil {
+			t.Fatalf("pick: %s", err)
+		}
+
+		if err := p.Use(slot.Addr()); err != nil {
+			t.Fatalf("use: %s", err)
+		}
+	}
+
+	if _, err := p.Pick(true); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("pick from the full pool: want %s got %v", ErrPoolExhausted, err)
+	}
+}
+
+func TestPoolSkip(t *testing.T) {
+	window := netip.MustParsePrefix("fd01::/112")
+
+	p, err := NewPool(window, 128, []netip.Addr{netip.MustParseAddr("fd01::1")})
+	if err != nil {
+		t.Fatalf("new pool: %s", err)
+	}
+
+	p.Skip = func(slot netip.Prefix) bool { return IsZeroEnding(slot.Addr()) }
+
+	for i := 0; i < attempts; i++ {
+		slot, err := p.Pick(i%2 == 0)
+		if err != nil {
+			t.Fatalf("pick: %s", err)
+		}
+
+		if IsZeroEnding(slot.Addr()) || slot.Addr() == netip.MustParseAddr("fd01::1") {
+			t.Errorf("pick: got %s", slot)
+		}
+	}
+}
+
+func TestHostInSlot(t *testing.T) {
+	for _, s := range []string{"100.64.7.0/24", "fd00:0:0:5::/64", "192.168.0.0/16"} {
+		slot := netip.MustParsePrefix(s)
+
+		last := LastPrefixIPv4
+		if slot.Addr().Is6() {
+			last = LastPrefixIPv6
+		}
+
+		for i := 0; i < attempts; i++ {
+			addr, err := HostInSlot(slot, i > 0)
+			if err != nil {
+				t.Fatalf("host: %s", err)
+			}
+
+			if !slot.Contains(addr) || addr == slot.Addr() || addr == last(slot) || IsZeroEnding(addr) {
+				t.Errorf("slot: %s got: %s", slot, addr)
+			}
+		}
+	}
+}
+
+// nearFull - /10 CGNAT window with the only free /24 slot.
+func nearFull(b *testing.B) (netip.Prefix, []netip.Addr) {
+	window := netip.MustParsePrefix("100.64.0.0/10")
+
+	return window, fillPool(b, window, 24, map[uint64]struct{}{12345: {}})
+}
+
+func BenchmarkPoolPickNearFull(b *testing.B) {
+	window, used := nearFull(b)
+
+	p, err := NewPool(window, 24, used)
+	if err != nil {
+		b.Fatalf("new pool: %s", err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Pick(false); err != nil {
+			b.Fatalf("pick: %s", err)
+		}
+	}
+}
+
+func BenchmarkPoolPickRandomNearFull(b *testing.B) {
+	window, used := nearFull(b)
+
+	p, err := NewPool(window, 24, used)
+	if err != nil {
+		b.Fatalf("new pool: %s", err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Pick(true); err != nil {
+			b.Fatalf("pick: %s", err)
+		}
+	}
+}
+
+func BenchmarkNewPoolNearFull(b *testing.B) {
+	window, used := nearFull(b)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := NewPool(window, 24, used); err != nil {
+			b.Fatalf("new pool: %s", err)
+		}
+	}
+}
+
+// BenchmarkRandomAttemptsNearFull - the former way: random probes until the free slot is hit.
+func BenchmarkRandomAttemptsNearFull(b *testing.B) {
+	window, used := nearFull(b)
+
+	busy := make(map[netip.Addr]struct{}, len(used))
+	for _, addr := range used {
+		busy[addr] = struct{}{}
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for {
+			slot := netip.PrefixFrom(RandomAddrIPv4(window), 24).Masked()
+			if _, ok := busy[slot.Addr()]; !ok {
+				break
+			}
+		}
+	}
+}
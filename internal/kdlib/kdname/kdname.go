@@ -0,0 +1,145 @@
+// Package kdname converts keydesk IPv6 addresses to host names and back.
+package kdname
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Naming schemes.
+const (
+	// SchemeLegacy - fd12:3456::1 is w12s3456ss1, only fd-prefixed addresses.
+	SchemeLegacy = "legacy"
+	// SchemeHex - x followed by 32 hex digits of the address, any IPv6 address.
+	SchemeHex = "hex"
+)
+
+const (
+	legacyPrefix = "fd"
+	legacyMark   = "w"
+	legacySep    = "s"
+	hexMark      = "x"
+)
+
+var (
+	ErrUnknownScheme = errors.New("unknown scheme")
+	ErrNotIPv6       = errors.New("not ipv6 address")
+	ErrNotLegacy     = errors.New("address doesn't start with fd")
+	ErrInvalidLabel  = errors.New("invalid label")
+	ErrOutOfZone     = errors.New("name out of zone")
+)
+
+// Codec - keydesk names in the zone.
+type Codec struct {
+	zone   string
+	scheme string
+}
+
+// New - the codec for the zone, the legacy scheme is used by default.
+func New(zone, scheme string) (*Codec, error) {
+	switch scheme {
+	case "":
+		scheme = SchemeLegacy
+	case SchemeLegacy, SchemeHex:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+
+	return &Codec{
+		zone:   strings.ToLower(strings.Trim(zone, ".")),
+		scheme: scheme,
+	}, nil
+}
+
+// Zone - the zone of names.
+func (c *Codec) Zone() string {
+	return c.zone
+}
+
+// Scheme - the naming scheme.
+func (c *Codec) Scheme() string {
+	return c.scheme
+}
+
+// Encode - the host name of the keydesk address, without the trailing dot.
+func (c *Codec) Encode(addr netip.Addr) (string, error) {
+	label, err := EncodeLabel(addr, c.scheme)
+	if err != nil {
+		return "", err
+	}
+
+	if c.zone == "" {
+		return label, nil
+	}
+
+	return label + "." + c.zone, nil
+}
+
+// Decode - the keydesk address of the host name, the name must be in the zone.
+func (c *Codec) Decode(name string) (netip.Addr, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	label, rest, _ := strings.Cut(name, ".")
+	if rest != c.zone {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrOutOfZone, name)
+	}
+
+	return DecodeLabel(label, c.scheme)
+}
+
+// EncodeLabel - the first label of the keydesk name.
+func EncodeLabel(addr netip.Addr, scheme string) (string, error) {
+	if !addr.Is6() || addr.Is4In6() || addr.Zone() != "" {
+		return "", fmt.Errorf("%w: %s", ErrNotIPv6, addr)
+	}
+
+	switch scheme {
+	case "", SchemeLegacy:
+		s := addr.String()
+		if !strings.HasPrefix(s, legacyPrefix) {
+			return "", fmt.Errorf("%w: %s", ErrNotLegacy, addr)
+		}
+
+		return legacyMark + strings.ReplaceAll(s[len(legacyPrefix):], ":", legacySep), nil
+	case SchemeHex:
+		buf := addr.As16()
+
+		return hexMark + hex.EncodeToString(buf[:]), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+}
+
+// DecodeLabel - the keydesk address of the first label.
+func DecodeLabel(label, scheme string) (netip.Addr, error) {
+	label = strings.ToLower(label)
+
+	switch scheme {
+	case "", SchemeLegacy:
+		if !strings.HasPrefix(label, legacyMark) || strings.Contains(label, ":") {
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidLabel, label)
+		}
+
+		s := legacyPrefix + strings.ReplaceAll(label[len(legacyMark):], legacySep, ":")
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is6() || addr.Is4In6() || addr.String() != s {
+			// Only the canonical form, one address has one name.
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidLabel, label)
+		}
+
+		return addr, nil
+	case SchemeHex:
+		buf, err := hex.DecodeString(strings.TrimPrefix(label, hexMark))
+		if err != nil || !strings.HasPrefix(label, hexMark) || len(buf) != 16 {
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidLabel, label)
+		}
+
+		return netip.AddrFrom16([16]byte(buf)), nil
+	default:
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+}
@@ -0,0 +1,157 @@
+package kdname
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+var legacyNames = [...]struct {
+	addr, label string
+}{
+	{"fd12:3456:789a:bcde:f012:3456:789a:bcde", "w12s3456s789asbcdesf012s3456s789asbcde"},
+	{"fd12:3456::1", "w12s3456ss1"},
+	{"fd00::", "w00ss"},
+	{"fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "wffsffffsffffsffffsffffsffffsffffsffff"},
+	{"fd::1", "wss1"}, // 00fd::1
+}
+
+func TestLegacyLabels(t *testing.T) {
+	for _, v := range legacyNames {
+		addr := netip.MustParseAddr(v.addr)
+
+		label, err := EncodeLabel(addr, SchemeLegacy)
+		if err != nil {
+			t.Fatalf("encode: %s: %s", v.addr, err)
+		}
+
+		if label != v.label {
+			t.Errorf("encode: %s: want %s got %s", v.addr, v.label, label)
+		}
+
+		back, err := DecodeLabel(label, SchemeLegacy)
+		if err != nil {
+			t.Fatalf("decode: %s: %s", label, err)
+		}
+
+		if back != addr {
+			t.Errorf("decode: %s: want %s got %s", label, addr, back)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	addrs := []string{
+		"fd12:3456::1",
+		"fd00::",
+		"fdab:cd::ef",
+		"fd12:0:0:1::",
+		"fd12::1:0:0:1",
+	}
+
+	for _, scheme := range []string{SchemeLegacy, SchemeHex} {
+		c, err := New("vpn.works.", scheme)
+		if err != nil {
+			t.Fatalf("new: %s: %s", scheme, err)
+		}
+
+		for _, s := range addrs {
+			addr := netip.MustParseAddr(s)
+
+			name, err := c.Encode(addr)
+			if err != nil {
+				t.Fatalf("%s: encode: %s: %s", scheme, s, err)
+			}
+
+			for _, n := range []string{name, name + ".", strings.ToUpper(name)} {
+				back, err := c.Decode(n)
+				if err != nil {
+					t.Fatalf("%s: decode: %s: %s", scheme, n, err)
+				}
+
+				if back != addr {
+					t.Errorf("%s: decode: %s: want %s got %s", scheme, n, addr, back)
+				}
+			}
+		}
+	}
+}
+
+func TestHexAnyPrefix(t *testing.T) {
+	c, err := New("vpn.works", SchemeHex)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	for _, s := range []string{"::1", "fc00::1", "2001:db8::", "::"} {
+		addr := netip.MustParseAddr(s)
+
+		name, err := c.Encode(addr)
+		if err != nil {
+			t.Fatalf("encode: %s: %s", s, err)
+		}
+
+		back, err := c.Decode(name)
+		if err != nil {
+			t.Fatalf("decode: %s: %s", name, err)
+		}
+
+		if back != addr {
+			t.Errorf("decode: %s: want %s got %s", name, addr, back)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c, err := New("vpn.works", SchemeLegacy)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	if _, err := New("vpn.works", "base64"); !errors.Is(err, ErrUnknownScheme) {
+		t.Errorf("unknown scheme: got %v", err)
+	}
+
+	for _, s := range []string{"fc00::1", "::1", "2001:db8::1"} {
+		if _, err := c.Encode(netip.MustParseAddr(s)); !errors.Is(err, ErrNotLegacy) {
+			t.Errorf("encode: %s: want ErrNotLegacy got %v", s, err)
+		}
+	}
+
+	for _, s := range []string{"192.168.1.1", "::ffff:192.168.1.1"} {
+		if _, err := c.Encode(netip.MustParseAddr(s)); !errors.Is(err, ErrNotIPv6) {
+			t.Errorf("encode: %s: want ErrNotIPv6 got %v", s, err)
+		}
+	}
+
+	if _, err := c.Decode("w12s3456ss1.example.com"); !errors.Is(err, ErrOutOfZone) {
+		t.Errorf("decode: want ErrOutOfZone got %v", err)
+	}
+
+	for _, label := range []string{
+		"x12s3456ss1",            // not legacy
+		"w12s3456ss1ss2",         // double ::
+		"w0012s3456ss1",          // not canonical
+		"w12s3456s0ss1",          // not canonical, :0:: is ::
+		"w12s3456sss1",           // :::
+		"w12s3456s1s2s3s4s5s6s7", // 9 groups
+		"w12s3456ss1.",           // not a label
+		"wzzss1",                 // not hex
+		"w12s3456s0s0s0s0s0s1",   // not canonical
+		"w12s3456:1",             // colon
+		"",                       // empty
+		"w",                      // fd is not an address
+		"w12s3456s789asbcdesf012s3456s789asbcd1e", // group too long
+	} {
+		if _, err := DecodeLabel(label, SchemeLegacy); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("decode: %q: want ErrInvalidLabel got %v", label, err)
+		}
+	}
+
+	for _, label := range []string{"fd120000000000000000000000000001", "x12", "xzz120000000000000000000000000001"} {
+		if _, err := DecodeLabel(label, SchemeHex); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("decode hex: %q: want ErrInvalidLabel got %v", label, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package logging - structured logs of the commands, every record has the operation ID.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Attribute keys.
+const (
+	KeyCmd       = "cmd"
+	KeyOp        = "op_id"
+	KeyBrigade   = "brigade_id"
+	KeyControlIP = "control_ip"
+	KeyPair      = "pair_id"
+	KeyStep      = "step"
+	KeyError     = "error"
+)
+
+// OpIDEnv - the operation ID is inherited from the caller and passed to the nodes in this variable.
+const OpIDEnv = "OP_ID"
+
+const opIDLen = 8 // bytes
+
+var (
+	ErrUnknownFormat = errors.New("unknown log format")
+	ErrUnknownLevel  = errors.New("unknown log level")
+)
+
+var opID = initOpID()
+
+func initOpID() string {
+	if id := os.Getenv(OpIDEnv); id != "" {
+		return id
+	}
+
+	return NewOpID()
+}
+
+// NewOpID - random operation ID.
+func NewOpID() string {
+	buf := make([]byte, opIDLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// OpID - the operation ID of the invocation.
+func OpID() string {
+	return opID
+}
+
+// New - the logger with the command name and the operation ID,
+// the format and the level are set by LOG_FORMAT (text|json) and LOG_LEVEL (debug|info|warn|error).
+func New(w io.Writer, cmd string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownLevel, level)
+		}
+
+		opts.Level = l
+	}
+
+	var h slog.Handler
+
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+
+	return slog.New(h).With(KeyCmd, cmd, KeyOp, opID), nil
+}
+
+// Setup - makes the command logger the default one,
+// the standard log package writes through it too.
+func Setup(cmd string) *slog.Logger {
+	logger, err := New(os.Stderr, cmd)
+	if err != nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil)).With(KeyCmd, cmd, KeyOp, opID)
+		logger.Warn("fallback to the text log", KeyError, err)
+	}
+
+	slog.SetDefault(logger)
+
+	return logger
+}
+
+// Fatal - logs the error and exits.
+func Fatal(logger *slog.Logger, msg string, err error, args ...any) {
+	logger.Error(msg, append([]any{KeyError, err}, args...)...)
+
+	os.Exit(1)
+}
+
+// Lines - multiline output as a list for the log record.
+func Lines(s string) []string {
+	return strings.Split(strings.TrimRight(s, "\n"), "\n")
+}
+
+type ctxKey struct{}
+
+// WithContext - the logger for the operation steps.
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// FromContext - the logger of the context or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// With - the context logger with more attributes.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithContext(ctx, FromContext(ctx).With(args...))
+}
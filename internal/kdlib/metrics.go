@@ -0,0 +1,196 @@
+package kdlib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Address pools names.
+const (
+	PoolEndpointIPv4 = "endpoint_ipv4"
+	PoolCGNATIPv4    = "cgnat_ipv4"
+	PoolULAIPv6      = "ula_ipv6"
+)
+
+const sqlMetricsBrigades = `
+SELECT
+	COUNT(*),
+	COUNT(d.brigade_id)
+FROM %s AS b
+	LEFT JOIN %s AS d ON d.brigade_id = b.brigade_id
+`
+
+// Pair states, the draining pairs are neither active nor inactive.
+const (
+	StateActive   = "active"
+	StateDraining = "draining"
+	StateInactive = "inactive"
+)
+
+// PairsCount - the pairs, their endpoint slots and the free ones.
+type PairsCount struct {
+	Pairs int64
+	Slots int64
+	Free  int64
+}
+
+func (c *PairsCount) add(p PairCapacity) {
+	c.Pairs++
+	c.Slots += p.Total
+	c.Free += p.Free
+}
+
+// DCMetrics - the datacenter capacity snapshot.
+type DCMetrics struct {
+	Total  PairsCount
+	States map[string]*PairsCount
+
+	BrigadesTotal   int
+	BrigadesDeleted int
+
+	Pools []PoolCapacity
+}
+
+// NewDCMetrics - the pairs by state and the pools of the capacity.
+func NewDCMetrics(c *Capacity) *DCMetrics {
+	m := &DCMetrics{
+		States: map[string]*PairsCount{StateActive: {}, StateDraining: {}, StateInactive: {}},
+		Pools:  c.Pools,
+	}
+
+	for _, p := range c.Pairs {
+		m.Total.add(p)
+
+		switch {
+		case !p.Active:
+			m.States[StateInactive].add(p)
+		case p.Draining:
+			m.States[StateDraining].add(p)
+		default:
+			m.States[StateActive].add(p)
+		}
+	}
+
+	return m
+}
+
+// CollectDCMetrics - the capacity and the brigades counts.
+func CollectDCMetrics(ctx context.Context, db *pgxpool.Pool, pairsSchema, brigadesSchema string) (*DCMetrics, error) {
+	c, err := CollectCapacity(ctx, db, pairsSchema, brigadesSchema)
+	if err != nil {
+		return nil, fmt.Errorf("capacity: %w", err)
+	}
+
+	m := NewDCMetrics(c)
+
+	if err := db.QueryRow(ctx,
+		fmt.Sprintf(sqlMetricsBrigades,
+			pgx.Identifier{brigadesSchema, "brigades"}.Sanitize(),
+			pgx.Identifier{brigadesSchema, "brigades_deleted"}.Sanitize(),
+		),
+	).Scan(&m.BrigadesTotal, &m.BrigadesDeleted); err != nil {
+		return nil, fmt.Errorf("brigades query: %w", err)
+	}
+
+	return m, nil
+}
+
+// WritePrometheus - the metrics in the Prometheus text format,
+// every metric is labelled with the datacenter.
+func (m *DCMetrics) WritePrometheus(w io.Writer, dcName, dcID string) error {
+	p := newPromWriter(w, dcName, dcID)
+
+	var slots, free, pairs []sample
+
+	for _, st := range []struct {
+		state string
+		c     *PairsCount
+	}{
+		{"total", &m.Total},
+		{StateActive, m.States[StateActive]},
+		{StateDraining, m.States[StateDraining]},
+		{StateInactive, m.States[StateInactive]},
+	} {
+		if st.c == nil {
+			st.c = &PairsCount{}
+		}
+
+		slots = append(slots, promSample(float64(st.c.Slots), "state", st.state))
+		free = append(free, promSample(float64(st.c.Free), "state", st.state))
+		pairs = append(pairs, promSample(float64(st.c.Pairs), "state", st.state))
+	}
+
+	p.gauge("vg_dc_slots", "Endpoint slots by the pair state, the draining pairs are not active.", slots...)
+	p.gauge("vg_dc_free_slots", "Endpoint slots without brigades by the pair state, the quarantined ones are not free.", free...)
+	p.gauge("vg_dc_pairs", "Pairs by state, the draining pairs are not active.", pairs...)
+
+	p.gauge("vg_dc_brigades", "Brigades, the deleted ones are kept until purged.",
+		promSample(float64(m.BrigadesTotal), "state", "total"),
+		promSample(float64(m.BrigadesDeleted), "state", "deleted"),
+	)
+
+	size := make([]sample, 0, len(m.Pools))
+	used := make([]sample, 0, len(m.Pools))
+	util := make([]sample, 0, len(m.Pools))
+
+	for _, u := range m.Pools {
+		size = append(size, promSample(u.Size, "pool", u.Pool, "net", u.Net.String()))
+		used = append(used, promSample(u.Used, "pool", u.Pool, "net", u.Net.String()))
+		util = append(util, promSample(u.Utilization(), "pool", u.Pool, "net", u.Net.String()))
+	}
+
+	p.gauge("vg_dc_pool_size", "Brigades the address pool can hold.", size...)
+	p.gauge("vg_dc_pool_used", "Brigades in the address pool.", used...)
+	p.gauge("vg_dc_pool_utilization", "Used part of the address pool.", util...)
+
+	return p.Flush()
+}
+
+// sample - the gauge value with the label name and value pairs.
+type sample struct {
+	value  float64
+	labels []string
+}
+
+func promSample(value float64, labels ...string) sample {
+	return sample{value: value, labels: labels}
+}
+
+// promWriter - writes the gauges labelled with the datacenter.
+type promWriter struct {
+	*bufio.Writer
+	dc string
+}
+
+func newPromWriter(w io.Writer, dcName, dcID string) *promWriter {
+	return &promWriter{
+		Writer: bufio.NewWriter(w),
+		dc:     fmt.Sprintf(`dc_name="%s",dc_id="%s"`, escapeLabel(dcName), escapeLabel(dcID)),
+	}
+}
+
+func (p *promWriter) gauge(name, help string, samples ...sample) {
+	fmt.Fprintf(p, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+
+	for _, s := range samples {
+		fmt.Fprintf(p, "%s{%s", name, p.dc)
+
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			fmt.Fprintf(p, `,%s="%s"`, s.labels[i], escapeLabel(s.labels[i+1]))
+		}
+
+		fmt.Fprintf(p, "} %g\n", s.value)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,51 @@
+package kdlib
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	m := NewDCMetrics(&Capacity{
+		Pairs: []PairCapacity{
+			{Active: true, Total: 60, Free: 15},
+			{Active: true, Total: 20, Free: 5},
+			{Active: true, Draining: true, Total: 10, Free: 10},
+			{Total: 10},
+		},
+		Pools: []PoolCapacity{
+			{Pool: PoolCGNATIPv4, Net: netip.MustParsePrefix("100.64.0.0/16"), Size: 256, Used: 64, Free: 192},
+			{Pool: PoolULAIPv6, Net: netip.MustParsePrefix("fd00::/48"), Size: 0, Used: 0},
+		},
+	})
+	m.BrigadesTotal, m.BrigadesDeleted = 70, 2
+
+	var buf bytes.Buffer
+
+	if err := m.WritePrometheus(&buf, `dc "one"`, "id\\1"); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE vg_dc_slots gauge",
+		`vg_dc_slots{dc_name="dc \"one\"",dc_id="id\\1",state="total"} 100`,
+		`vg_dc_slots{dc_name="dc \"one\"",dc_id="id\\1",state="active"} 80`,
+		`vg_dc_slots{dc_name="dc \"one\"",dc_id="id\\1",state="draining"} 10`,
+		`vg_dc_slots{dc_name="dc \"one\"",dc_id="id\\1",state="inactive"} 10`,
+		`vg_dc_free_slots{dc_name="dc \"one\"",dc_id="id\\1",state="active"} 20`,
+		`vg_dc_pairs{dc_name="dc \"one\"",dc_id="id\\1",state="active"} 2`,
+		`vg_dc_pairs{dc_name="dc \"one\"",dc_id="id\\1",state="inactive"} 1`,
+		`vg_dc_pairs{dc_name="dc \"one\"",dc_id="id\\1",state="draining"} 1`,
+		`vg_dc_brigades{dc_name="dc \"one\"",dc_id="id\\1",state="deleted"} 2`,
+		`vg_dc_pool_utilization{dc_name="dc \"one\"",dc_id="id\\1",pool="cgnat_ipv4",net="100.64.0.0/16"} 0.25`,
+		`vg_dc_pool_utilization{dc_name="dc \"one\"",dc_id="id\\1",pool="ula_ipv6",net="fd00::/48"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("no line %q in:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package kdlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The stats are collected from the pair for all its brigades at once,
+// so the last brigade update is the last successful collection.
+const sqlPairsStats = `
+SELECT
+	p.pair_id,
+	p.control_ip,
+	p.is_active,
+	(SELECT COUNT(*) FROM %s AS s WHERE s.pair_id = p.pair_id),
+	COUNT(b.brigade_id),
+	COALESCE(SUM(st.active_users_count), 0),
+	MAX(st.update_time)
+FROM %s AS p
+	LEFT JOIN %s AS b ON b.pair_id = p.pair_id
+	LEFT JOIN %s AS st ON st.brigade_id = b.brigade_id
+WHERE
+	$1 = '' OR p.pair_id::text = $1
+GROUP BY p.pair_id
+ORDER BY p.pair_id
+`
+
+// PairStats - the pair items for the monitoring.
+type PairStats struct {
+	PairID      string
+	ControlIP   netip.Addr
+	Active      bool
+	FreeSlots   int64
+	Brigades    int64
+	ActiveUsers int64
+	LastStats   *time.Time
+}
+
+// CollectPairsStats - the stats of the pair, of all the pairs if pairID is empty.
+func CollectPairsStats(ctx context.Context, db *pgxpool.Pool, pairsSchema, brigadesSchema, statsSchema, pairID string) ([]PairStats, error) {
+	rows, err := db.Query(ctx,
+		fmt.Sprintf(sqlPairsStats,
+			pgx.Identifier{brigadesSchema, "slots"}.Sanitize(),
+			pgx.Identifier{pairsSchema, "pairs"}.Sanitize(),
+			pgx.Identifier{brigadesSchema, "brigades"}.Sanitize(),
+			pgx.Identifier{statsSchema, "brigades_stats"}.Sanitize(),
+		),
+		pairID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("pairs query: %w", err)
+	}
+
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PairStats, error) {
+		var p PairStats
+
+		err := row.Scan(&p.PairID, &p.ControlIP, &p.Active, &p.FreeSlots, &p.Brigades, &p.ActiveUsers, &p.LastStats)
+
+		return p, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pairs rows: %w", err)
+	}
+
+	return list, nil
+}
+
+// ZabbixPairsLLD - the Zabbix low-level discovery of the pairs.
+func ZabbixPairsLLD(list []PairStats, dcName, dcID string) ([]byte, error) {
+	lld := make([]map[string]string, 0, len(list))
+
+	for _, p := range list {
+		active := "0"
+		if p.Active {
+			active = "1"
+		}
+
+		lld = append(lld, map[string]string{
+			"{#VPNGEN_DATACENTER_NAME}": dcName,
+			"{#VPNGEN_DATACENTER_ID}":   dcID,
+			"{#VPNGEN_PAIR_ID}":         p.PairID,
+			"{#VPNGEN_PAIR_CONTROL_IP}": p.ControlIP.String(),
+			"{#VPNGEN_PAIR_ACTIVE}":     active,
+		})
+	}
+
+	return json.Marshal(lld)
+}
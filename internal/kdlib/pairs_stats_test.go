@@ -0,0 +1,39 @@
+package kdlib
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+)
+
+func TestZabbixPairsLLD(t *testing.T) {
+	buf, err := ZabbixPairsLLD([]PairStats{
+		{PairID: "11111111-1111-1111-1111-111111111111", ControlIP: netip.MustParseAddr("10.0.0.1"), Active: true},
+		{PairID: "22222222-2222-2222-2222-222222222222", ControlIP: netip.MustParseAddr("10.0.0.2")},
+	}, "dc", "dc-id")
+	if err != nil {
+		t.Fatalf("lld: %s", err)
+	}
+
+	var lld []map[string]string
+
+	if err := json.Unmarshal(buf, &lld); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+
+	if len(lld) != 2 {
+		t.Fatalf("got %d pairs", len(lld))
+	}
+
+	if lld[0]["{#VPNGEN_PAIR_ACTIVE}"] != "1" || lld[1]["{#VPNGEN_PAIR_ACTIVE}"] != "0" {
+		t.Errorf("active: %v", lld)
+	}
+
+	if lld[1]["{#VPNGEN_PAIR_CONTROL_IP}"] != "10.0.0.2" || lld[1]["{#VPNGEN_DATACENTER_ID}"] != "dc-id" {
+		t.Errorf("macros: %v", lld[1])
+	}
+
+	if buf, _ := ZabbixPairsLLD(nil, "dc", "dc-id"); string(buf) != "[]" {
+		t.Errorf("empty: %s", buf)
+	}
+}
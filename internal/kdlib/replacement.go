@@ -0,0 +1,220 @@
+package kdlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultReplaceLimitPeriod - the period of the replacements limit if it isn't set.
+const DefaultReplaceLimitPeriod = 30 * 24 * time.Hour
+
+const defaultReplacementsLimit = 100
+
+const (
+	sqlReplacementsCount = `SELECT COUNT(*) FROM %s WHERE brigade_id=$1 AND replaced_at > now() - make_interval(secs => $2)`
+
+	sqlReplacementLockBrigade = `SELECT 1 FROM %s WHERE brigade_id=$1 FOR UPDATE`
+
+	sqlReplacementInsert = `
+INSERT INTO %s
+	(brigade_id, caller, origin, reason, forced, op_id)
+VALUES
+	($1, $2, $3, $4, $5, $6)
+RETURNING
+	replacement_id,
+	replaced_at
+`
+
+	sqlReplacementDelete = `DELETE FROM %s WHERE replacement_id=$1`
+
+	sqlReplacementsList = `
+SELECT
+	replaced_at,
+	caller,
+	origin,
+	reason,
+	forced,
+	op_id
+FROM %s
+WHERE
+	brigade_id=$1
+ORDER BY replaced_at DESC
+LIMIT $2
+`
+)
+
+var ErrReplaceLimit = errors.New("replacements limit is exceeded")
+
+// Querier - the pool or the transaction.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// ReplacePolicy - max brigadier replacements per brigade in the period, unlimited if Max is zero.
+type ReplacePolicy struct {
+	Max    int
+	Period time.Duration
+}
+
+// Replacement - the brigadier replacement record.
+// The Caller is reported by the caller itself, the Origin is the ssh client address.
+type Replacement struct {
+	ID         int64     `json:"-"`
+	ReplacedAt time.Time `json:"replaced_at"`
+	Caller     string    `json:"caller,omitempty"`
+	Origin     string    `json:"origin,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Forced     bool      `json:"forced,omitempty"`
+	OpID       string    `json:"op_id,omitempty"`
+}
+
+// ReplacePolicyFromEnv - REPLACE_LIMIT and REPLACE_LIMIT_PERIOD.
+func ReplacePolicyFromEnv() (ReplacePolicy, error) {
+	p := ReplacePolicy{Period: DefaultReplaceLimitPeriod}
+
+	if limit := os.Getenv("REPLACE_LIMIT"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid replace limit: %s", limit)
+		}
+
+		p.Max = n
+	}
+
+	if period := os.Getenv("REPLACE_LIMIT_PERIOD"); period != "" {
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("invalid replace limit period: %s", period)
+		}
+
+		p.Period = d
+	}
+
+	return p, nil
+}
+
+func replacementsTable(schema string) string {
+	return pgx.Identifier{schema, "brigadier_replacements"}.Sanitize()
+}
+
+// CountReplacements - the brigade replacements in the policy period.
+func CountReplacements(ctx context.Context, db Querier, schema, brigadeID string, p ReplacePolicy) (int, error) {
+	var n int
+
+	if err := db.QueryRow(ctx,
+		fmt.Sprintf(sqlReplacementsCount, replacementsTable(schema)),
+		brigadeID, p.Period.Seconds(),
+	).Scan(&n); err != nil {
+		return 0, fmt.Errorf("replacements count: %w", err)
+	}
+
+	return n, nil
+}
+
+// CheckReplacePolicy - the next replacement is refused if the limit is reached.
+// The brigade row must be locked in the transaction to serialize the checks.
+func CheckReplacePolicy(ctx context.Context, tx pgx.Tx, schema, brigadeID string, p ReplacePolicy) error {
+	if p.Max == 0 {
+		return nil
+	}
+
+	n, err := CountReplacements(ctx, tx, schema, brigadeID, p)
+	if err != nil {
+		return err
+	}
+
+	if n >= p.Max {
+		return fmt.Errorf("%w: %d in %s", ErrReplaceLimit, n, p.Period)
+	}
+
+	return nil
+}
+
+// ReserveReplacement - records the replacement before it's done on the node,
+// the forced replacement ignores the limit. The brigade row is locked
+// for the check and the record only, not for the node command.
+// The replacement is canceled by CancelReplacement if the node fails.
+func ReserveReplacement(ctx context.Context, db *pgxpool.Pool, schema, brigadeID string, p ReplacePolicy, r *Replacement) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	var found int
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlReplacementLockBrigade, pgx.Identifier{schema, "brigades"}.Sanitize()),
+		brigadeID,
+	).Scan(&found); err != nil {
+		return fmt.Errorf("brigade lock: %w", err)
+	}
+
+	if !r.Forced {
+		if err := CheckReplacePolicy(ctx, tx, schema, brigadeID, p); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.QueryRow(ctx,
+		fmt.Sprintf(sqlReplacementInsert, replacementsTable(schema)),
+		brigadeID, r.Caller, r.Origin, r.Reason, r.Forced, r.OpID,
+	).Scan(&r.ID, &r.ReplacedAt); err != nil {
+		return fmt.Errorf("replacement insert: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+// CancelReplacement - removes the reserved replacement which wasn't done.
+func CancelReplacement(ctx context.Context, db *pgxpool.Pool, schema string, r *Replacement) error {
+	if _, err := db.Exec(ctx, fmt.Sprintf(sqlReplacementDelete, replacementsTable(schema)), r.ID); err != nil {
+		return fmt.Errorf("replacement delete: %w", err)
+	}
+
+	return nil
+}
+
+// ListReplacements - the brigade replacements, the last first.
+func ListReplacements(ctx context.Context, db Querier, schema, brigadeID string, limit int) ([]*Replacement, error) {
+	if limit <= 0 {
+		limit = defaultReplacementsLimit
+	}
+
+	rows, err := db.Query(ctx, fmt.Sprintf(sqlReplacementsList, replacementsTable(schema)), brigadeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("replacements query: %w", err)
+	}
+
+	defer rows.Close()
+
+	var list []*Replacement
+
+	for rows.Next() {
+		var r Replacement
+
+		if err := rows.Scan(&r.ReplacedAt, &r.Caller, &r.Origin, &r.Reason, &r.Forced, &r.OpID); err != nil {
+			return nil, fmt.Errorf("replacement row: %w", err)
+		}
+
+		list = append(list, &r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("replacements rows: %w", err)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,109 @@
+// Package reset re-encrypts the brigade secrets for the new router
+// and optionally moves the brigade to the new endpoint.
+package reset
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"github.com/vpngen/keydesk/keydesk"
+	"github.com/vpngen/keydesk/keydesk/storage"
+	"github.com/vpngen/vpngine/naclkey"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ErrCantDecrypt - can't decrypt.
+var ErrCantDecrypt = errors.New("can't decrypt")
+
+// Storage - the brigade storage in the file.
+func Storage(brigadeID, dbFile string) (*storage.BrigadeStorage, error) {
+	db := &storage.BrigadeStorage{
+		BrigadeID:       brigadeID,
+		BrigadeFilename: dbFile,
+		BrigadeSpinlock: dbFile + ".lock",
+		APIAddrPort:     netip.AddrPort{},
+		BrigadeStorageOpts: storage.BrigadeStorageOpts{
+			MaxUsers:               keydesk.MaxUsers,
+			MonthlyQuotaRemaining:  keydesk.MonthlyQuotaRemaining,
+			MaxUserInctivityPeriod: keydesk.DefaultMaxUserInactivityPeriod,
+		},
+	}
+
+	if err := db.SelfCheckAndInit(); err != nil {
+		return nil, fmt.Errorf("storage initialization: %w", err)
+	}
+
+	return db, nil
+}
+
+// Do - re-encrypts the brigade and the users secrets for the router,
+// the endpoint is replaced if it's valid.
+func Do(db *storage.BrigadeStorage, routerKey *[naclkey.NaclBoxKeyLength]byte, shufflerKeys *naclkey.NaclBoxKeypair, epAddr netip.Addr) error {
+	f, data, err := db.OpenDbToModify()
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+
+	defer f.Close()
+
+	if epAddr.IsValid() {
+		data.EndpointIPv4 = epAddr
+	}
+
+	wgPrivateRouterEnc, err := reEncrypt(routerKey, shufflerKeys, data.WgPrivateShufflerEnc)
+	if err != nil {
+		return fmt.Errorf("re-encrypt wg private: %w", err)
+	}
+
+	data.WgPrivateRouterEnc = wgPrivateRouterEnc
+
+	for _, user := range data.Users {
+		wgPSKRouterEnc, err := reEncrypt(routerKey, shufflerKeys, user.WgPSKShufflerEnc)
+		if err != nil {
+			return fmt.Errorf("re-encrypt wg psk: %w", err)
+		}
+
+		user.WgPSKRouterEnc = wgPSKRouterEnc
+	}
+
+	if err := f.Commit(data); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+func reEncrypt(routerKey *[naclkey.NaclBoxKeyLength]byte, shufflerKeys *naclkey.NaclBoxKeypair, payload []byte) ([]byte, error) {
+	slog.Debug("re-encrypting", "bytes", len(payload))
+
+	decrypted, ok := box.OpenAnonymous(nil, payload, &shufflerKeys.Public, &shufflerKeys.Private)
+
+	if !ok {
+		return nil, fmt.Errorf("open: %w", ErrCantDecrypt)
+	}
+
+	reEncrypted, err := box.SealAnonymous(nil, decrypted, routerKey, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("seal: %w", err)
+	}
+
+	return reEncrypted, nil
+}
+
+// ReadKeys - the router public key and the shuffler keypair.
+func ReadKeys(routerFile, shufflerFile string) (*[naclkey.NaclBoxKeyLength]byte, *naclkey.NaclBoxKeypair, error) {
+	routerKey, err := naclkey.ReadPublicKeyFile(routerFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("router key: %w", err)
+	}
+
+	shufflerKeys, err := naclkey.ReadKeypairFile(shufflerFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("shuffler key: %w", err)
+	}
+
+	return &routerKey, &shufflerKeys, nil
+}
@@ -5,13 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 )
 
 const (
@@ -85,6 +88,8 @@ func SSHSessionStart(client *ssh.Client, b, e *bytes.Buffer, cmd string, data io
 	session.Stdout = b
 	session.Stderr = e
 
+	SSHSetOpID(session)
+
 	go func() {
 		stdin, err := session.StdinPipe()
 		if err != nil {
@@ -111,6 +116,18 @@ func SSHSessionStart(client *ssh.Client, b, e *bytes.Buffer, cmd string, data io
 	return nil
 }
 
+var opIDRefused sync.Once
+
+// SSHSetOpID - passes the operation ID to the remote command. The server drops it
+// unless sshd has "AcceptEnv OP_ID", see sshd-op-id.conf-sample, it's warned once.
+func SSHSetOpID(session *ssh.Session) {
+	if err := session.Setenv(logging.OpIDEnv, logging.OpID()); err != nil {
+		opIDRefused.Do(func() {
+			slog.Warn("the operation ID isn't accepted by the ssh server, AcceptEnv "+logging.OpIDEnv+" is needed", logging.KeyError, err)
+		})
+	}
+}
+
 func SSHSessionRun(client *ssh.Client, b, e *bytes.Buffer, cmd string) error {
 	session, err := client.NewSession()
 	if err != nil {
@@ -121,6 +138,8 @@ func SSHSessionRun(client *ssh.Client, b, e *bytes.Buffer, cmd string) error {
 	session.Stdout = b
 	session.Stderr = e
 
+	SSHSetOpID(session)
+
 	if err := session.Run(cmd); err != nil {
 		return fmt.Errorf("run: %w", err)
 	}
@@ -139,12 +158,9 @@ func NewSSHCient(sshconf *ssh.ClientConfig, server string) (*ssh.Client, *bytes.
 	f := func(logtag string) {
 		switch errstr := e.String(); errstr {
 		case "":
-			fmt.Fprintf(os.Stderr, "%s: SSH Session StdErr: empty\n", logtag)
+			slog.Debug("ssh session stderr is empty", "tag", logtag, "server", server)
 		default:
-			fmt.Fprintf(os.Stderr, "%s: SSH Session StdErr:\n", logtag)
-			for _, line := range strings.Split(errstr, "\n") {
-				fmt.Fprintf(os.Stderr, "%s: | %s\n", logtag, line)
-			}
+			slog.Info("ssh session stderr", "tag", logtag, "server", server, "stderr", logging.Lines(errstr))
 		}
 	}
 
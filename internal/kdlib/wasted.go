@@ -0,0 +1,132 @@
+package kdlib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Wasted brigades selectors.
+const (
+	WastedNotVisited = "notvisited"
+	WastedInactive   = "inactive"
+)
+
+const wastedUpdateTimeFreshness = 1 // hours
+
+const (
+	sqlWastedNotVisited = `
+SELECT
+	s.brigade_id
+FROM
+	%s AS s
+WHERE
+	s.update_time > now() - ($1 * INTERVAL '1 hours')
+AND
+	s.created_at < now() - ($2 * INTERVAL '1 days')
+AND
+	s.total_users_count=1
+AND
+	s.first_visit IS NULL
+AND
+	NOT EXISTS (SELECT 1 FROM %s AS d WHERE d.brigade_id = s.brigade_id)
+ORDER BY
+	s.created_at ASC
+LIMIT $3::int
+`
+
+	sqlWastedInactive = `
+SELECT
+	s.brigade_id
+FROM
+	%s AS s
+WHERE
+	(
+		(s.update_time > now() - ($1 * INTERVAL '1 days'))
+	OR
+		-- it's for resolve corrupted brigade deletion
+		((s.update_time < now() - ($1 * INTERVAL '1 days')) AND (s.update_time>=$2))
+	)
+AND
+	s.created_at < $3
+AND
+	s.active_users_count < $4::int
+AND
+	NOT EXISTS (SELECT 1 FROM %s AS d WHERE d.brigade_id = s.brigade_id)
+ORDER BY
+	s.created_at ASC
+LIMIT $5::int
+`
+)
+
+// WastedParams - the wasted brigades selection.
+type WastedParams struct {
+	// Selector - WastedNotVisited or WastedInactive.
+	Selector string `json:"selector"`
+	// Days - notvisited: days limit to the first visit.
+	Days int `json:"days,omitempty"`
+	// Months - inactive: months limit from the registration.
+	Months int `json:"months,omitempty"`
+	// MinActive - inactive: minimum active users count for the live brigade.
+	MinActive int `json:"min_active,omitempty"`
+	// Num - max brigades.
+	Num int `json:"num"`
+}
+
+// SelectWasted - the oldest wasted brigades, the deleted ones are skipped.
+func SelectWasted(ctx context.Context, db *pgxpool.Pool, brigadesSchema, statsSchema string, p WastedParams) ([]string, error) {
+	var (
+		rows pgx.Rows
+		err  error
+	)
+
+	deleted := pgx.Identifier{brigadesSchema, "brigades_deleted"}.Sanitize()
+	stats := pgx.Identifier{statsSchema, "brigades_stats"}.Sanitize()
+
+	switch p.Selector {
+	case WastedNotVisited:
+		rows, err = db.Query(ctx,
+			fmt.Sprintf(sqlWastedNotVisited, stats, deleted),
+			wastedUpdateTimeFreshness,
+			p.Days,
+			p.Num,
+		)
+	case WastedInactive:
+		t := time.Now().UTC()
+		firstDayOfMonth := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		maxCreatedAt := firstDayOfMonth.AddDate(0, -p.Months, 0)
+
+		rows, err = db.Query(ctx,
+			fmt.Sprintf(sqlWastedInactive, stats, deleted),
+			wastedUpdateTimeFreshness,
+			firstDayOfMonth,
+			maxCreatedAt,
+			p.MinActive,
+			p.Num,
+		)
+	default:
+		return nil, fmt.Errorf("unknown selector: %s", p.Selector)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("brigades query: %w", err)
+	}
+
+	var (
+		id  string
+		ids []string
+	)
+
+	if _, err := pgx.ForEachRow(rows, []any{&id}, func() error {
+		ids = append(ids, id)
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("brigade row: %w", err)
+	}
+
+	return ids, nil
+}
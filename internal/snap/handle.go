@@ -2,16 +2,17 @@ package snap
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
 
 	dcmgmt "github.com/vpngen/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 )
 
 // HandleSnapsStream - handle stats stream and update snaps and write to the file.
-func HandleSnapsStream(logTag string, data *dcmgmt.AggrSnaps, filename string, stream <-chan *IncomingSnaps, wg *sync.WaitGroup) {
+func HandleSnapsStream(data *dcmgmt.AggrSnaps, filename string, stream <-chan *IncomingSnaps, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for snap := range stream {
@@ -22,7 +23,7 @@ func HandleSnapsStream(logTag string, data *dcmgmt.AggrSnaps, filename string, s
 
 	f, err := os.Create(filename + fileTempSuffix)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: create stats file: %s\n", logTag, err)
+		slog.Error("can't create snaps file", "file", filename, logging.KeyError, err)
 
 		return
 	}
@@ -32,7 +33,7 @@ func HandleSnapsStream(logTag string, data *dcmgmt.AggrSnaps, filename string, s
 	data.UpdateTime = time.Now().UTC()
 
 	if err := json.NewEncoder(f).Encode(data); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: encode stats: %s\n", logTag, err)
+		slog.Error("can't encode snaps", "file", filename, logging.KeyError, err)
 
 		return
 	}
@@ -41,21 +42,21 @@ func HandleSnapsStream(logTag string, data *dcmgmt.AggrSnaps, filename string, s
 
 	if _, err := os.Stat(filename); !os.IsNotExist(err) {
 		if err := os.Remove(filename); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: remove stats file: %s\n", logTag, err)
+			slog.Error("can't remove snaps file", "file", filename, logging.KeyError, err)
 
 			return
 		}
 	}
 
 	if err := os.Link(filename+fileTempSuffix, filename); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: link stats file: %s\n", logTag, err)
+		slog.Error("can't link snaps file", "file", filename, logging.KeyError, err)
 
 		return
 	}
 
 	if _, err := os.Stat(filename + fileTempSuffix); !os.IsNotExist(err) {
 		if err := os.Remove(filename + fileTempSuffix); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: remove temp stats file: %s\n", logTag, err)
+			slog.Error("can't remove temp snaps file", "file", filename+fileTempSuffix, logging.KeyError, err)
 
 			return
 		}
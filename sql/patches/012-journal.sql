@@ -0,0 +1,22 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '012-journal', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps']);
+
+CREATE TABLE :"schema_brigades_name".brigades_journal (
+    brigade_id      uuid PRIMARY KEY NOT NULL,
+    operation       text NOT NULL,
+    step            text NOT NULL DEFAULT '',
+    steps_done      text[] NOT NULL DEFAULT '{}',
+    state           text NOT NULL,
+    payload         json NOT NULL,
+    answer          json,
+    last_error      text,
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    update_time     timestamp without time zone NOT NULL DEFAULT now()
+);
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".brigades_journal TO :"brigades_dbuser";
+
+COMMIT;
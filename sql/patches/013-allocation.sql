@@ -0,0 +1,13 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '013-allocation', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal']);
+
+-- Concurrent brigade allocations don't lock the table anymore,
+-- the unique constraints reject the loser of the race, it retries.
+CREATE UNIQUE INDEX brigades_ipv4_cgnat_net_key ON :"schema_brigades_name".brigades ((network(ipv4_cgnat)));
+CREATE UNIQUE INDEX brigades_ipv6_ula_net_key ON :"schema_brigades_name".brigades ((network(ipv6_ula)));
+ALTER TABLE :"schema_brigades_name".brigades ADD CONSTRAINT brigades_keydesk_ipv6_key UNIQUE (keydesk_ipv6);
+
+COMMIT;
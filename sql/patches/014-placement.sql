@@ -0,0 +1,10 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '014-placement', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation']);
+
+-- Pairs labels for the labels placement policy, e.g. region or hardware class.
+ALTER TABLE :"schema_pairs_name".pairs ADD COLUMN labels text[] NOT NULL DEFAULT '{}';
+
+COMMIT;
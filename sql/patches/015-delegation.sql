@@ -0,0 +1,25 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '015-delegation', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement']);
+
+-- Brigades created without waiting for the delegation,
+-- the pending ones are checked by checkdelegation.
+CREATE TABLE :"schema_brigades_name".brigades_delegation (
+    brigade_id      uuid PRIMARY KEY NOT NULL,
+    state           text NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'done')),
+    keydesk_ok      boolean NOT NULL DEFAULT false,
+    domain_ok       boolean NOT NULL DEFAULT false,
+    attempts        int NOT NULL DEFAULT 0,
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    check_time      timestamp without time zone NOT NULL DEFAULT now(),
+    FOREIGN KEY (brigade_id) REFERENCES :"schema_brigades_name".brigades (brigade_id) ON DELETE CASCADE
+);
+
+CREATE INDEX brigades_delegation_pending_idx ON :"schema_brigades_name".brigades_delegation (created_at) WHERE state = 'pending';
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".brigades_delegation TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".brigades_delegation TO :"stats_dbuser";
+
+COMMIT;
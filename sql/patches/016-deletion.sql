@@ -0,0 +1,21 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '016-deletion', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation']);
+
+-- Brigades marked as deleted, they are suspended on the nodes
+-- and keep the slots and the domains until purged.
+CREATE TABLE :"schema_brigades_name".brigades_deleted (
+    brigade_id      uuid PRIMARY KEY NOT NULL,
+    deleted_at      timestamp without time zone NOT NULL DEFAULT now(),
+    purge_after     timestamp without time zone NOT NULL,
+    FOREIGN KEY (brigade_id) REFERENCES :"schema_brigades_name".brigades (brigade_id) ON DELETE CASCADE
+);
+
+CREATE INDEX brigades_deleted_purge_idx ON :"schema_brigades_name".brigades_deleted (purge_after);
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".brigades_deleted TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".brigades_deleted TO :"stats_dbuser";
+
+COMMIT;
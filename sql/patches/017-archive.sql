@@ -0,0 +1,39 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '017-archive', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion']);
+
+ALTER TABLE :"schema_brigades_name".brigades_deleted ADD COLUMN reason text NOT NULL DEFAULT '';
+
+-- Purged brigades with their allocation and the last stats,
+-- for the abuse reports and audits. The brigade ID may be reused, so it's not unique.
+CREATE TABLE :"schema_brigades_name".brigades_archive (
+    archive_id      bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    brigade_id      uuid NOT NULL,
+    pair_id         uuid NOT NULL,
+    control_ip      inet NOT NULL,
+    brigadier       text NOT NULL,
+    endpoint_ipv4   inet NOT NULL,
+    domain_name     text DEFAULT NULL,
+    dns_ipv4        inet NOT NULL,
+    dns_ipv6        inet NOT NULL,
+    keydesk_ipv6    inet NOT NULL,
+    ipv4_cgnat      inet NOT NULL,
+    ipv6_ula        inet NOT NULL,
+    person          json NOT NULL,
+    stats           jsonb DEFAULT NULL,
+    deleted_at      timestamp without time zone NOT NULL,
+    purged_at       timestamp without time zone NOT NULL DEFAULT now(),
+    reason          text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX brigades_archive_brigade_id_idx ON :"schema_brigades_name".brigades_archive (brigade_id);
+CREATE INDEX brigades_archive_brigadier_idx ON :"schema_brigades_name".brigades_archive (brigadier);
+CREATE INDEX brigades_archive_endpoint_ipv4_idx ON :"schema_brigades_name".brigades_archive (endpoint_ipv4);
+CREATE INDEX brigades_archive_domain_name_idx ON :"schema_brigades_name".brigades_archive (domain_name);
+
+GRANT SELECT,INSERT ON :"schema_brigades_name".brigades_archive TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".brigades_archive TO :"stats_dbuser";
+
+COMMIT;
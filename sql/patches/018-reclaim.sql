@@ -0,0 +1,34 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '018-reclaim', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive']);
+
+-- Bulk deletion runs of the wasted brigades.
+CREATE TABLE :"schema_brigades_name".reclaim_runs (
+    run_id          bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    params          jsonb NOT NULL,
+    state           text NOT NULL DEFAULT 'running' CHECK (state IN ('running', 'done')),
+    op_id           text NOT NULL DEFAULT '',
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    update_time     timestamp without time zone NOT NULL DEFAULT now()
+);
+
+-- The brigades selected by the run, the brigade can be purged later,
+-- so there is no foreign key to the brigades.
+CREATE TABLE :"schema_brigades_name".reclaim_items (
+    run_id          bigint NOT NULL,
+    brigade_id      uuid NOT NULL,
+    state           text NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'done', 'skipped', 'failed')),
+    error           text NOT NULL DEFAULT '',
+    update_time     timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (run_id, brigade_id),
+    FOREIGN KEY (run_id) REFERENCES :"schema_brigades_name".reclaim_runs (run_id) ON DELETE CASCADE
+);
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".reclaim_runs TO :"brigades_dbuser";
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".reclaim_items TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".reclaim_runs TO :"stats_dbuser";
+GRANT SELECT ON :"schema_brigades_name".reclaim_items TO :"stats_dbuser";
+
+COMMIT;
@@ -0,0 +1,24 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '019-replacements', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim']);
+
+-- Brigadier replacements history, it outlives the purged brigade
+-- for the support requests, so there is no foreign key to the brigades.
+CREATE TABLE :"schema_brigades_name".brigadier_replacements (
+    replacement_id  bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    brigade_id      uuid NOT NULL,
+    replaced_at     timestamp without time zone NOT NULL DEFAULT now(),
+    caller          text NOT NULL DEFAULT '',
+    reason          text NOT NULL DEFAULT '',
+    forced          boolean NOT NULL DEFAULT false,
+    op_id           text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX brigadier_replacements_brigade_idx ON :"schema_brigades_name".brigadier_replacements (brigade_id, replaced_at);
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".brigadier_replacements TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".brigadier_replacements TO :"stats_dbuser";
+
+COMMIT;
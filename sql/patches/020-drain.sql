@@ -0,0 +1,27 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '020-drain', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements']);
+
+-- The draining pair is still active for its brigades,
+-- but it doesn't take the new ones and the moved ones.
+ALTER TABLE :"schema_pairs_name".pairs ADD COLUMN is_draining bool NOT NULL DEFAULT false;
+
+CREATE OR REPLACE VIEW :"schema_brigades_name".active_pairs AS 
+    SELECT 
+        pairs.pair_id, 
+        COUNT(pairs_endpoints_ipv4.*)-COUNT(brigades.*) AS free_slots_count
+    FROM 
+        :"schema_pairs_name".pairs 
+        JOIN :"schema_pairs_name".pairs_endpoints_ipv4 ON pairs_endpoints_ipv4.pair_id=pairs.pair_id
+        LEFT JOIN :"schema_brigades_name".brigades ON brigades.endpoint_ipv4=pairs_endpoints_ipv4.endpoint_ipv4
+    WHERE
+            pairs.is_active
+            AND NOT pairs.is_draining
+    GROUP BY pairs.pair_id
+    HAVING
+        COUNT(pairs_endpoints_ipv4.*)-COUNT(brigades.*) > 0
+;
+
+COMMIT;
@@ -0,0 +1,68 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '021-quarantine', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain']);
+
+-- The endpoints blocked somewhere, they are not given to the brigades until released.
+CREATE TABLE :"schema_pairs_name".endpoints_quarantine (
+    endpoint_ipv4       inet PRIMARY KEY,
+    brigade_id          uuid,
+    reason              text NOT NULL DEFAULT '',
+    quarantined_at      timestamp without time zone NOT NULL DEFAULT now(),
+    op_id               text NOT NULL DEFAULT '',
+    FOREIGN KEY (endpoint_ipv4) REFERENCES :"schema_pairs_name".pairs_endpoints_ipv4 (endpoint_ipv4)
+);
+
+DROP VIEW IF EXISTS :"schema_brigades_name".slots;
+CREATE VIEW :"schema_brigades_name".slots AS 
+    SELECT
+        pairs.pair_id,
+        pairs.control_ip,
+        pairs_endpoints_ipv4.endpoint_ipv4,
+        domains_endpoints_ipv4.domain_name
+    FROM 
+        :"schema_pairs_name".pairs
+        JOIN :"schema_pairs_name".pairs_endpoints_ipv4 ON pairs_endpoints_ipv4.pair_id = pairs.pair_id
+        LEFT JOIN :"schema_brigades_name".brigades ON brigades.endpoint_ipv4 = pairs_endpoints_ipv4.endpoint_ipv4
+        LEFT JOIN :"schema_brigades_name".domains_endpoints_ipv4 ON domains_endpoints_ipv4.endpoint_ipv4 = pairs_endpoints_ipv4.endpoint_ipv4
+    WHERE
+        NOT EXISTS (
+            SELECT
+            FROM :"schema_pairs_name".pairs_endpoints_ipv4
+            WHERE endpoint_ipv4 = brigades.endpoint_ipv4
+        )
+        AND NOT EXISTS (
+            SELECT
+            FROM :"schema_pairs_name".endpoints_quarantine
+            WHERE endpoints_quarantine.endpoint_ipv4 = pairs_endpoints_ipv4.endpoint_ipv4
+        );
+
+CREATE OR REPLACE VIEW :"schema_brigades_name".active_pairs AS 
+    SELECT 
+        pairs.pair_id, 
+        COUNT(pairs_endpoints_ipv4.*)-COUNT(brigades.*)-COUNT(endpoints_quarantine.*) AS free_slots_count
+    FROM 
+        :"schema_pairs_name".pairs 
+        JOIN :"schema_pairs_name".pairs_endpoints_ipv4 ON pairs_endpoints_ipv4.pair_id=pairs.pair_id
+        LEFT JOIN :"schema_brigades_name".brigades ON brigades.endpoint_ipv4=pairs_endpoints_ipv4.endpoint_ipv4
+        LEFT JOIN :"schema_pairs_name".endpoints_quarantine ON endpoints_quarantine.endpoint_ipv4=pairs_endpoints_ipv4.endpoint_ipv4
+            AND brigades.endpoint_ipv4 IS NULL
+    WHERE
+            pairs.is_active
+            AND NOT pairs.is_draining
+    GROUP BY pairs.pair_id
+    HAVING
+        COUNT(pairs_endpoints_ipv4.*)-COUNT(brigades.*)-COUNT(endpoints_quarantine.*) > 0
+;
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_pairs_name".endpoints_quarantine TO :"pairs_dbuser";
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_pairs_name".endpoints_quarantine TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_pairs_name".endpoints_quarantine TO :"stats_dbuser";
+
+-- The recreated view has lost its grants.
+GRANT SELECT ON :"schema_brigades_name".slots TO :"pairs_dbuser";
+GRANT SELECT ON :"schema_brigades_name".slots TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".slots TO :"stats_dbuser";
+
+COMMIT;
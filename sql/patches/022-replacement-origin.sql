@@ -0,0 +1,10 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '022-replacement-origin', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain', '021-quarantine']);
+
+-- The caller is reported by the caller itself, the origin is the ssh client address.
+ALTER TABLE :"schema_brigades_name".brigadier_replacements ADD COLUMN origin text NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,18 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '023-journal-grants', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain', '021-quarantine', '022-replacement-origin']);
+
+-- The journal keeps the brigadier private configs for a while, it's for the brigades operations only.
+-- The grants on all the tables of the schema and the default privileges have given it to everyone,
+-- so the later patches must not grant all the tables of the schema again.
+REVOKE ALL ON :"schema_brigades_name".brigades_journal FROM :"pairs_dbuser";
+REVOKE ALL ON :"schema_brigades_name".brigades_journal FROM :"stats_dbuser";
+REVOKE ALL ON :"schema_brigades_name".brigades_journal FROM :"snaps_dbuser";
+REVOKE ALL ON :"schema_brigades_name".brigades_journal FROM :"migr_dbuser";
+
+-- The answers are cleared after a while.
+CREATE INDEX brigades_journal_answer_idx ON :"schema_brigades_name".brigades_journal (update_time) WHERE answer IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,16 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '024-deletion-state', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain', '021-quarantine', '022-replacement-origin', '023-journal-grants']);
+
+-- The brigade is suspended on the node only if the node can,
+-- the brigades deleted before are all suspended.
+ALTER TABLE :"schema_brigades_name".brigades_deleted ADD COLUMN suspended boolean NOT NULL DEFAULT true;
+ALTER TABLE :"schema_brigades_name".brigades_deleted ALTER COLUMN suspended SET DEFAULT false;
+
+-- The purge destroys the brigade on the node out of the transaction,
+-- the started purge keeps the undelete away.
+ALTER TABLE :"schema_brigades_name".brigades_deleted ADD COLUMN purge_started_at timestamp without time zone;
+
+COMMIT;
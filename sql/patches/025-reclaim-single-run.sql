@@ -0,0 +1,10 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '025-reclaim-single-run', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain', '021-quarantine', '022-replacement-origin', '023-journal-grants', '024-deletion-state']);
+
+-- Only one reclaim run is running at a time.
+CREATE UNIQUE INDEX reclaim_runs_running_idx ON :"schema_brigades_name".reclaim_runs ((true)) WHERE state = 'running';
+
+COMMIT;
@@ -0,0 +1,22 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '026-leftovers', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain', '021-quarantine', '022-replacement-origin', '023-journal-grants', '024-deletion-state', '025-reclaim-single-run']);
+
+-- The suspended old copies of the moved brigades, they are destroyed
+-- when the delegation follows the new copy. The brigade may be purged before,
+-- so there is no foreign key to the brigades.
+CREATE TABLE :"schema_brigades_name".brigades_leftovers (
+    brigade_id      uuid NOT NULL,
+    control_ip      inet NOT NULL,
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (brigade_id, control_ip)
+);
+
+CREATE INDEX brigades_leftovers_control_ip_idx ON :"schema_brigades_name".brigades_leftovers (control_ip);
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".brigades_leftovers TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".brigades_leftovers TO :"stats_dbuser";
+
+COMMIT;
@@ -0,0 +1,22 @@
+BEGIN;
+
+SELECT _v.assert_user_is_superuser();
+
+SELECT _v.register_patch( '027-domains-retiring', ARRAY[ '001-init', '002-roles', '003-stats', '004-stats', '005-stats', '006-stats', '007-stats', '008-domains', '009-domains', '010-viewfixes', '011-collectsnaps', '012-journal', '013-allocation', '014-placement', '015-delegation', '016-deletion', '017-archive', '018-reclaim', '019-replacements', '020-drain', '021-quarantine', '022-replacement-origin', '023-journal-grants', '024-deletion-state', '025-reclaim-single-run', '026-leftovers']);
+
+-- The old domains of the rotated brigades, they stay in the delegation list
+-- on the brigade endpoint until the node and the users are switched to the new ones.
+CREATE TABLE :"schema_brigades_name".domains_retiring (
+    domain_name     text PRIMARY KEY NOT NULL,
+    endpoint_ipv4   inet NOT NULL,
+    brigade_id      uuid NOT NULL,
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    FOREIGN KEY (brigade_id) REFERENCES :"schema_brigades_name".brigades (brigade_id)
+);
+
+CREATE INDEX domains_retiring_brigade_idx ON :"schema_brigades_name".domains_retiring (brigade_id);
+
+GRANT SELECT,INSERT,UPDATE,DELETE ON :"schema_brigades_name".domains_retiring TO :"brigades_dbuser";
+GRANT SELECT ON :"schema_brigades_name".domains_retiring TO :"stats_dbuser";
+
+COMMIT;
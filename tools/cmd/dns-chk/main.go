@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	dcmgmt "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/kdname"
 )
 
 func main() {
@@ -15,6 +16,8 @@ func main() {
 	kd := flag.Bool("kd", false, "It is a keydesk address")
 	ipstr := flag.String("ip", "", "IP address")
 	srv := flag.String("ns", "", "nameservers, comma separated")
+	zone := flag.String("zone", "vpn.works", "keydesk zone")
+	scheme := flag.String("scheme", kdname.SchemeLegacy, "keydesk name scheme: legacy|hex")
 
 	flag.Parse()
 
@@ -30,11 +33,15 @@ func main() {
 	}
 
 	if *kd {
-		if !ip.Is6() || !strings.HasPrefix(*ipstr, "fd") {
-			log.Fatalf("Keydesk IP address must be IPv6 and start with fd\n")
+		names, err := kdname.New(*zone, *scheme)
+		if err != nil {
+			log.Fatalf("Can't use keydesk names: %s\n", err)
 		}
 
-		*domain = strings.ReplaceAll(strings.Replace(*ipstr, (*ipstr)[:2], "w", 1), ":", "s") + ".vpn.works"
+		*domain, err = names.Encode(ip)
+		if err != nil {
+			log.Fatalf("Can't make keydesk name: %s\n", err)
+		}
 	}
 
 	// servers := strings.Split(*srv, ",")
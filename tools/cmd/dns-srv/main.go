@@ -1,20 +1,38 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"strings"
 
 	"github.com/miekg/dns"
+
+	"github.com/vpngen/dc-mgmt/internal/kdlib/kdname"
 )
 
+var names *kdname.Codec
+
 func main() {
-	server := &dns.Server{Addr: "127.0.0.1:5353", Net: "udp"}
-	dns.HandleFunc(".", handleDnsRequest)
-	err := server.ListenAndServe()
+	listen := flag.String("l", "127.0.0.1:5353", "listen address")
+	zone := flag.String("zone", "", "keydesk zone, any zone if empty")
+	scheme := flag.String("scheme", kdname.SchemeLegacy, "keydesk name scheme: legacy|hex")
+
+	flag.Parse()
+
+	var err error
+
+	names, err = kdname.New(*zone, *scheme)
 	if err != nil {
+		log.Fatalf("Can't use keydesk names: %s\n", err)
+	}
+
+	server := &dns.Server{Addr: *listen, Net: "udp"}
+	dns.HandleFunc(".", handleDnsRequest)
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %s\n", err.Error())
 	}
 }
@@ -43,19 +61,20 @@ func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m.Authoritative = false
 
 	for _, q := range m.Question {
-		sub, _, ok := strings.Cut(q.Name, ".")
-		if !ok {
+		ip, err := decode(q.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't decode name: %s\n", err)
+
 			continue
 		}
 
-		ip := strings.ReplaceAll(strings.Replace(sub, "w", "fd", 1), "s", ":")
 		fmt.Fprintf(os.Stderr, "ip: %s\n", ip)
 
 		switch q.Qtype {
 		case dns.TypeAAAA:
 			rr := new(dns.AAAA)
 			rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}
-			rr.AAAA = net.ParseIP(ip)
+			rr.AAAA = net.IP(ip.AsSlice())
 			m.Answer = append(m.Answer, rr)
 		}
 	}
@@ -80,3 +99,14 @@ func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 	fo.Write(buf)
 }
+
+// decode - the keydesk address of the name, the first label only if the zone is not set.
+func decode(name string) (netip.Addr, error) {
+	if names.Zone() != "" {
+		return names.Decode(name)
+	}
+
+	label, _, _ := strings.Cut(name, ".")
+
+	return kdname.DecodeLabel(label, names.Scheme())
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/vpngen/dc-mgmt/internal/kdlib"
 	dcmgmt "github.com/vpngen/dc-mgmt/internal/kdlib/dc-mgmt"
+	"github.com/vpngen/dc-mgmt/internal/kdlib/logging"
 )
 
 const (
@@ -38,6 +39,8 @@ func setLogTag() string {
 }
 
 func main() {
+	logging.Setup(LogTag)
+
 	sshKeyFile, dbname, schema, ident, kdAddrSyncServerUser, kdAddrSyncServer, err := readConfigs()
 	if err != nil {
 		log.Fatalf("%s: Can't read configs: %s\n", LogTag, err)
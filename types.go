@@ -12,6 +12,7 @@ type Answer struct {
 	keydesk.Answer
 	KeydeskIPv6 netip.Addr `json:"keydesk_ipv6"`
 	FreeSlots   int        `json:"free_slots"`
+	Delegation  string     `json:"delegation,omitempty"`
 }
 
 // AggrStatsVersion - current version of aggregated stats.